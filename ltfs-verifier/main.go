@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/sha256"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -16,6 +17,10 @@ const (
 	updateInterval = 500 * time.Millisecond // Update progress every 500ms
 )
 
+// readLimiter 读取限速，由 -limit 设置，为 nil 时不限速。
+// 其他磁带任务同时运行时用来避免抢占驱动器带宽
+var readLimiter *rateLimiter
+
 type ProgressTracker struct {
 	totalBytes         int64
 	processedBytes     int64
@@ -149,13 +154,17 @@ func generateSHA256(filename string, tracker *ProgressTracker) (string, error) {
 
 	hash := sha256.New()
 	buffer := make([]byte, bufferSize)
+	reader := readLimiter.Reader(file)
 
 	log.Printf("开始计算SHA256哈希值...")
 	log.Printf("缓冲区大小: %s", formatBytes(bufferSize))
+	if rate := readLimiter.Rate(); rate > 0 {
+		log.Printf("读取限速: %s/s", formatBytes(rate))
+	}
 	log.Println()
 
 	for {
-		n, err := file.Read(buffer)
+		n, err := reader.Read(buffer)
 		if n > 0 {
 			hash.Write(buffer[:n])
 			tracker.update(int64(n))
@@ -290,6 +299,8 @@ func printUsage() {
 	log.Println("用法:")
 	log.Println("  生成模式: go run sha256_tool.go generate <file>")
 	log.Println("  验证模式: go run sha256_tool.go verify <file>")
+	log.Println("  限速读取: go run sha256_tool.go -limit 50MB verify <file>")
+	log.Println("  限速读取: go run sha256_tool.go verify <file> -limit 50MB")
 	log.Println()
 	log.Println("简写模式:")
 	log.Println("  生成: go run sha256_tool.go gen <file>")
@@ -300,6 +311,7 @@ func printUsage() {
 	log.Println("说明:")
 	log.Println("  generate - 为指定文件生成 .sha256 校验文件")
 	log.Println("  verify   - 验证文件与对应的 .sha256 校验文件")
+	log.Println("  -limit   - 读取限速，如 50MB、500K，0 表示不限速")
 	log.Println()
 	log.Println("功能特性:")
 	log.Println("  • 实时进度显示")
@@ -313,19 +325,48 @@ func printUsage() {
 	log.Println("  go run sha256_tool.go verify large_file.zip")
 }
 
+// parseArgs 解析命令行，返回位置参数。flag.Parse 遇到第一个非 flag 参数就停止，
+// 这里逐段继续解析，-limit 写在模式和文件名之后也能生效；"--" 之后的参数都按位置参数处理
+func parseArgs(rest []string) []string {
+	var args []string
+	for len(rest) > 0 {
+		flag.CommandLine.Parse(rest)
+		if n := len(rest) - flag.NArg(); n > 0 && rest[n-1] == "--" {
+			return append(args, flag.Args()...)
+		}
+		rest = flag.Args()
+		if len(rest) > 0 {
+			args = append(args, rest[0])
+			rest = rest[1:]
+		}
+	}
+	return args
+}
+
 func main() {
-	if len(os.Args) != 3 {
+	limit := flag.String("limit", "", "读取限速，如 50MB，0 表示不限速")
+	flag.Usage = printUsage
+	args := parseArgs(os.Args[1:])
+	if len(args) != 2 {
 		printUsage()
 		os.Exit(1)
 	}
 
-	mode := os.Args[1]
-	filename := os.Args[2]
+	rate, err := parseByteRate(*limit)
+	if err != nil {
+		log.Printf("错误: %v\n", err)
+		os.Exit(1)
+	}
+	if rate > 0 {
+		readLimiter = newRateLimiter(rate)
+	}
+
+	mode := args[0]
+	filename := args[1]
 
 	// 记录开始时间
 	startTime := time.Now()
 
-	var err error
 	switch mode {
 	case "generate", "gen", "g":
 		err = generateSHA256File(filename)
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 与 smb-backup/ratelimit.go 同一个令牌桶，只保留读取限速用到的部分。
+// 两个工具是各自独立的模块、各自单独构建和分发，不为这几十行引入共享模块和 replace，
+// 修改算法时两边一起改
+
+// rateLimiter 令牌桶限速器，可被多个 goroutine 共用。
+// 令牌允许透支：一次取走超过桶容量的字节时先扣成负数再按欠额等待，
+// 这样大缓冲区的读写也能平滑限速。rate 为 0 表示不限速，nil 也表示不限速
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 字节/秒
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate < 0 {
+		rate = 0
+	}
+	r := float64(rate)
+	// 最多积攒 1 秒的令牌
+	return &rateLimiter{rate: r, burst: r, last: time.Now()}
+}
+
+func (l *rateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// Wait 取走 n 个字节的令牌，不够时睡眠到补足为止
+func (l *rateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// Reader 读取后按读到的字节数限速
+func (l *rateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.l.Wait(n)
+	return n, err
+}
+
+// parseByteRate 解析 "5MB"、"500K"、"1.5G"、"10MB/s" 这样的速率，单位按 1024 进位，
+// 不带单位时为字节。空字符串和 "0" 表示不限速
+func parseByteRate(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "/S")
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "IB"), "B")
+	if str == "" {
+		return 0, nil
+	}
+
+	mult := 1.0
+	switch str[len(str)-1] {
+	case 'K':
+		mult = 1 << 10
+	case 'M':
+		mult = 1 << 20
+	case 'G':
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		str = str[:len(str)-1]
+	}
+
+	v, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q, expected a value like 5MB or 500K", s)
+	}
+	return int64(v * mult), nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WorkGate 限制同时处理任务的 worker 数，上限可以在运行中调整。
+// nil 表示不限制。
+type WorkGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active int
+}
+
+func NewWorkGate(limit int) *WorkGate {
+	g := &WorkGate{limit: limit}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// Acquire 等待直到活跃 worker 数低于上限
+func (g *WorkGate) Acquire() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.active >= g.limit {
+		g.cond.Wait()
+	}
+	g.active++
+}
+
+func (g *WorkGate) Release() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	g.cond.Broadcast()
+}
+
+func (g *WorkGate) SetLimit(limit int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.limit = limit
+	g.cond.Broadcast()
+}
+
+// autoTuner 从最小并发开始，吞吐量持续提升就加大 worker 数和连接池，
+// 错误率或延迟明显上升时回退，始终保持在配置的上下限之内
+type autoTuner struct {
+	config *Config
+	pool   *SMBPool
+	gate   *WorkGate
+	stats  *Stats
+
+	routines int
+	step     int
+	lastUp   bool // 上一次调整是否为增加
+	ceiling  int  // 增加到这个并发数时吞吐量没有提升，不再越过它；错误或延迟上升时清除
+
+	lastBytes      int64
+	lastFiles      int64
+	lastErrors     int64
+	lastLatCount   int64
+	lastLatNanos   int64
+	lastThroughput float64
+	baseLatency    time.Duration // 最低并发时观察到的延迟
+}
+
+func newAutoTuner(config *Config, pool *SMBPool, gate *WorkGate, stats *Stats) *autoTuner {
+	return &autoTuner{
+		config:   config,
+		pool:     pool,
+		gate:     gate,
+		stats:    stats,
+		routines: config.MinRoutines,
+		step:     max(1, (config.Routines-config.MinRoutines)/4),
+	}
+}
+
+func (t *autoTuner) run(done <-chan struct{}) {
+	interval := time.Duration(t.config.TuneInterval) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	slog.Info("Auto-tune started", "routines", t.routines, "pool_size", t.pool.Size())
+
+	for {
+		select {
+		case <-ticker.C:
+			t.adjust(interval)
+		case <-done:
+			slog.Info("Auto-tune finished", "routines", t.routines, "pool_size", t.pool.Size())
+			return
+		}
+	}
+}
+
+// adjust 根据上一个周期的吞吐量、错误率和延迟决定下一步
+func (t *autoTuner) adjust(interval time.Duration) {
+	bytes := atomic.LoadInt64(&t.stats.ProcessedBytes)
+	errors := atomic.LoadInt64(&t.stats.ErrorCount)
+	files := atomic.LoadInt64(&t.stats.ProcessedFiles)
+	latCount := atomic.LoadInt64(&t.stats.LatencyCount)
+	latNanos := atomic.LoadInt64(&t.stats.LatencyNanos)
+
+	throughput := float64(bytes-t.lastBytes) / interval.Seconds()
+	newErrors := errors - t.lastErrors
+	errorRate := 0.0
+	if ops := newErrors + files - t.lastFiles; ops > 0 {
+		errorRate = float64(newErrors) / float64(ops)
+	}
+	var latency time.Duration
+	if n := latCount - t.lastLatCount; n > 0 {
+		latency = time.Duration((latNanos - t.lastLatNanos) / n)
+	}
+
+	t.lastBytes, t.lastFiles, t.lastErrors = bytes, files, errors
+	t.lastLatCount, t.lastLatNanos = latCount, latNanos
+
+	if t.baseLatency == 0 || (latency > 0 && latency < t.baseLatency) {
+		t.baseLatency = latency
+	}
+
+	next := t.routines
+	reason := ""
+	switch {
+	case newErrors > 0 && errorRate > 0.05:
+		next = t.routines - t.step
+		reason = "error rate rising"
+		t.ceiling = 0
+	case latency > 0 && t.baseLatency > 0 && latency > t.baseLatency*3:
+		next = t.routines - t.step
+		reason = "latency rising"
+		t.ceiling = 0
+	case t.lastUp && throughput < t.lastThroughput*0.95:
+		// 上次增加后吞吐量没有提升，退回并记下上限，之后停在上限之下
+		t.ceiling = t.routines
+		next = t.routines - t.step
+		reason = "no throughput gain"
+	case throughput > 0 && throughput >= t.lastThroughput*1.05 && (t.ceiling == 0 || t.routines+t.step < t.ceiling):
+		next = t.routines + t.step
+		reason = "throughput improving"
+	}
+	t.lastThroughput = throughput
+
+	next = max(t.config.MinRoutines, min(next, t.config.Routines))
+	t.lastUp = next > t.routines
+	if next == t.routines {
+		t.resizePool(next) // 之前没能关闭的空闲连接
+		return
+	}
+
+	t.routines = next
+	t.gate.SetLimit(next)
+	poolSize := t.resizePool(next)
+
+	slog.Info("Auto-tune adjusted", "reason", reason, "bytes_per_sec", int64(throughput),
+		"error_rate", errorRate, "latency", latency.Round(time.Millisecond), "routines", next, "pool_size", poolSize)
+}
+
+// resizePool 让连接池大小跟随并发数，限制在 min_pool_size 和 pool_size 之间
+func (t *autoTuner) resizePool(routines int) int {
+	target := max(t.config.MinPoolSize, min(routines, t.config.PoolSize))
+
+	for t.pool.Size() < target {
+		if err := t.pool.Grow(); err != nil {
+			slog.Warn("Auto-tune failed to grow pool", "err", err)
+			break
+		}
+	}
+	for t.pool.Size() > target {
+		if !t.pool.Shrink() {
+			break // 没有空闲连接，下个周期再试
+		}
+	}
+
+	return t.pool.Size()
+}
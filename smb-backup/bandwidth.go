@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// bandwidth 所有 worker 共用的全局限速，由 bandwidth_limit 和 bandwidth_schedule 决定速率
+var bandwidth = newRateLimiter(0)
+
+// BandwidthPeriod 一个时间段内的限速，如 {"window": "08:00-23:00", "limit": "5MB"}。
+// limit 为 0 或空表示该时段不限速
+type BandwidthPeriod struct {
+	Window string `json:"window"`
+	Limit  string `json:"limit"`
+
+	window *timeWindow
+	rate   int64
+}
+
+// parseBandwidth 解析限速配置
+func parseBandwidth(config *Config) error {
+	var err error
+	if config.bandwidthLimit, err = parseByteRate(config.BandwidthLimit); err != nil {
+		return fmt.Errorf("bandwidth_limit: %v", err)
+	}
+	if config.connectionLimit, err = parseByteRate(config.ConnectionBandwidthLimit); err != nil {
+		return fmt.Errorf("connection_bandwidth_limit: %v", err)
+	}
+	for i := range config.BandwidthSchedule {
+		p := &config.BandwidthSchedule[i]
+		if p.window, err = parseTimeWindow(p.Window); err != nil {
+			return fmt.Errorf("bandwidth_schedule %d: %v", i+1, err)
+		}
+		if p.rate, err = parseByteRate(p.Limit); err != nil {
+			return fmt.Errorf("bandwidth_schedule %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// bandwidthAt 返回 t 时刻的全局限速：第一个包含 t 的时段优先，都不包含时用 bandwidth_limit
+func (c *Config) bandwidthAt(t time.Time) int64 {
+	for _, p := range c.BandwidthSchedule {
+		if p.window.Contains(t) {
+			return p.rate
+		}
+	}
+	return c.bandwidthLimit
+}
+
+// applyBandwidth 按当前时间设置全局限速，速率变化时输出日志
+func applyBandwidth(config *Config) {
+	rate := config.bandwidthAt(time.Now())
+	if rate == bandwidth.Rate() {
+		return
+	}
+	bandwidth.SetRate(rate)
+	slog.Info("Bandwidth limit set", "rate", formatByteRate(rate))
+}
+
+// bandwidthScheduler 每分钟检查一次限速时段
+func bandwidthScheduler(config *Config, done <-chan struct{}) {
+	if len(config.BandwidthSchedule) == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			applyBandwidth(config)
+		case <-done:
+			return
+		}
+	}
+}
+
+// newConnLimiter 单个上传流的限速器。一个流同一时间只占用一个连接，
+// 所以按流限速等同于按连接限速。未配置时返回 nil
+func newConnLimiter(config *Config) *rateLimiter {
+	if config.connectionLimit == 0 {
+		return nil
+	}
+	return newRateLimiter(config.connectionLimit)
+}
+
+// throttle 依次经过全局和单连接限速
+func throttle(n int, conn *rateLimiter) {
+	bandwidth.Wait(n)
+	conn.Wait(n)
+}
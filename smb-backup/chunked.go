@@ -0,0 +1,523 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// chunkState 大文件分块上传的断点状态，每完成一个分块就写回 state_dir
+type chunkState struct {
+	Source    string    `json:"source"`
+	Dest      string    `json:"dest"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	ChunkSize int64     `json:"chunk_size"`
+	Done      []byte    `json:"done"` // 已完成分块位图
+
+	path string
+	mu   sync.Mutex
+}
+
+// chunkStatePath 根据目标位置生成状态文件路径
+func chunkStatePath(config *Config, destPath string) string {
+	return filepath.Join(config.StateDir, "chunks", destKey(config, destPath)+".json")
+}
+
+// destKey 远端文件在 state_dir 中的文件名
+func destKey(config *Config, destPath string) string {
+	sum := sha1.Sum([]byte(config.Host + "/" + config.Share + "/" + destPath))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadChunkState 读取已有的断点状态，源文件或分块大小变化时重新开始
+func loadChunkState(path string, task FileTask, destPath string, chunkSize int64) *chunkState {
+	state := &chunkState{
+		Source:    task.SourcePath,
+		Dest:      destPath,
+		Size:      task.Size,
+		ModTime:   task.ModTime,
+		ChunkSize: chunkSize,
+		path:      path,
+	}
+	state.Done = make([]byte, (state.count()+7)/8)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state
+	}
+
+	var saved chunkState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		slog.Warn("Ignoring corrupt chunk state file", "path", path, "err", err)
+		return state
+	}
+
+	if saved.Dest != destPath || saved.Size != task.Size || !saved.ModTime.Equal(task.ModTime) ||
+		saved.ChunkSize != chunkSize || len(saved.Done) != len(state.Done) {
+		slog.Info("Source changed since last chunked attempt, restarting", "path", task.SourcePath)
+		return state
+	}
+
+	state.Done = saved.Done
+	return state
+}
+
+func (s *chunkState) count() int {
+	return int((s.Size + s.ChunkSize - 1) / s.ChunkSize)
+}
+
+func (s *chunkState) isDone(i int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Done[i/8]&(1<<(i%8)) != 0
+}
+
+func (s *chunkState) doneCount() int {
+	n := 0
+	for i := 0; i < s.count(); i++ {
+		if s.isDone(i) {
+			n++
+		}
+	}
+	return n
+}
+
+// chunkRange 返回分块在文件中的范围 [start, end)
+func (s *chunkState) chunkRange(i int) (int64, int64) {
+	start := int64(i) * s.ChunkSize
+	end := start + s.ChunkSize
+	if end > s.Size {
+		end = s.Size
+	}
+	return start, end
+}
+
+func (s *chunkState) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.Done {
+		s.Done[i] = 0
+	}
+}
+
+// markDone 标记分块完成并立即持久化
+func (s *chunkState) markDone(i int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Done[i/8] |= 1 << (i % 8)
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *chunkState) remove() {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove chunk state file", "path", s.path, "err", err)
+	}
+}
+
+// chunkedUpload 一个大文件的分块上传过程，多个连接并发写入不同分块
+type chunkedUpload struct {
+	pool     *SMBPool
+	task     FileTask
+	config   *Config
+	stats    *Stats
+	destPath string
+	state    *chunkState
+	src      *os.File
+
+	pending   chan int // 待上传分块，失败的分块重新放回
+	attempts  []int32
+	remaining int32
+	finished  chan struct{}
+	uploaded  int64 // 本次上传完成的分块字节数，已计入进度，文件失败时扣除
+
+	abort     chan struct{}
+	abortOnce sync.Once
+	err       error
+
+	wg sync.WaitGroup
+}
+
+// acquireConnection 获取连接，失败时退避后无限重试，直到被中止
+func acquireConnection(pool *SMBPool) (*SMBConnection, error) {
+	for attempt := 1; ; attempt++ {
+		if control.Aborted() {
+			return nil, errAborted
+		}
+
+		conn, err := pool.GetOrCreate(10 * time.Second)
+		if err == nil {
+			return conn, nil
+		}
+
+		waitTime := time.Second * time.Duration(min(attempt, 30))
+		slog.Warn("Failed to get connection, waiting before retry", "attempt", attempt, "wait", waitTime, "err", err)
+		control.Sleep(waitTime)
+	}
+}
+
+// reconnect 重建损坏的连接并继续使用，重建失败时重新从池中获取
+func reconnect(pool *SMBPool, conn *SMBConnection) (*SMBConnection, error) {
+	newConn, err := pool.RecreateConnection(conn)
+	if err != nil {
+		slog.Warn("Failed to recreate connection, getting a new one", "err", err)
+		return acquireConnection(pool)
+	}
+	return newConn, nil
+}
+
+// prepareChunkedDest 创建目标文件并预设大小，已有进度且远程文件完整时直接复用
+func prepareChunkedDest(share *smb2.Share, state *chunkState, destPath string, dirCreator *DirCreator) error {
+	if idx := strings.LastIndex(destPath, "/"); idx != -1 {
+		if err := dirCreator.EnsureDir(share, destPath[:idx]); err != nil {
+			return fmt.Errorf("create dir '%s': %v", destPath[:idx], err)
+		}
+	}
+
+	if state.doneCount() > 0 {
+		fi, err := share.Stat(destPath)
+		if err == nil && fi.Size() == state.Size {
+			return nil
+		}
+		slog.Info("Remote file missing or resized, discarding saved chunk progress", "dest", destPath)
+		state.reset()
+	}
+
+	dstFile, err := share.Create(destPath)
+	if err != nil {
+		return fmt.Errorf("create dest '%s': %v", destPath, err)
+	}
+	defer dstFile.Close()
+
+	if err := dstFile.Truncate(state.Size); err != nil {
+		return fmt.Errorf("preallocate dest '%s': %v", destPath, err)
+	}
+	return nil
+}
+
+func uploadFileChunked(pool *SMBPool, task FileTask, config *Config, stats *Stats, dirCreator *DirCreator) error {
+	src, err := os.Open(task.SourcePath)
+	if err != nil {
+		stats.recordFailure(task, errorClassRead, err, 1)
+		slog.Error("Upload failed", "path", task.SourcePath, "class", errorClassRead, "err", err)
+		return err
+	}
+	defer src.Close()
+
+	// 以打开时的状态为准，上传完成后再比较一次
+	before, err := src.Stat()
+	if err != nil {
+		stats.recordFailure(task, errorClassRead, err, 1)
+		slog.Error("Upload failed", "path", task.SourcePath, "class", errorClassRead, "err", err)
+		return err
+	}
+	if err := checkObjectSource(task, before); err != nil {
+		return err
+	}
+	task.Size = before.Size()
+	task.ModTime = before.ModTime()
+
+	destPath := dirCreator.names.RemotePath(task)
+	state := loadChunkState(chunkStatePath(config, destPath), task, destPath, config.ChunkSize)
+
+	fail := func(err error, attempts int) error {
+		if err == errAborted {
+			atomic.AddInt64(&stats.InterruptedFiles, 1)
+			slog.Warn("Upload interrupted, progress saved for resume", "path", task.SourcePath)
+			return err
+		}
+		stats.recordFailure(task, errorClass(err), err, attempts)
+		slog.Error("Chunked upload failed", "path", task.SourcePath, "attempts", attempts, "err", err)
+		return err
+	}
+
+	// 准备目标文件
+	conn, err := acquireConnection(pool)
+	if err != nil {
+		return fail(err, 0)
+	}
+	for attempt := 0; ; {
+		err = prepareChunkedDest(conn.share, state, destPath, dirCreator)
+		if err == nil {
+			break
+		}
+
+		if !isTCPConnectionError(err) {
+			attempt++
+			if attempt > config.RetryTimes {
+				pool.Put(conn)
+				return fail(err, attempt)
+			}
+		}
+		slog.Warn("Failed to prepare chunked upload", "dest", destPath, "attempt", attempt, "err", err)
+		if isTCPConnectionError(err) || isSMBSessionError(err) {
+			if conn, err = reconnect(pool, conn); err != nil {
+				return fail(err, attempt)
+			}
+		}
+		if err := control.Sleep(time.Millisecond * time.Duration(200*(attempt+1))); err != nil {
+			pool.Put(conn)
+			return fail(err, attempt)
+		}
+	}
+
+	u := &chunkedUpload{
+		pool:     pool,
+		task:     task,
+		config:   config,
+		stats:    stats,
+		destPath: destPath,
+		state:    state,
+		src:      src,
+		pending:  make(chan int, state.count()),
+		attempts: make([]int32, state.count()),
+		finished: make(chan struct{}),
+		abort:    make(chan struct{}),
+	}
+
+	// 以前上传的分块在整个文件完成后才计入进度，文件失败时不会多算
+	var resumed int64
+	for i := 0; i < state.count(); i++ {
+		if state.isDone(i) {
+			start, end := state.chunkRange(i)
+			resumed += end - start
+			continue
+		}
+		u.pending <- i
+		u.remaining++
+	}
+
+	if done := state.doneCount(); done > 0 {
+		slog.Info("Resuming chunked upload", "path", task.SourcePath, "chunks_done", done, "chunks", state.count())
+	} else {
+		slog.Debug("Chunked upload", "path", task.SourcePath, "chunks", state.count(), "chunk_size", config.ChunkSize)
+	}
+
+	if u.remaining == 0 {
+		close(u.finished)
+		pool.Put(conn)
+	} else {
+		u.wg.Add(1)
+		go u.run(conn)
+
+		// 池中有空闲连接时招募更多连接加入，直到达到上限
+		maxConns := min(config.ChunkConnections, int(u.remaining))
+		helpers := 1
+		recruit := func() {
+			for helpers < maxConns {
+				c := pool.TryGet()
+				if c == nil {
+					return
+				}
+				helpers++
+				u.wg.Add(1)
+				go u.run(c)
+			}
+		}
+		recruit()
+
+		ticker := time.NewTicker(2 * time.Second)
+	wait:
+		for {
+			select {
+			case <-u.finished:
+				break wait
+			case <-u.abort:
+				break wait
+			case <-control.AbortChan():
+				break wait
+			case <-ticker.C:
+				recruit()
+			}
+		}
+		ticker.Stop()
+		u.wg.Wait()
+
+		slog.Debug("Chunked upload used extra connections", "path", task.SourcePath, "connections", helpers)
+	}
+
+	if u.err != nil {
+		atomic.AddInt64(&stats.ProcessedBytes, -atomic.LoadInt64(&u.uploaded))
+		return fail(u.err, config.RetryTimes+1)
+	}
+	if atomic.LoadInt32(&u.remaining) > 0 {
+		atomic.AddInt64(&stats.ProcessedBytes, -atomic.LoadInt64(&u.uploaded))
+		return fail(errAborted, 0)
+	}
+
+	state.remove()
+	if err := checkUnchanged(task.SourcePath, before); err != nil {
+		// 已上传的分块内容不再可信，由调用方决定重传还是按策略处理
+		atomic.AddInt64(&stats.ProcessedBytes, -atomic.LoadInt64(&u.uploaded))
+		return err
+	}
+	atomic.AddInt64(&stats.ProcessedBytes, resumed)
+	atomic.AddInt64(&stats.ProcessedFiles, 1)
+	slog.Debug("Uploaded", "path", task.SourcePath, "bytes", task.Size)
+	return nil
+}
+
+// run 在一个连接上循环领取并上传分块
+func (u *chunkedUpload) run(conn *SMBConnection) {
+	defer u.wg.Done()
+
+	var dstFile *smb2.File
+	defer func() {
+		if dstFile != nil {
+			dstFile.Close()
+		}
+		if conn != nil {
+			u.pool.Put(conn)
+		}
+	}()
+
+	buffer := make([]byte, u.config.BufferSize)
+	limiter := newConnLimiter(u.config)
+
+	for {
+		var idx int
+		select {
+		case <-u.finished:
+			return
+		case <-u.abort:
+			return
+		case <-control.AbortChan():
+			return
+		case idx = <-u.pending:
+		}
+
+		var err error
+		if dstFile == nil {
+			dstFile, err = conn.share.OpenFile(u.destPath, os.O_WRONLY, 0644)
+			if err != nil {
+				dstFile = nil
+				err = fmt.Errorf("open dest '%s': %v", u.destPath, err)
+			}
+		}
+		if err == nil {
+			err = u.writeChunk(dstFile, idx, buffer, limiter)
+		}
+
+		if err == nil {
+			u.complete(idx)
+			continue
+		}
+
+		if dstFile != nil {
+			dstFile.Close()
+			dstFile = nil
+		}
+
+		if control.Aborted() {
+			u.pending <- idx
+			return
+		}
+
+		u.stats.noteError(u.task.SourcePath, err)
+		if isTCPConnectionError(err) {
+			// TCP 连接错误 - 无限重试
+			slog.Warn("TCP connection error, recreating connection", "path", u.task.SourcePath, "chunk", idx, "err", err)
+			u.pending <- idx
+			if conn, err = reconnect(u.pool, conn); err != nil {
+				return
+			}
+			continue
+		}
+
+		attempts := int(atomic.AddInt32(&u.attempts[idx], 1))
+		if attempts > u.config.RetryTimes {
+			u.fail(fmt.Errorf("chunk %d: %v (after %d retries)", idx, err, u.config.RetryTimes))
+			return
+		}
+
+		slog.Warn("Chunk upload failed, retrying", "path", u.task.SourcePath, "chunk", idx,
+			"attempt", attempts, "retries", u.config.RetryTimes, "err", err)
+		u.pending <- idx
+		if isSMBSessionError(err) {
+			if conn, err = reconnect(u.pool, conn); err != nil {
+				return
+			}
+		}
+		control.Sleep(time.Millisecond * time.Duration(200*attempts))
+	}
+}
+
+// writeChunk 将源文件的一个分块写入目标文件的相同偏移
+func (u *chunkedUpload) writeChunk(dstFile *smb2.File, idx int, buffer []byte, limiter *rateLimiter) error {
+	start, end := u.state.chunkRange(idx)
+
+	for off := start; off < end; {
+		if err := control.Wait(); err != nil {
+			return err
+		}
+
+		n := int(min64(int64(len(buffer)), end-off))
+		read, err := u.src.ReadAt(buffer[:n], off)
+		if read < n {
+			if err == nil || err == io.EOF {
+				err = fmt.Errorf("source truncated at %d", off+int64(read))
+			}
+			return fmt.Errorf("read source: %v", err)
+		}
+
+		throttle(n, limiter)
+		if _, err := dstFile.WriteAt(buffer[:n], off); err != nil {
+			return fmt.Errorf("write data: %v", err)
+		}
+		off += int64(n)
+	}
+
+	return nil
+}
+
+func (u *chunkedUpload) complete(idx int) {
+	if err := u.state.markDone(idx); err != nil {
+		slog.Warn("Failed to save chunk progress", "path", u.task.SourcePath, "err", err)
+	}
+
+	start, end := u.state.chunkRange(idx)
+	atomic.AddInt64(&u.stats.ProcessedBytes, end-start)
+	atomic.AddInt64(&u.uploaded, end-start)
+
+	if atomic.AddInt32(&u.remaining, -1) == 0 {
+		close(u.finished)
+	}
+}
+
+func (u *chunkedUpload) fail(err error) {
+	u.abortOnce.Do(func() {
+		u.err = err
+		close(u.abort)
+	})
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressSuffix 压缩上传的文件在共享上附加的后缀，restore 时去掉并解压。
+// 不用 .zst，避免与源端本来就是 zstd 的文件混淆。源文件名本身以它结尾时由 encodeSMBName 转义，
+// 远端带这个后缀的一定是压缩上传的
+const compressSuffix = ".smb-zst"
+
+// 文本、日志、数据库等压缩效果好的扩展名，直接压缩
+var compressibleExts = map[string]bool{
+	".txt": true, ".log": true, ".json": true, ".xml": true, ".csv": true, ".tsv": true,
+	".db": true, ".sqlite": true, ".sqlite3": true, ".db-wal": true, ".db-journal": true, ".wal": true,
+	".html": true, ".htm": true, ".js": true, ".css": true, ".md": true, ".sql": true,
+	".ini": true, ".conf": true, ".cfg": true, ".yaml": true, ".yml": true, ".properties": true, ".prop": true,
+	".sh": true, ".py": true, ".java": true, ".c": true, ".h": true, ".go": true, ".svg": true,
+}
+
+// 图片、音视频、压缩包等已经压缩过的格式，不压缩
+var incompressibleExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".heif": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true, ".amr": true,
+	".mp4": true, ".mkv": true, ".webm": true, ".mov": true, ".avi": true, ".3gp": true, ".ts": true,
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".apk": true, ".aab": true, ".jar": true, ".obb": true, ".docx": true, ".xlsx": true, ".pptx": true,
+}
+
+const (
+	compressSampleSize   = 64 * 1024 // 每个抽样位置读取的字节数
+	compressEntropyLimit = 7.0       // 抽样的熵（比特/字节）低于该值才压缩，随机或已压缩的数据接近 8
+)
+
+// shouldCompress 判断文件是否压缩上传：先看扩展名，未知扩展名抽样估计熵
+func shouldCompress(task FileTask, config *Config) bool {
+	if !config.Compress || task.Object != "" || task.Size < config.CompressMinSize {
+		return false
+	}
+	// 分块上传按偏移并行写入，无法压缩
+	if config.ChunkThreshold > 0 && task.Size >= config.ChunkThreshold {
+		return false
+	}
+
+	ext := strings.ToLower(filepath.Ext(task.RelPath))
+	switch {
+	case incompressibleExts[ext]:
+		return false
+	case compressibleExts[ext]:
+		return true
+	}
+
+	f, err := os.Open(task.SourcePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return sampleEntropy(f, task.Size) < compressEntropyLimit
+}
+
+// sampleEntropy 读取文件开头、中间和结尾各一段，计算字节分布的香农熵
+func sampleEntropy(r io.ReaderAt, size int64) float64 {
+	var counts [256]int64
+	var total int64
+	buf := make([]byte, compressSampleSize)
+	for _, off := range []int64{0, size/2 - compressSampleSize/2, size - compressSampleSize} {
+		off = max(off, 0)
+		n, _ := r.ReadAt(buf, off)
+		for _, b := range buf[:n] {
+			counts[b]++
+		}
+		total += int64(n)
+		if off+int64(n) >= size {
+			break
+		}
+	}
+	if total == 0 {
+		return 8
+	}
+
+	var entropy float64
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// countingWriter 记录写入共享的字节数，即压缩后的大小
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// copyCompressed 把 src 压缩写入 dst，返回读取的原始字节数和写入的字节数。
+// 每个文件单独一个编码器且不开并发，worker 多时内存占用可控
+func copyCompressed(dst io.Writer, src io.Reader, buf []byte) (read, stored int64, err error) {
+	cw := &countingWriter{w: dst}
+	enc, err := zstd.NewWriter(cw, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return 0, 0, err
+	}
+	read, err = io.CopyBuffer(enc, src, buf)
+	if cerr := enc.Close(); err == nil {
+		err = cerr
+	}
+	return read, cw.n, err
+}
+
+// decompressReader 返回解压后的内容，closer 释放解码器
+func decompressReader(r io.Reader) (rd io.Reader, closer func(), err error) {
+	dec, err := zstd.NewReader(bufio.NewReader(r), zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, nil, err
+	}
+	return dec, dec.Close, nil
+}
+
+// staleRemotePath 同一文件以另一种方式上传时的远端路径
+func staleRemotePath(destPath string, compressed bool) string {
+	if compressed {
+		return strings.TrimSuffix(destPath, compressSuffix)
+	}
+	return destPath + compressSuffix
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 复制过程中源文件被修改（数据库、日志等）时的处理方式
+const (
+	changedPolicyFlag = "flag" // 保留最后一次的副本，在报告中标记为不一致
+	changedPolicySkip = "skip" // 删除远端副本，作为失败记录，可用 retry-failed 重传
+)
+
+// fileChangedError 复制前后源文件的大小或修改时间不一致
+type fileChangedError struct {
+	beforeSize, afterSize int64
+	beforeTime, afterTime time.Time
+}
+
+func (e *fileChangedError) Error() string {
+	return fmt.Sprintf("file changed during copy: size %d -> %d, mtime %s -> %s",
+		e.beforeSize, e.afterSize,
+		e.beforeTime.Format(time.RFC3339Nano), e.afterTime.Format(time.RFC3339Nano))
+}
+
+func isFileChanged(err error) bool {
+	var changed *fileChangedError
+	return errors.As(err, &changed)
+}
+
+// checkUnchanged 重新读取源文件状态，与复制前的快照比较
+func checkUnchanged(path string, before os.FileInfo) error {
+	after, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("stat source after copy: %v", err)
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		return &fileChangedError{
+			beforeSize: before.Size(),
+			afterSize:  after.Size(),
+			beforeTime: before.ModTime(),
+			afterTime:  after.ModTime(),
+		}
+	}
+	return nil
+}
+
+// readStable 整体读取小文件，读取期间文件变化时最多重读 retries 次。
+// 仍不一致时返回最后一次读到的内容和 fileChangedError
+func readStable(path string, retries int) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		before, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = checkUnchanged(path, before)
+		if err == nil || !isFileChanged(err) || attempt >= retries {
+			return data, err
+		}
+		if control.Sleep(time.Millisecond*time.Duration(100*(attempt+1))) != nil {
+			return data, err
+		}
+	}
+}
+
+// changedRetryDelay 等待文件写入告一段落再重新复制
+func changedRetryDelay(attempt int) time.Duration {
+	return time.Second * time.Duration(min(attempt, 10))
+}
+
+// settleChangedFile 重试用完后按 changed_file_policy 处理仍在变化的文件。
+// 去重对象的内容必须与哈希一致，总是删除
+func settleChangedFile(pool *SMBPool, task FileTask, destPath string, err error, attempts int, config *Config, stats *Stats) error {
+	if config.ChangedFilePolicy == changedPolicySkip || task.Object != "" {
+		if conn, cerr := pool.GetOrCreate(10 * time.Second); cerr == nil {
+			conn.share.Remove(destPath)
+			pool.Put(conn)
+		}
+		stats.recordFailure(task, errorClassChanged, err, attempts)
+		slog.Error("Changed during upload, remote copy removed", "path", task.SourcePath, "attempts", attempts, "err", err)
+		return err
+	}
+
+	stats.recordInconsistent(task, err, attempts)
+	atomic.AddInt64(&stats.ProcessedFiles, 1)
+	atomic.AddInt64(&stats.ProcessedBytes, task.Size)
+	slog.Warn("Changed during upload, copy kept", "path", task.SourcePath, "attempts", attempts, "err", err)
+	return nil
+}
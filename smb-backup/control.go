@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// errAborted 关闭超过期限或再次收到停止信号后，正在进行的上传被中止
+var errAborted = errors.New("aborted by shutdown")
+
+// Controller 处理停止、中止和暂停请求。
+// 停止：不再扫描和领取新任务，正在上传的文件继续完成；
+// 中止：停止后超过期限仍未结束，正在上传的文件也立即放弃；
+// 暂停：在任务之间和每次读取源数据前阻塞，保持 SMB 会话不断开。
+type Controller struct {
+	stopOnce  sync.Once
+	abortOnce sync.Once
+	stopping  chan struct{}
+	aborted   chan struct{}
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pausedBy map[string]bool // 暂停来源，全部解除后才恢复
+}
+
+// control 信号是进程级的，控制器也只有一个
+var control = NewController()
+
+func NewController() *Controller {
+	c := &Controller{
+		stopping: make(chan struct{}),
+		aborted:  make(chan struct{}),
+		pausedBy: make(map[string]bool),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Stop 请求优雅停止，timeout 后仍未结束则中止；已在停止中再次调用会立即中止
+func (c *Controller) Stop(timeout time.Duration) {
+	first := false
+	c.stopOnce.Do(func() {
+		first = true
+		slog.Warn("Shutdown requested, finishing in-flight uploads (signal again to abort)", "timeout", timeout)
+		close(c.stopping)
+
+		// 停止时解除暂停，让正在进行的上传能够完成
+		c.mu.Lock()
+		c.pausedBy = make(map[string]bool)
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		time.AfterFunc(timeout, func() {
+			if !c.Aborted() {
+				slog.Warn("Shutdown deadline reached, aborting in-flight uploads")
+			}
+			c.Abort()
+		})
+	})
+
+	if !first {
+		slog.Warn("Second shutdown request, aborting in-flight uploads")
+		c.Abort()
+	}
+}
+
+func (c *Controller) Abort() {
+	c.abortOnce.Do(func() {
+		close(c.aborted)
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
+
+func (c *Controller) Stopping() bool {
+	select {
+	case <-c.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Controller) Aborted() bool {
+	select {
+	case <-c.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// AbortChan 中止时关闭
+func (c *Controller) AbortChan() <-chan struct{} {
+	return c.aborted
+}
+
+// StopChan 收到停止请求时关闭
+func (c *Controller) StopChan() <-chan struct{} {
+	return c.stopping
+}
+
+func (c *Controller) Pause(source string) {
+	if c.Stopping() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.pausedBy[source] {
+		c.pausedBy[source] = true
+		slog.Info("Paused", "source", source)
+	}
+}
+
+func (c *Controller) Resume(source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pausedBy[source] {
+		delete(c.pausedBy, source)
+		if len(c.pausedBy) == 0 {
+			slog.Info("Resumed", "source", source)
+		}
+		c.cond.Broadcast()
+	}
+}
+
+func (c *Controller) Paused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pausedBy) > 0
+}
+
+// Wait 暂停期间阻塞，已中止时返回 errAborted
+func (c *Controller) Wait() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.pausedBy) > 0 && !c.Aborted() {
+		c.cond.Wait()
+	}
+	if c.Aborted() {
+		return errAborted
+	}
+	return nil
+}
+
+// Sleep 可被中止打断的 time.Sleep
+func (c *Controller) Sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-c.aborted:
+		return errAborted
+	}
+}
+
+// Reader 包装源文件，每次读取前检查暂停和中止
+func (c *Controller) Reader(r io.Reader) io.Reader {
+	return &controlledReader{r: r, c: c}
+}
+
+type controlledReader struct {
+	r io.Reader
+	c *Controller
+}
+
+func (cr *controlledReader) Read(p []byte) (int, error) {
+	if err := cr.c.Wait(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// watchPauseFile 控制文件存在时暂停，删除后恢复
+func (c *Controller) watchPauseFile(path string, done <-chan struct{}) {
+	if path == "" {
+		return
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := os.Stat(path); err == nil {
+				c.Pause("pause file " + path)
+			} else {
+				c.Resume("pause file " + path)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// handleSignals SIGINT/SIGTERM 优雅停止，SIGUSR1 暂停，SIGUSR2 恢复
+func (c *Controller) handleSignals(shutdownTimeout time.Duration) {
+	sigChan := make(chan os.Signal, 4)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	go func() {
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGUSR1:
+				c.Pause("signal")
+			case syscall.SIGUSR2:
+				c.Resume("signal")
+			default:
+				c.Stop(shutdownTimeout)
+			}
+		}
+	}()
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"time"
+)
+
+// handleSignals Windows 上只有 Ctrl+C，暂停请使用 pause_file
+func (c *Controller) handleSignals(shutdownTimeout time.Duration) {
+	sigChan := make(chan os.Signal, 2)
+	signal.Notify(sigChan, os.Interrupt)
+
+	go func() {
+		for range sigChan {
+			c.Stop(shutdownTimeout)
+		}
+	}()
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// 凭据库：条目名 -> 密码的 JSON，用口令经 PBKDF2 派生的密钥做 AES-GCM 加密后保存。
+// 口令依次取自 passphrase_file、环境变量 SMB_BACKUP_PASSPHRASE，都没有时在终端输入
+const (
+	credentialKDF        = "pbkdf2-sha256"
+	credentialIterations = 600000
+	passphraseEnv        = "SMB_BACKUP_PASSPHRASE"
+)
+
+type credentialFile struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+type credentialStore struct {
+	path    string
+	entries map[string]string
+}
+
+func deriveCredentialKey(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// openCredentialStore 解密凭据库，文件不存在时返回空库
+func openCredentialStore(path, passphrase string) (*credentialStore, error) {
+	store := &credentialStore{path: path, entries: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file credentialFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse credential store %s: %v", path, err)
+	}
+	if file.KDF != credentialKDF {
+		return nil, fmt.Errorf("credential store %s: unsupported kdf %q", path, file.KDF)
+	}
+
+	aead, err := deriveCredentialKey(passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("credential store %s: wrong passphrase or corrupted file", path)
+	}
+	if err := json.Unmarshal(plain, &store.entries); err != nil {
+		return nil, fmt.Errorf("credential store %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// save 每次保存都使用新的 salt 和 nonce
+func (s *credentialStore) save(passphrase string) error {
+	plain, err := json.Marshal(s.entries)
+	if err != nil {
+		return err
+	}
+
+	file := credentialFile{
+		Version:    1,
+		KDF:        credentialKDF,
+		Iterations: credentialIterations,
+		Salt:       make([]byte, 16),
+	}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return err
+	}
+	aead, err := deriveCredentialKey(passphrase, file.Salt, file.Iterations)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(file.Nonce); err != nil {
+		return err
+	}
+	file.Data = aead.Seal(nil, file.Nonce, plain, nil)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+var (
+	passphraseMu      sync.Mutex
+	cachedPassphrases = make(map[string]string)           // 口令来源 -> 口令，见 storePassphrase
+	openedStores      = make(map[string]*credentialStore) // 多个任务共用凭据库时只解密一次
+	stdinReader       = bufio.NewReader(os.Stdin)
+)
+
+// prompt 提示并读取一行口令或密码。标准输入是终端时关闭回显，
+// 否则（管道、重定向）按普通文本读取一行
+func prompt(msg string) (string, error) {
+	fmt.Fprint(os.Stderr, msg)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		secret, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(secret), err
+	}
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// storePassphrase 获取凭据库口令，按来源缓存：同一个 passphrase_file、环境变量，
+// 或同一个凭据库在终端输入的口令，同一进程内只读取或询问一次。
+// 多个任务使用不同的口令文件或凭据库时各自取口令
+func storePassphrase(storePath, passphraseFile string) (string, error) {
+	passphraseMu.Lock()
+	defer passphraseMu.Unlock()
+
+	source := "prompt:" + storePath
+	switch {
+	case passphraseFile != "":
+		source = "file:" + passphraseFile
+	case os.Getenv(passphraseEnv) != "":
+		source = "env"
+	}
+	if p, ok := cachedPassphrases[source]; ok {
+		return p, nil
+	}
+
+	var passphrase string
+	switch {
+	case passphraseFile != "":
+		secret, err := readSecretFile(passphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("read passphrase_file: %v", err)
+		}
+		passphrase = secret
+	case os.Getenv(passphraseEnv) != "":
+		passphrase = os.Getenv(passphraseEnv)
+	default:
+		p, err := prompt(fmt.Sprintf("Passphrase for credential store %s: ", storePath))
+		if err != nil {
+			return "", fmt.Errorf("read passphrase: %v", err)
+		}
+		passphrase = p
+	}
+	if passphrase == "" {
+		return "", errors.New("empty passphrase")
+	}
+
+	cachedPassphrases[source] = passphrase
+	return passphrase, nil
+}
+
+// loadCredentialStore 打开并缓存凭据库，已经打开的凭据库不再取口令
+func loadCredentialStore(path, passphraseFile string) (*credentialStore, error) {
+	passphraseMu.Lock()
+	store, ok := openedStores[path]
+	passphraseMu.Unlock()
+	if ok {
+		return store, nil
+	}
+
+	passphrase, err := storePassphrase(path, passphraseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	passphraseMu.Lock()
+	defer passphraseMu.Unlock()
+	if store, ok := openedStores[path]; ok {
+		return store, nil
+	}
+	store, err = openCredentialStore(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	openedStores[path] = store
+	return store, nil
+}
+
+// readSecretFile 读取文件第一行作为密码或口令
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimRight(secret, "\r"), nil
+}
+
+// resolvePassword 按配置从环境变量、文件或凭据库取得密码，最多只能指定一种来源
+func resolvePassword(config *Config) error {
+	sources := 0
+	for _, set := range []bool{config.Password != "", config.PasswordEnv != "", config.PasswordFile != "", config.Credential != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("only one of password, password_env, password_file and credential may be set")
+	}
+
+	switch {
+	case config.PasswordEnv != "":
+		password, ok := os.LookupEnv(config.PasswordEnv)
+		if !ok {
+			return fmt.Errorf("environment variable %s from password_env is not set", config.PasswordEnv)
+		}
+		config.Password = password
+
+	case config.PasswordFile != "":
+		password, err := readSecretFile(config.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("read password_file: %v", err)
+		}
+		config.Password = password
+
+	case config.Credential != "":
+		store, err := loadCredentialStore(config.CredentialStore, config.PassphraseFile)
+		if err != nil {
+			return err
+		}
+		password, ok := store.entries[config.Credential]
+		if !ok {
+			return fmt.Errorf("credential %q not found in %s", config.Credential, config.CredentialStore)
+		}
+		config.Password = password
+
+	case config.Password != "":
+		slog.Warn("Plaintext password in config, consider password_env, password_file or credential", "config", config.path)
+	}
+	return nil
+}
+
+// credentialsCommand smb-backup credentials [-config config.json] [-store path] set|delete|list [name]
+func credentialsCommand(args []string) {
+	fs := flag.NewFlagSet("credentials", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file whose credential_store is used (default: config.json next to the program)")
+	storePath := fs.String("store", "", "credential store file, overrides the config")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: smb-backup credentials [-config config.json] [-store path] set <name>")
+		fmt.Fprintln(fs.Output(), "       smb-backup credentials [-config config.json] [-store path] delete <name>")
+		fmt.Fprintln(fs.Output(), "       smb-backup credentials [-config config.json] [-store path] list")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) < 1 || (args[0] != "list" && len(args) < 2) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	passphraseFile := ""
+	if *storePath == "" {
+		if *configPath == "" {
+			*configPath = defaultConfigPath()
+		}
+		// 只需要凭据库位置，不解析密码，避免循环依赖
+		var raw struct {
+			CredentialStore string `json:"credential_store"`
+			PassphraseFile  string `json:"passphrase_file"`
+		}
+		data, err := os.ReadFile(*configPath)
+		if err != nil {
+			fatal("Failed to load config", "err", err)
+		}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			fatal("Failed to load config", "err", err)
+		}
+		*storePath = defaultCredentialStore(*configPath, raw.CredentialStore)
+		passphraseFile = configRelative(*configPath, raw.PassphraseFile)
+	}
+
+	_, statErr := os.Stat(*storePath)
+	creating := os.IsNotExist(statErr)
+
+	passphrase, err := storePassphrase(*storePath, passphraseFile)
+	if err != nil {
+		fatal("Failed to get passphrase", "err", err)
+	}
+	if creating && args[0] == "set" && passphraseFile == "" && os.Getenv(passphraseEnv) == "" {
+		confirm, err := prompt("Repeat passphrase: ")
+		if err != nil || confirm != passphrase {
+			fatal("Passphrases do not match")
+		}
+	}
+
+	store, err := openCredentialStore(*storePath, passphrase)
+	if err != nil {
+		fatal("Failed to open credential store", "err", err)
+	}
+
+	switch args[0] {
+	case "list":
+		var names []string
+		for name := range store.entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+
+	case "set":
+		password, err := prompt(fmt.Sprintf("Password for %s: ", args[1]))
+		if err != nil {
+			fatal("Failed to read password", "err", err)
+		}
+		store.entries[args[1]] = password
+
+	case "delete":
+		if _, ok := store.entries[args[1]]; !ok {
+			fatal("Credential not found", "name", args[1])
+		}
+		delete(store.entries, args[1])
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err := store.save(passphrase); err != nil {
+		fatal("Failed to save credential store", "err", err)
+	}
+	slog.Info("Credential store updated", "path", *storePath)
+}
+
+// defaultCredentialStore 未配置时凭据库放在配置文件旁边
+func defaultCredentialStore(configPath, store string) string {
+	if store == "" {
+		store = "credentials.enc"
+	}
+	return configRelative(configPath, store)
+}
+
+// configRelative 相对路径按配置文件所在目录解析
+func configRelative(configPath, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(filepath.Dir(configPath), p)
+}
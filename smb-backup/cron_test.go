@@ -0,0 +1,170 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronField(t *testing.T) {
+	bits := func(values ...int) uint64 {
+		var b uint64
+		for _, v := range values {
+			b |= 1 << uint(v)
+		}
+		return b
+	}
+
+	tests := []struct {
+		field  string
+		lo, hi int
+		want   uint64
+	}{
+		{"*", 0, 6, bits(0, 1, 2, 3, 4, 5, 6)},
+		{"5", 0, 59, bits(5)},
+		{"1,15,30", 1, 31, bits(1, 15, 30)},
+		{"9-12", 0, 23, bits(9, 10, 11, 12)},
+		{"*/15", 0, 59, bits(0, 15, 30, 45)},
+		{"*/5", 1, 12, bits(1, 6, 11)},
+		{"10-20/5", 0, 59, bits(10, 15, 20)},
+		{"50/4", 0, 59, bits(50, 54, 58)},
+		{"1-3,20-22/2", 0, 23, bits(1, 2, 3, 20, 22)},
+		{"0-7", 0, 7, bits(0, 1, 2, 3, 4, 5, 6, 7)},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.lo, tt.hi)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tt.field, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseCronField(%q, %d, %d) = %b, want %b", tt.field, tt.lo, tt.hi, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@yearly",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted an invalid expression", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(y int, m time.Month, d, h, min int) time.Time { return time.Date(y, m, d, h, min, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name string
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"next minute", "* * * * *", at(2025, 3, 10, 8, 30), at(2025, 3, 10, 8, 31)},
+		{"excludes current minute", "30 8 * * *", at(2025, 3, 10, 8, 30), at(2025, 3, 11, 8, 30)},
+		{"seconds are truncated", "31 8 * * *", at(2025, 3, 10, 8, 30).Add(59 * time.Second), at(2025, 3, 10, 8, 31)},
+		{"minute step", "*/15 * * * *", at(2025, 3, 10, 8, 31), at(2025, 3, 10, 8, 45)},
+		{"minute step wraps hour", "*/15 * * * *", at(2025, 3, 10, 8, 50), at(2025, 3, 10, 9, 0)},
+		{"hour range", "0 9-17 * * *", at(2025, 3, 10, 17, 0), at(2025, 3, 11, 9, 0)},
+		{"hour range step", "0 8-20/4 * * *", at(2025, 3, 10, 12, 1), at(2025, 3, 10, 16, 0)},
+		{"list", "0 2,14 * * *", at(2025, 3, 10, 3, 0), at(2025, 3, 10, 14, 0)},
+		{"daily", "@daily", at(2025, 3, 10, 8, 30), at(2025, 3, 11, 0, 0)},
+		{"hourly", "@hourly", at(2025, 3, 10, 8, 30), at(2025, 3, 10, 9, 0)},
+		{"weekly on sunday", "@weekly", at(2025, 3, 10, 8, 30), at(2025, 3, 16, 0, 0)},
+
+		// 跨月、跨年
+		{"monthly", "@monthly", at(2025, 3, 10, 8, 30), at(2025, 4, 1, 0, 0)},
+		{"month end", "0 0 * * *", at(2025, 4, 30, 23, 59), at(2025, 5, 1, 0, 0)},
+		{"year end", "0 0 * * *", at(2025, 12, 31, 23, 59), at(2026, 1, 1, 0, 0)},
+		{"monthly across year", "@monthly", at(2025, 12, 1, 0, 0), at(2026, 1, 1, 0, 0)},
+		{"day 31 skips short months", "0 3 31 * *", at(2025, 3, 31, 4, 0), at(2025, 5, 31, 3, 0)},
+		{"month field", "0 0 1 2,8 *", at(2025, 3, 1, 0, 0), at(2025, 8, 1, 0, 0)},
+		{"month field across year", "0 0 1 2 *", at(2025, 3, 1, 0, 0), at(2026, 2, 1, 0, 0)},
+		{"february 29", "0 0 29 2 *", at(2025, 1, 1, 0, 0), at(2028, 2, 29, 0, 0)},
+		{"never", "0 0 30 2 *", at(2025, 1, 1, 0, 0), time.Time{}},
+
+		// 日和周同时限定时满足其一即可，任一为 * 时只看另一个
+		{"dom or dow, dow first", "0 0 15 * 1", at(2025, 3, 1, 0, 0), at(2025, 3, 3, 0, 0)},
+		{"dom or dow, dom first", "0 0 15 * 1", at(2025, 3, 11, 0, 0), at(2025, 3, 15, 0, 0)},
+		{"dom only", "0 0 15 * *", at(2025, 3, 1, 0, 0), at(2025, 3, 15, 0, 0)},
+		{"dow only", "0 0 * * 5", at(2025, 3, 1, 0, 0), at(2025, 3, 7, 0, 0)},
+		{"dow range", "0 0 * * 1-5", at(2025, 3, 7, 12, 0), at(2025, 3, 10, 0, 0)},
+		{"7 is sunday", "0 0 * * 7", at(2025, 3, 10, 0, 0), at(2025, 3, 16, 0, 0)},
+		{"range ending in 7", "0 0 * * 6-7", at(2025, 3, 10, 0, 0), at(2025, 3, 15, 0, 0)},
+		{"range ending in 7 includes sunday", "0 0 * * 6-7", at(2025, 3, 15, 0, 0), at(2025, 3, 16, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%s) = %s, want %s", tt.from.Format(time.RFC3339), got.Format(time.RFC3339), tt.want.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	clock := func(h, m int) time.Time { return time.Date(2025, 3, 10, h, m, 0, 0, time.UTC) }
+
+	tests := []struct {
+		window string
+		at     time.Time
+		want   bool
+	}{
+		{"01:00-06:00", clock(0, 59), false},
+		{"01:00-06:00", clock(1, 0), true},
+		{"01:00-06:00", clock(5, 59), true},
+		{"01:00-06:00", clock(6, 0), false},
+
+		// 跨越午夜
+		{"22:00-06:00", clock(21, 59), false},
+		{"22:00-06:00", clock(22, 0), true},
+		{"22:00-06:00", clock(23, 59), true},
+		{"22:00-06:00", clock(0, 0), true},
+		{"22:00-06:00", clock(5, 59), true},
+		{"22:00-06:00", clock(6, 0), false},
+		{"22:00-06:00", clock(12, 0), false},
+		{"23:30-00:15", clock(0, 10), true},
+		{"23:30-00:15", clock(0, 15), false},
+		{" 20:00 - 08:00 ", clock(7, 0), true},
+	}
+	for _, tt := range tests {
+		w, err := parseTimeWindow(tt.window)
+		if err != nil {
+			t.Errorf("parseTimeWindow(%q): %v", tt.window, err)
+			continue
+		}
+		if got := w.Contains(tt.at); got != tt.want {
+			t.Errorf("%q contains %s = %v, want %v", tt.window, tt.at.Format("15:04"), got, tt.want)
+		}
+	}
+
+	// 未设置窗口时任何时间都允许
+	var none *timeWindow
+	if !none.Contains(clock(12, 0)) {
+		t.Error("nil window rejected a time")
+	}
+
+	for _, bad := range []string{"", "01:00", "01:00-01:00", "25:00-06:00", "1am-6am"} {
+		if _, err := parseTimeWindow(bad); err == nil {
+			t.Errorf("parseTimeWindow(%q) accepted an invalid window", bad)
+		}
+	}
+}
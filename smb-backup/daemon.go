@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// daemon 检查间隔。按墙上时间比较而不是依赖定时器，设备休眠醒来后能立刻发现错过的运行
+const daemonTick = 30 * time.Second
+
+// scheduledJob daemon 中的一个定时任务
+type scheduledJob struct {
+	config *Config
+	next   time.Time
+}
+
+// daemonCommand smb-backup daemon [-config config.json]
+// 常驻运行，按各任务的 schedule 依次执行，同一时间只运行一个任务
+func daemonCommand(args []string) {
+	fs := flag.NewFlagSet("daemon", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file (default: config.json next to the program)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: smb-backup daemon [-config config.json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *configPath == "" {
+		*configPath = defaultConfigPath()
+	}
+
+	jobs, err := loadJobs(*configPath)
+	if err != nil {
+		fatalConfig("Failed to load config", "err", err)
+	}
+	if err := setupLogging(jobs[0]); err != nil {
+		fatalConfig("Failed to set up logging", "err", err)
+	}
+
+	lock, err := acquireLock(filepath.Join(jobs[0].stateRoot, "daemon.lock"))
+	if err != nil {
+		fatal("Another daemon is already running", "err", err)
+	}
+	defer lock.Release()
+
+	control.handleSignals(time.Duration(jobs[0].ShutdownTimeout) * time.Second)
+
+	now := time.Now()
+	var scheduled []*scheduledJob
+	for _, config := range jobs {
+		if config.schedule == nil {
+			slog.Info("Job has no schedule, ignored", "job", jobLabel(config))
+			continue
+		}
+
+		sj := &scheduledJob{config: config}
+		sj.next = firstRun(config, now)
+		scheduled = append(scheduled, sj)
+
+		window := "any time"
+		if config.window != nil {
+			window = config.window.String()
+		}
+		slog.Info("Job scheduled", "job", jobLabel(config), "schedule", config.Schedule,
+			"window", window, "next_run", sj.next.Format("2006-01-02 15:04"))
+	}
+	if len(scheduled) == 0 {
+		fatalConfig("No job has a schedule, nothing to do")
+	}
+
+	for !control.Stopping() {
+		for _, sj := range scheduled {
+			if control.Stopping() {
+				break
+			}
+			now := time.Now()
+			if now.Before(sj.next) || !sj.config.window.Contains(now) {
+				continue
+			}
+
+			runScheduledJob(sj.config)
+			sj.next = sj.config.schedule.Next(time.Now())
+			slog.Info("Next run scheduled", "job", jobLabel(sj.config), "next_run", sj.next.Format("2006-01-02 15:04"))
+		}
+
+		select {
+		case <-time.After(daemonTick):
+		case <-control.StopChan():
+		}
+	}
+
+	slog.Info("Daemon stopped")
+}
+
+// firstRun 根据上次运行时间计算 daemon 启动后的第一次运行。
+// 错过的运行在 catch_up 开启时立即补上，否则等到下一个计划时间
+func firstRun(config *Config, now time.Time) time.Time {
+	last := lastRunTime(config)
+	if last.IsZero() {
+		return config.schedule.Next(now)
+	}
+
+	next := config.schedule.Next(last)
+	if next.Before(now) {
+		if config.CatchUp {
+			slog.Info("Job missed its run, catching up", "job", jobLabel(config), "missed", next.Format("2006-01-02 15:04"))
+			return now
+		}
+		return config.schedule.Next(now)
+	}
+	return next
+}
+
+// lastRunTime 读取 state_dir/last-run.json 中记录的上次运行开始时间
+func lastRunTime(config *Config) time.Time {
+	data, err := os.ReadFile(filepath.Join(config.StateDir, "last-run.json"))
+	if err != nil {
+		return time.Time{}
+	}
+	var summary RunSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return time.Time{}
+	}
+	return summary.StartTime
+}
+
+// runScheduledJob 运行一次任务，运行期间离开时间窗口就暂停传输，回到窗口内再继续
+func runScheduledJob(config *Config) {
+	done := make(chan struct{})
+	if config.window != nil {
+		go func() {
+			ticker := time.NewTicker(daemonTick)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if config.window.Contains(time.Now()) {
+						control.Resume("window")
+					} else {
+						control.Pause("window")
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	startRunLog(config.Name)
+	runJobs([]*Config{config})
+
+	close(done)
+	control.Resume("window")
+}
+
+func jobLabel(config *Config) string {
+	if config.Name == "" {
+		return "default"
+	}
+	return config.Name
+}
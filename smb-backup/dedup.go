@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// 去重模式下文件内容按 SHA-256 存放在 .smb-backup/objects/<前两位>/<哈希>，
+// 路径到内容的对应关系记录在 dedup 清单中，restore 时按清单取回
+const (
+	dedupManifestPath = ".smb-backup/dedup.json"
+	objectDirName     = ".smb-backup/objects"
+)
+
+// dedupEntry 清单中的一条记录，size 和 mod_time 用于下次运行时跳过未变化文件的哈希计算
+type dedupEntry struct {
+	Path    string    `json:"path"` // 源端相对路径，与映射清单中的 original 相同
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+type dedupManifest struct {
+	Version int          `json:"version"`
+	Entries []dedupEntry `json:"entries"`
+}
+
+// ObjectStore 共享上按内容寻址的对象区和路径清单。
+// 同一内容同时出现在多个 worker 中时只有一个上传，其余等待结果
+type ObjectStore struct {
+	destPath string
+
+	mu       sync.Mutex
+	entries  map[string]dedupEntry    // 源端相对路径 -> 记录
+	known    map[string]bool          // 确认已完整存在的对象
+	inflight map[string]chan struct{} // 正在上传的对象
+	dirty    bool
+}
+
+func NewObjectStore(config *Config) *ObjectStore {
+	return &ObjectStore{
+		destPath: config.DestPath,
+		entries:  make(map[string]dedupEntry),
+		known:    make(map[string]bool),
+		inflight: make(map[string]chan struct{}),
+	}
+}
+
+// objectPath 对象在共享上的完整路径
+func (s *ObjectStore) objectPath(sum string) string {
+	return joinSMBPath(s.destPath, objectDirName, sum[:2], sum)
+}
+
+// cachedHash 清单中同一路径的大小和修改时间都没变时沿用上次的哈希
+func (s *ObjectStore) cachedHash(original string, info os.FileInfo) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[original]
+	if !ok || e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) || !s.known[e.Hash] {
+		return "", false
+	}
+	return e.Hash, true
+}
+
+// hashSource 计算源文件内容的哈希，计算期间文件发生变化时返回 fileChangedError
+func (s *ObjectStore) hashSource(task FileTask) (string, os.FileInfo, error) {
+	f, err := os.Open(task.SourcePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	before, err := f.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	if sum, ok := s.cachedHash(originalPath(task.BaseDir, task.RelPath), before); ok {
+		return sum, before, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, control.Reader(f)); err != nil {
+		return "", nil, err
+	}
+	if err := checkUnchanged(task.SourcePath, before); err != nil {
+		return "", nil, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), before, nil
+}
+
+// acquire 对象已存在时返回 true；否则占用上传权，调用方上传后必须调用 release
+func (s *ObjectStore) acquire(sum string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.known[sum] {
+			return true
+		}
+		ch, busy := s.inflight[sum]
+		if !busy {
+			break
+		}
+		s.mu.Unlock()
+		<-ch
+		s.mu.Lock()
+	}
+	s.inflight[sum] = make(chan struct{})
+	return false
+}
+
+// release 结束上传，ok 表示对象已完整写入
+func (s *ObjectStore) release(sum string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ok {
+		s.known[sum] = true
+	}
+	close(s.inflight[sum])
+	delete(s.inflight, sum)
+}
+
+// record 记录路径对应的内容
+func (s *ObjectStore) record(task FileTask, sum string) {
+	e := dedupEntry{
+		Path:    originalPath(task.BaseDir, task.RelPath),
+		Hash:    sum,
+		Size:    task.Size,
+		ModTime: task.ModTime,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.entries[e.Path]; !ok || prev != e {
+		s.entries[e.Path] = e
+		s.dirty = true
+	}
+}
+
+// Entries 按路径排序的全部记录
+func (s *ObjectStore) Entries() []dedupEntry {
+	s.mu.Lock()
+	entries := make([]dedupEntry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// Load 读取共享上的清单，清单中引用的对象视为已存在，不存在时视为空清单
+func (s *ObjectStore) Load(share *smb2.Share) error {
+	f, err := share.Open(joinSMBPath(s.destPath, dedupManifestPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	var manifest dedupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("parse dedup manifest: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range manifest.Entries {
+		s.entries[e.Path] = e
+		s.known[e.Hash] = true
+	}
+	return nil
+}
+
+// Save 清单有变化时写回共享，先写临时文件再改名。
+// 文件数可能很多，不做缩进
+func (s *ObjectStore) Save(share *smb2.Share, dirCreator *DirCreator) error {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(dedupManifest{Version: 1, Entries: s.Entries()})
+	if err != nil {
+		return err
+	}
+
+	manifestPath := joinSMBPath(s.destPath, dedupManifestPath)
+	if err := dirCreator.EnsureDir(share, manifestPath[:strings.LastIndex(manifestPath, "/")]); err != nil {
+		return err
+	}
+
+	tmpPath := manifestPath + ".tmp"
+	if err := share.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	share.Remove(manifestPath)
+	if err := share.Rename(tmpPath, manifestPath); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.dirty = false
+	s.mu.Unlock()
+	return nil
+}
+
+// remoteObjectComplete 对象文件已在共享上且完整：大小一致，也没有未完成的分块上传
+func remoteObjectComplete(pool *SMBPool, objectPath string, size int64, config *Config) bool {
+	if _, err := os.Stat(chunkStatePath(config, objectPath)); err == nil {
+		return false
+	}
+
+	conn, err := pool.GetOrCreate(10 * time.Second)
+	if err != nil {
+		return false
+	}
+	defer pool.Put(conn)
+
+	info, err := conn.share.Stat(objectPath)
+	return err == nil && info.Size() == size
+}
+
+// checkObjectSource 对象按上传前计算的哈希命名，打开源文件时发现它已与计算哈希时不同，
+// 按复制期间发生变化处理，避免对象内容与名字不符
+func checkObjectSource(task FileTask, before os.FileInfo) error {
+	if task.Object == "" {
+		return nil
+	}
+	if before.Size() != task.Size || !before.ModTime().Equal(task.ModTime) {
+		return &fileChangedError{
+			beforeSize: task.Size,
+			afterSize:  before.Size(),
+			beforeTime: task.ModTime,
+			afterTime:  before.ModTime(),
+		}
+	}
+	return nil
+}
+
+// uploadDeduped 去重模式下上传一个文件：先计算哈希，内容已存在时只记录路径，
+// 否则按普通文件的重试流程上传到对象路径
+func uploadDeduped(pool *SMBPool, task FileTask, config *Config, stats *Stats, dirCreator *DirCreator) error {
+	store := dirCreator.objects
+
+	sum, info, err := store.hashSource(task)
+	if err == errAborted {
+		atomic.AddInt64(&stats.InterruptedFiles, 1)
+		return err
+	}
+	if err != nil {
+		class := errorClassRead
+		if isFileChanged(err) {
+			class = errorClassChanged
+		}
+		stats.recordFailure(task, class, err, 1)
+		slog.Error("Hashing failed", "path", task.SourcePath, "err", err)
+		return err
+	}
+	task.Size = info.Size()
+	task.ModTime = info.ModTime()
+
+	if store.acquire(sum) {
+		store.record(task, sum)
+		atomic.AddInt64(&stats.ProcessedFiles, 1)
+		atomic.AddInt64(&stats.ProcessedBytes, task.Size)
+		atomic.AddInt64(&stats.DedupedFiles, 1)
+		atomic.AddInt64(&stats.DedupedBytes, task.Size)
+		slog.Debug("Deduplicated", "path", task.SourcePath, "hash", sum)
+		return nil
+	}
+
+	object := task
+	object.Object = store.objectPath(sum)
+	if remoteObjectComplete(pool, object.Object, task.Size, config) {
+		store.release(sum, true)
+		store.record(task, sum)
+		atomic.AddInt64(&stats.ProcessedFiles, 1)
+		atomic.AddInt64(&stats.ProcessedBytes, task.Size)
+		atomic.AddInt64(&stats.DedupedFiles, 1)
+		atomic.AddInt64(&stats.DedupedBytes, task.Size)
+		slog.Debug("Deduplicated, object found on share", "path", task.SourcePath, "hash", sum)
+		return nil
+	}
+
+	err = uploadFile(pool, object, config, stats, dirCreator)
+	store.release(sum, err == nil)
+	if err != nil {
+		return err
+	}
+	store.record(task, sum)
+	return nil
+}
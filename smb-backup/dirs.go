@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// DirTasks 扫描到的目录任务。目录不经过上传队列，全部文件上传结束后统一创建，
+// 再设置修改时间：在目录中写入文件会改变目录的修改时间，必须最后设置
+type DirTasks struct {
+	mu    sync.Mutex
+	tasks []FileTask
+}
+
+func NewDirTasks() *DirTasks {
+	return &DirTasks{}
+}
+
+func (d *DirTasks) Add(task FileTask) {
+	d.mu.Lock()
+	d.tasks = append(d.tasks, task)
+	d.mu.Unlock()
+}
+
+// Tasks 按深度从深到浅排列，创建子目录和设置子目录的时间都在上层目录之前完成
+func (d *DirTasks) Tasks() []FileTask {
+	d.mu.Lock()
+	tasks := append([]FileTask(nil), d.tasks...)
+	d.mu.Unlock()
+
+	sort.Slice(tasks, func(i, j int) bool {
+		a, b := originalPath(tasks[i].BaseDir, tasks[i].RelPath), originalPath(tasks[j].BaseDir, tasks[j].RelPath)
+		if da, db := strings.Count(a, "/"), strings.Count(b, "/"); da != db {
+			return da > db
+		}
+		return a < b
+	})
+	return tasks
+}
+
+// recordDir 扫描到子目录时记录目录任务。
+// 有 include 规则时只有包含选中文件的目录才会出现在共享上，不记录
+func recordDir(dir scanDir, path, relPath string, info os.FileInfo, stats *Stats) {
+	if stats.dirs == nil || info == nil || len(dir.src.Include) > 0 {
+		return
+	}
+	stats.dirs.Add(FileTask{
+		SourcePath: path,
+		RelPath:    relPath,
+		ModTime:    info.ModTime(),
+		BaseDir:    dir.src.Dest,
+		Dir:        true,
+	})
+}
+
+// applyDirTasks 创建目录（包括空目录）并设置修改时间。
+// 名字超长、按文件分别缩短的目录在共享上没有唯一的对应，跳过
+func applyDirTasks(share *smb2.Share, tasks []FileTask, names *NameMapper, dirCreator *DirCreator, stats *Stats) {
+	if len(tasks) == 0 {
+		return
+	}
+	slog.Info("Applying directories", "dirs", len(tasks))
+
+	var failed int64
+	for _, task := range tasks {
+		if control.Aborted() {
+			return
+		}
+		original := originalPath(task.BaseDir, task.RelPath)
+		if names.maxName > 0 && hasLongName(original, names.maxName) {
+			slog.Debug("Directory name too long, skipped", "path", original)
+			continue
+		}
+		remote := names.Map(original)
+		if strings.HasPrefix(remote, longPathDirName+"/") {
+			slog.Debug("Directory path too long, skipped", "path", original)
+			continue
+		}
+
+		destPath := joinSMBPath(names.destPath, remote)
+		if err := dirCreator.EnsureDir(share, destPath); err != nil {
+			slog.Warn("Failed to create directory", "dest", destPath, "err", err)
+			failed++
+			continue
+		}
+		if err := share.Chtimes(destPath, task.ModTime, task.ModTime); err != nil {
+			slog.Warn("Failed to set directory time", "dest", destPath, "err", err)
+			failed++
+			continue
+		}
+		atomic.AddInt64(&stats.Dirs, 1)
+	}
+	atomic.AddInt64(&stats.DirFailures, failed)
+}
+
+// hasLongName 路径中有超过 limit 字节、上传时会被缩短的名字
+func hasLongName(original string, limit int) bool {
+	for _, part := range strings.Split(original, "/") {
+		if len(encodeSMBName(part)) > limit {
+			return true
+		}
+	}
+	return false
+}
+
+// localDirTime 恢复的目录及其修改时间
+type localDirTime struct {
+	path    string
+	modTime time.Time
+}
+
+// restoreDirTimes 文件全部恢复后创建空目录并设置目录的修改时间，从最深的目录开始
+func restoreDirTimes(dirs []localDirTime) (failed int64) {
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].path, string(filepath.Separator)) > strings.Count(dirs[j].path, string(filepath.Separator))
+	})
+	for _, d := range dirs {
+		if err := os.MkdirAll(d.path, 0755); err != nil {
+			slog.Error("Restore failed", "path", d.path, "err", err)
+			failed++
+			continue
+		}
+		os.Chtimes(d.path, d.modTime, d.modTime)
+	}
+	return failed
+}
@@ -2,8 +2,14 @@ module smb-backup
 
 go 1.25.1
 
+require (
+	github.com/hirochachacha/go-smb2 v1.1.0
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/term v0.36.0
+)
+
 require (
 	github.com/geoffgarside/ber v1.1.0 // indirect
-	github.com/hirochachacha/go-smb2 v1.1.0 // indirect
 	golang.org/x/crypto v0.0.0-20200728195943-123391ffb6de // indirect
+	golang.org/x/sys v0.37.0 // indirect
 )
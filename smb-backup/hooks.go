@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 退出码：0 全部成功，1 部分文件失败或被中断，2 任务整体失败，3 配置错误
+const (
+	exitOK          = 0
+	exitPartial     = 1
+	exitFailed      = 2
+	exitConfigError = 3
+)
+
+// 一次运行的结果
+const (
+	runStatusSuccess = "success"
+	runStatusPartial = "partial"
+	runStatusFailed  = "failed"
+)
+
+// webhook_on 的取值
+const (
+	webhookAlways  = "always"
+	webhookFailure = "failure"
+)
+
+// fatalConfig 配置无法使用时退出，退出码与运行失败区分开
+func fatalConfig(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(exitConfigError)
+}
+
+// runStatus 根据运行结果判断成功、部分失败或整体失败。
+// 有文件失败或有路径扫描不到，但也有文件上传成功算部分失败，一个也没成功算整体失败
+func runStatus(stats *Stats, err error) string {
+	if err != nil || stats == nil {
+		return runStatusFailed
+	}
+	failed := atomic.LoadInt64(&stats.FailedFiles) > 0 || atomic.LoadInt64(&stats.scanErrors) > 0
+	switch {
+	case failed && atomic.LoadInt64(&stats.ProcessedFiles) == 0:
+		return runStatusFailed
+	case failed || control.Stopping():
+		return runStatusPartial
+	default:
+		return runStatusSuccess
+	}
+}
+
+// exitCode 多个任务的总退出码：全部成功为 0，全部失败为 2，其余为 1
+func exitCode(results []jobResult, total int) int {
+	failed, succeeded := 0, 0
+	for _, r := range results {
+		switch r.status {
+		case runStatusSuccess:
+			succeeded++
+		case runStatusFailed:
+			failed++
+		}
+	}
+	switch {
+	case succeeded == total:
+		return exitOK
+	case failed == total:
+		return exitFailed
+	default:
+		return exitPartial
+	}
+}
+
+// HookPayload post_run 环境变量和 webhook 的内容
+type HookPayload struct {
+	RunSummary
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Report string `json:"report,omitempty"` // 失败报告路径
+	Host   string `json:"host"`             // 运行备份的设备
+	Dest   string `json:"dest"`
+}
+
+// start 为运行开始时间，备份未能开始时 stats 为 nil
+func newHookPayload(config *Config, start time.Time, stats *Stats, err error) HookPayload {
+	payload := HookPayload{
+		Status: runStatus(stats, err),
+		Dest:   fmt.Sprintf("//%s/%s/%s", config.Host, config.Share, config.DestPath),
+	}
+	payload.Host, _ = os.Hostname()
+	if stats != nil {
+		payload.RunSummary = newRunSummary(config, stats)
+		payload.Report = stats.reportPath
+	} else {
+		payload.Job = config.Name
+		payload.StartTime = start
+		payload.EndTime = time.Now()
+	}
+	if err != nil {
+		payload.Error = err.Error()
+	}
+	return payload
+}
+
+// env 以 SMB_BACKUP_ 开头的环境变量
+func (p HookPayload) env() []string {
+	vars := map[string]string{
+		"STATUS":             p.Status,
+		"ERROR":              p.Error,
+		"REPORT":             p.Report,
+		"DEST":               p.Dest,
+		"START_TIME":         p.StartTime.Format(time.RFC3339),
+		"END_TIME":           p.EndTime.Format(time.RFC3339),
+		"INTERRUPTED":        strconv.FormatBool(p.Interrupted),
+		"TOTAL_FILES":        strconv.FormatInt(p.TotalFiles, 10),
+		"TOTAL_BYTES":        strconv.FormatInt(p.TotalBytes, 10),
+		"PROCESSED_FILES":    strconv.FormatInt(p.ProcessedFiles, 10),
+		"PROCESSED_BYTES":    strconv.FormatInt(p.ProcessedBytes, 10),
+		"FAILED_FILES":       strconv.FormatInt(p.FailedFiles, 10),
+		"SKIPPED_FILES":      strconv.FormatInt(p.SkippedFiles, 10),
+		"INCONSISTENT_FILES": strconv.FormatInt(p.InconsistentFiles, 10),
+		"SCAN_ERRORS":        strconv.FormatInt(p.ScanErrors, 10),
+	}
+	env := []string{"SMB_BACKUP_JOB=" + jobLabel(&Config{Name: p.Job})}
+	for k, v := range vars {
+		env = append(env, "SMB_BACKUP_"+k+"="+v)
+	}
+	return env
+}
+
+// runHook 用系统 shell 执行钩子命令，超过 hook_timeout 后结束
+func runHook(name, command string, env []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Env = append(os.Environ(), env...)
+
+	slog.Info("Running hook", "hook", name, "command", command)
+	output, err := cmd.CombinedOutput()
+	for _, line := range bytes.Split(bytes.TrimSpace(output), []byte("\n")) {
+		if len(line) > 0 {
+			slog.Info("Hook output", "hook", name, "line", string(line))
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook timed out after %v", name, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook: %v", name, err)
+	}
+	return nil
+}
+
+// runPreHook 运行前钩子，失败时不开始备份
+func runPreHook(config *Config) error {
+	if config.PreRun == "" {
+		return nil
+	}
+	env := []string{
+		"SMB_BACKUP_JOB=" + jobLabel(config),
+		"SMB_BACKUP_DEST=" + fmt.Sprintf("//%s/%s/%s", config.Host, config.Share, config.DestPath),
+	}
+	return runHook("pre_run", config.PreRun, env, time.Duration(config.HookTimeout)*time.Second)
+}
+
+// notifyRunResult 运行结束后执行 post_run 钩子并发送 webhook，失败只记录日志
+func notifyRunResult(config *Config, start time.Time, stats *Stats, runErr error) {
+	if config.PostRun == "" && config.Webhook == "" {
+		return
+	}
+	payload := newHookPayload(config, start, stats, runErr)
+
+	if config.PostRun != "" {
+		if err := runHook("post_run", config.PostRun, payload.env(), time.Duration(config.HookTimeout)*time.Second); err != nil {
+			slog.Warn("Hook failed", "hook", "post_run", "err", err)
+		}
+	}
+
+	if config.Webhook != "" && (config.WebhookOn == webhookAlways || payload.Status != runStatusSuccess) {
+		if err := postWebhook(config.Webhook, payload, time.Duration(config.HookTimeout)*time.Second); err != nil {
+			slog.Warn("Webhook failed", "err", err)
+		} else {
+			slog.Info("Webhook sent", "status", payload.Status)
+		}
+	}
+}
+
+func postWebhook(url string, payload HookPayload, timeout time.Duration) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// config.json 可以定义多个任务：
+//
+//	{
+//	  "host": "192.168.0.111", "username": "...", "password": "...",
+//	  "jobs": [
+//	    {"name": "appdata", "src_path": ["/data/data"], "share": "backup", "dest_path": "appdata"},
+//	    {"name": "media", "src_path": ["/sdcard/DCIM"], "share": "media", "routines": 4}
+//	  ]
+//	}
+//
+// 顶层字段是所有任务的公共配置，每个任务只需写出不同的部分。
+// 没有 jobs 时整个文件就是一个匿名任务，与之前的用法相同。
+
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// loadJobs 读取配置文件中的全部任务。
+// 每个任务使用 state_dir 下以任务名命名的子目录，断点和运行记录互不干扰
+func loadJobs(filename string) ([]*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Jobs []json.RawMessage `json:"jobs"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	if len(file.Jobs) == 0 {
+		config, err := parseConfig(filename, data)
+		if err != nil {
+			return nil, err
+		}
+		return []*Config{config}, nil
+	}
+
+	var jobs []*Config
+	seen := make(map[string]bool)
+	dests := make(map[string]string)
+	for i, raw := range file.Jobs {
+		config, err := parseConfig(filename, data, raw)
+		if err != nil {
+			return nil, fmt.Errorf("job %d: %v", i+1, err)
+		}
+		if !jobNamePattern.MatchString(config.Name) {
+			return nil, fmt.Errorf("job %d: invalid or missing name %q", i+1, config.Name)
+		}
+		if seen[config.Name] {
+			return nil, fmt.Errorf("duplicate job name %q", config.Name)
+		}
+		seen[config.Name] = true
+		// 同一目标目录下的分段、名字清单和链接清单会互相覆盖或清理
+		dest := destLocation(config)
+		if other, ok := dests[dest]; ok {
+			return nil, fmt.Errorf("jobs %q and %q back up to the same dest_path", other, config.Name)
+		}
+		dests[dest] = config.Name
+
+		config.StateDir = filepath.Join(config.StateDir, config.Name)
+		jobs = append(jobs, config)
+	}
+	return jobs, nil
+}
+
+// destLocation 目标目录在服务器上的位置，SMB 不区分大小写
+func destLocation(config *Config) string {
+	return strings.ToLower(config.Host + "/" + config.Share + "/" + joinSMBPath(config.DestPath))
+}
+
+// loadJobConfig 读取指定任务的配置，name 为空时配置文件中只能有一个任务
+func loadJobConfig(filename, name string) (*Config, error) {
+	jobs, err := loadJobs(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		if len(jobs) > 1 {
+			return nil, fmt.Errorf("config defines %d jobs, select one with -job (%s)", len(jobs), strings.Join(jobNames(jobs), ", "))
+		}
+		return jobs[0], nil
+	}
+
+	selected, err := selectJobs(jobs, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	return selected[0], nil
+}
+
+// selectJobs 按名字挑选任务并保持命令行给出的顺序，names 为空时返回全部任务
+func selectJobs(jobs []*Config, names []string) ([]*Config, error) {
+	if len(names) == 0 {
+		return jobs, nil
+	}
+
+	byName := make(map[string]*Config)
+	for _, job := range jobs {
+		byName[job.Name] = job
+	}
+
+	var selected []*Config
+	for _, name := range names {
+		job, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown job %q, available: %s", name, strings.Join(jobNames(jobs), ", "))
+		}
+		selected = append(selected, job)
+	}
+	return selected, nil
+}
+
+func jobNames(jobs []*Config) []string {
+	var names []string
+	for _, job := range jobs {
+		names = append(names, job.Name)
+	}
+	return names
+}
+
+// runCommand smb-backup run [-config config.json] [job ...]
+func runCommand(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file (default: config.json next to the program)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: smb-backup run [-config config.json] [job ...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *configPath == "" {
+		*configPath = defaultConfigPath()
+	}
+
+	jobs, err := loadJobs(*configPath)
+	if err != nil {
+		fatalConfig("Failed to load config", "err", err)
+	}
+	jobs, err = selectJobs(jobs, fs.Args())
+	if err != nil {
+		fatalConfig("Failed to select jobs", "err", err)
+	}
+	if err := setupLogging(jobs[0]); err != nil {
+		fatalConfig("Failed to set up logging", "err", err)
+	}
+
+	control.handleSignals(time.Duration(jobs[0].ShutdownTimeout) * time.Second)
+
+	os.Exit(runJobs(jobs))
+}
+
+// jobResult 一个任务的运行结果，用于最后的汇总
+type jobResult struct {
+	name    string
+	stats   *Stats
+	err     error
+	status  string
+	elapsed time.Duration
+}
+
+// runLockedJob 持有任务的锁文件运行一次备份，防止手动运行和定时运行重叠。
+// 前后钩子也在锁内执行，结束后无论成功与否都发送通知；没拿到锁时只返回错误，
+// 不运行 post_run，以免和正在进行的那次运行的钩子重叠
+func runLockedJob(config *Config) (stats *Stats, err error) {
+	start := time.Now()
+	lock, err := acquireLock(filepath.Join(config.StateDir, "run.lock"))
+	if err != nil {
+		return nil, fmt.Errorf("another run of this job is in progress: %v", err)
+	}
+	defer lock.Release()
+	// defer 后进先出，通知在释放锁之前发送
+	defer func() {
+		notifyRunResult(config, start, stats, err)
+	}()
+
+	if err := runPreHook(config); err != nil {
+		return nil, err
+	}
+
+	return runBackup(config, func(sched *Scheduler, stats *Stats) {
+		scanFiles(config.SrcPath, sched, stats, config)
+	})
+}
+
+// runJobs 依次运行任务，收到停止信号后不再开始新的任务。返回进程退出码
+func runJobs(jobs []*Config) int {
+	var results []jobResult
+
+	for i, config := range jobs {
+		if control.Stopping() {
+			slog.Info("Skipping remaining jobs after shutdown request")
+			break
+		}
+
+		if len(jobs) > 1 {
+			startRunLog(config.Name)
+			slog.Info("Starting job", "job", config.Name, "index", i+1, "jobs", len(jobs))
+		}
+
+		start := time.Now()
+		stats, err := runLockedJob(config)
+		if err != nil {
+			slog.Error("Job failed", "job", jobLabel(config), "err", err)
+		}
+		results = append(results, jobResult{
+			name:    config.Name,
+			stats:   stats,
+			err:     err,
+			status:  runStatus(stats, err),
+			elapsed: time.Since(start),
+		})
+	}
+
+	if len(jobs) > 1 {
+		for _, r := range results {
+			if r.err != nil {
+				slog.Error("Job summary", "job", r.name, "status", runStatusFailed, "err", r.err)
+				continue
+			}
+			slog.Info("Job summary", "job", r.name, "status", r.status,
+				"processed_files", r.stats.ProcessedFiles, "total_files", r.stats.TotalFiles, "failed_files", r.stats.FailedFiles,
+				"bytes", r.stats.ProcessedBytes, "elapsed", r.elapsed.Round(time.Second))
+		}
+		for _, config := range jobs[len(results):] {
+			slog.Info("Job summary", "job", config.Name, "status", "not started")
+		}
+	}
+
+	return exitCode(results, len(jobs))
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// 扫描到符号链接时的处理方式
+const (
+	symlinkRecord = "record" // 不上传内容，把链接目标记录在清单中，restore 时重建链接
+	symlinkFollow = "follow" // 按目标的内容上传，指向目录时继续扫描，指向上层目录的循环链接跳过
+	symlinkSkip   = "skip"   // 忽略
+)
+
+// 链接清单，记录符号链接和没有重复上传的硬链接
+const linkManifestPath = ".smb-backup/links.json"
+
+const (
+	linkSymlink  = "symlink"
+	linkHardlink = "hardlink"
+)
+
+// linkEntry 清单中的一条记录
+type linkEntry struct {
+	Path   string `json:"path"`   // 源端相对路径
+	Type   string `json:"type"`   // symlink / hardlink
+	Target string `json:"target"` // 符号链接的内容，或同一 inode 中被上传的路径（路径最小的一个）
+}
+
+type linkManifest struct {
+	Version int         `json:"version"`
+	Entries []linkEntry `json:"entries"`
+}
+
+// fileID 区分文件的设备号和 inode
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// heldFile 扫描时暂缓上传的硬链接文件
+type heldFile struct {
+	task   FileTask
+	submit func() // 交给扫描的 visit 回调
+}
+
+// linkedFile 记为硬链接、没有上传内容的文件
+type linkedFile struct {
+	task   FileTask
+	target string
+}
+
+// LinkTable 扫描时记录符号链接，并按 inode 识别硬链接：同一 inode 只上传路径最小的一个，其余记为链接。
+// 扫描是并发的，先遇到哪个路径不确定，所以硬链接文件先暂存，遍历结束后再决定
+type LinkTable struct {
+	destPath string
+
+	mu      sync.Mutex
+	entries map[string]linkEntry
+	groups  map[fileID][]heldFile // 遍历期间按 inode 暂存的硬链接文件
+	linked  []linkedFile
+	dirty   bool
+
+	// 可用空间检查时先扫描后读取清单，这期间作为普通文件扫描到的路径，读取清单时不再恢复旧记录
+	loaded  bool
+	dropped map[string]bool
+}
+
+func NewLinkTable(config *Config) *LinkTable {
+	return &LinkTable{
+		destPath: config.DestPath,
+		entries:  make(map[string]linkEntry),
+		groups:   make(map[fileID][]heldFile),
+		dropped:  make(map[string]bool),
+	}
+}
+
+// AddSymlink 记录符号链接
+func (t *LinkTable) AddSymlink(original, target string) {
+	t.add(linkEntry{Path: original, Type: linkSymlink, Target: target})
+}
+
+// Visit 扫描到普通文件时调用。有多个硬链接的文件暂存并返回 true，调用方不再处理，
+// 由 Release 决定上传哪一个
+func (t *LinkTable) Visit(info os.FileInfo, task FileTask, submit func()) bool {
+	id, nlink, ok := fileIdentity(info)
+	if !ok || nlink < 2 {
+		t.remove(originalPath(task.BaseDir, task.RelPath))
+		return false
+	}
+
+	t.mu.Lock()
+	t.groups[id] = append(t.groups[id], heldFile{task: task, submit: submit})
+	t.mu.Unlock()
+	return true
+}
+
+// Release 遍历结束后调用：每个 inode 上传路径最小的文件，其余记为指向它的链接。
+// 返回记为链接的文件数
+func (t *LinkTable) Release() int64 {
+	t.mu.Lock()
+	groups := t.groups
+	t.groups = make(map[fileID][]heldFile)
+	t.mu.Unlock()
+
+	var links int64
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			return originalPath(group[i].task.BaseDir, group[i].task.RelPath) < originalPath(group[j].task.BaseDir, group[j].task.RelPath)
+		})
+		target := originalPath(group[0].task.BaseDir, group[0].task.RelPath)
+		t.remove(target)
+		for _, h := range group[1:] {
+			t.add(linkEntry{Path: originalPath(h.task.BaseDir, h.task.RelPath), Type: linkHardlink, Target: target})
+			t.mu.Lock()
+			t.linked = append(t.linked, linkedFile{task: h.task, target: target})
+			t.mu.Unlock()
+			slog.Debug("Hardlink recorded", "path", h.task.SourcePath, "target", target)
+			links++
+		}
+		group[0].submit()
+	}
+	return links
+}
+
+// recordOrphanLinks 上传结束后检查硬链接：目标没有上传成功时链接在共享上没有可用的内容，
+// 从清单中删除并记为失败，按失败报告重试时作为普通文件上传
+func recordOrphanLinks(stats *Stats) {
+	if stats.links == nil {
+		return
+	}
+	failed, _ := stats.failedFiles()
+	if len(failed) == 0 {
+		return
+	}
+	byPath := make(map[string]FailedFile, len(failed))
+	for _, f := range failed {
+		byPath[originalPath(f.BaseDir, f.RelPath)] = f
+	}
+
+	t := stats.links
+	t.mu.Lock()
+	linked := t.linked
+	t.mu.Unlock()
+	for _, l := range linked {
+		f, ok := byPath[l.target]
+		if !ok {
+			continue
+		}
+		t.remove(originalPath(l.task.BaseDir, l.task.RelPath))
+		atomic.AddInt64(&stats.LinkFiles, -1)
+		atomic.AddInt64(&stats.TotalFiles, 1)
+		stats.recordFailure(l.task, f.ErrorClass, fmt.Errorf("hardlink target %s was not backed up: %s", f.Path, f.LastError), 1)
+		slog.Error("Hardlink target was not backed up", "path", l.task.SourcePath, "target", f.Path)
+	}
+}
+
+func (t *LinkTable) add(e linkEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev, ok := t.entries[e.Path]; !ok || prev != e {
+		t.entries[e.Path] = e
+		t.dirty = true
+	}
+}
+
+// remove 路径这次作为普通文件上传，以前的链接记录已过时
+func (t *LinkTable) remove(original string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.loaded {
+		t.dropped[original] = true
+	}
+	if _, ok := t.entries[original]; ok {
+		delete(t.entries, original)
+		t.dirty = true
+	}
+}
+
+// Entries 按路径排序的全部记录
+func (t *LinkTable) Entries() []linkEntry {
+	t.mu.Lock()
+	entries := make([]linkEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		entries = append(entries, e)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+// Load 读取共享上已有的链接清单，不存在时视为空清单。本次扫描已经处理过的路径以本次为准
+func (t *LinkTable) Load(share *smb2.Share) error {
+	defer func() {
+		t.mu.Lock()
+		t.loaded = true
+		t.dropped = nil
+		t.mu.Unlock()
+	}()
+
+	f, err := share.Open(joinSMBPath(t.destPath, linkManifestPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	var manifest linkManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("parse link manifest: %v", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range manifest.Entries {
+		if _, ok := t.entries[e.Path]; !ok && !t.dropped[e.Path] {
+			t.entries[e.Path] = e
+		}
+	}
+	return nil
+}
+
+// Save 清单有变化时写回共享，先写临时文件再改名
+func (t *LinkTable) Save(share *smb2.Share, dirCreator *DirCreator) error {
+	t.mu.Lock()
+	dirty := t.dirty
+	t.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(linkManifest{Version: 1, Entries: t.Entries()}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	manifestPath := joinSMBPath(t.destPath, linkManifestPath)
+	if err := dirCreator.EnsureDir(share, manifestPath[:strings.LastIndex(manifestPath, "/")]); err != nil {
+		return err
+	}
+
+	tmpPath := manifestPath + ".tmp"
+	if err := share.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	share.Remove(manifestPath)
+	if err := share.Rename(tmpPath, manifestPath); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	t.dirty = false
+	t.mu.Unlock()
+	return nil
+}
+
+// isSpecialFile 套接字、管道、设备文件等，打开时可能阻塞或出错，不备份
+func isSpecialFile(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice|os.ModeCharDevice|os.ModeIrregular) != 0
+}
+
+// specialFileType 日志中显示的特殊文件类型
+func specialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeCharDevice != 0:
+		return "char device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	default:
+		return "irregular file"
+	}
+}
+
+// restoreLinks 在文件恢复完之后重建链接。硬链接的目标没有恢复时失败，
+// 目标所在的文件系统不支持硬链接时复制一份
+func restoreLinks(localDir string, entries []linkEntry, wanted func(string) bool) (restored, failed int64) {
+	for _, e := range entries {
+		if control.Stopping() {
+			return
+		}
+		if !wanted(e.Path) {
+			continue
+		}
+		if err := restoreLink(localDir, e); err != nil {
+			slog.Error("Restore failed", "path", e.Path, "type", e.Type, "target", e.Target, "err", err)
+			failed++
+			continue
+		}
+		restored++
+		slog.Debug("Restored link", "path", e.Path, "type", e.Type, "target", e.Target)
+	}
+	return restored, failed
+}
+
+func restoreLink(localDir string, e linkEntry) error {
+	localPath, err := restoreTarget(localDir, e.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	os.Remove(localPath)
+
+	if e.Type == linkSymlink {
+		return os.Symlink(e.Target, localPath)
+	}
+
+	targetPath, err := restoreTarget(localDir, e.Target)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(targetPath); err != nil {
+		return fmt.Errorf("link target was not restored")
+	}
+	if err := os.Link(targetPath, localPath); err == nil {
+		return nil
+	}
+	return copyLocalFile(targetPath, localPath)
+}
+
+func copyLocalFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+	return nil
+}
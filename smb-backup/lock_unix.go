@@ -0,0 +1,42 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// fileLock 基于 flock 的锁文件，进程被杀死后由内核自动释放
+type fileLock struct {
+	f *os.File
+}
+
+// acquireLock 获取锁，已被其他进程持有时立即返回错误
+func acquireLock(path string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid, _ := os.ReadFile(path)
+		f.Close()
+		return nil, fmt.Errorf("%s is held by process %s", path, string(pid))
+	}
+
+	f.Truncate(0)
+	f.WriteString(strconv.Itoa(os.Getpid()))
+	return &fileLock{f: f}, nil
+}
+
+func (l *fileLock) Release() {
+	syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+	l.f.Close()
+}
@@ -0,0 +1,39 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// fileLock Windows 上打开的文件无法被删除，用独占创建加删除旧文件实现锁，
+// 进程异常退出留下的锁文件在下次获取时会被删除
+type fileLock struct {
+	f    *os.File
+	path string
+}
+
+// acquireLock 获取锁，已被其他进程持有时立即返回错误
+func acquireLock(path string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	os.Remove(path)
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		pid, _ := os.ReadFile(path)
+		return nil, fmt.Errorf("%s is held by process %s", path, string(pid))
+	}
+
+	f.WriteString(strconv.Itoa(os.Getpid()))
+	return &fileLock{f: f, path: path}, nil
+}
+
+func (l *fileLock) Release() {
+	l.f.Close()
+	os.Remove(l.path)
+}
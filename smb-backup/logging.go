@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志分三路输出：标准输出、log_dir 下每次运行一个的日志文件、只含警告和错误的 errors.log。
+// 各处直接调用 slog 并以键值对带上 path、bytes、err 等属性，json 格式下可以按字段检索
+
+// fatal 输出错误日志后退出
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log_level %q, expected debug, info, warn or error", s)
+}
+
+// multiHandler 把记录分发给多个 handler，每个 handler 自己决定级别
+type multiHandler []slog.Handler
+
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range m {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	out := make(multiHandler, len(m))
+	for i, h := range m {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// rotatingFile 超过 maxSize 后把当前文件改名为 <name>-<时间>.log 并重新打开。
+// 每次打开和轮转时清理 dir 中匹配 pattern 的旧文件，只保留 keep 个且不超过 maxAge
+type rotatingFile struct {
+	mu      sync.Mutex
+	dir     string
+	name    string
+	pattern string
+	maxSize int64
+	keep    int
+	maxAge  time.Duration
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(dir, name, pattern string, maxSize int64, keep int, maxAge time.Duration) (*rotatingFile, error) {
+	r := &rotatingFile{dir: dir, name: name, pattern: pattern, maxSize: maxSize, keep: keep, maxAge: maxAge}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.prune()
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(r.dir, r.name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	base := strings.TrimSuffix(r.name, ".log")
+	rotated := fmt.Sprintf("%s-%s.log", base, time.Now().Format("20060102-150405.000"))
+	if err := os.Rename(filepath.Join(r.dir, r.name), filepath.Join(r.dir, rotated)); err != nil {
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// reopen 换到新的文件名继续写，daemon 每次运行任务时调用
+func (r *rotatingFile) reopen(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.f.Close()
+	r.name = name
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.prune()
+	return nil
+}
+
+// prune 删除超出数量或过期的旧文件，当前文件不计入
+func (r *rotatingFile) prune() {
+	matches, err := filepath.Glob(filepath.Join(r.dir, r.pattern))
+	if err != nil {
+		return
+	}
+
+	type oldFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []oldFile
+	for _, path := range matches {
+		if filepath.Base(path) == r.name {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files = append(files, oldFile{path, info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+
+	limit := r.keep
+	if current, _ := filepath.Match(r.pattern, r.name); current {
+		limit--
+	}
+	for i, f := range files {
+		expired := r.maxAge > 0 && time.Since(f.modTime) > r.maxAge
+		if (r.keep > 0 && i >= limit) || expired {
+			os.Remove(f.path)
+		}
+	}
+}
+
+// runLog 当前运行的日志文件，未写文件时为 nil
+var runLog *rotatingFile
+
+// setupLogging 按配置初始化日志输出。
+// 多任务时日志设置取自第一个任务，一般写在配置顶层
+func setupLogging(config *Config) error {
+	opts := func(level slog.Level) *slog.HandlerOptions {
+		return &slog.HandlerOptions{Level: level}
+	}
+	newHandler := func(w io.Writer, level slog.Level) slog.Handler {
+		if config.LogFormat == "json" {
+			return slog.NewJSONHandler(w, opts(level))
+		}
+		return slog.NewTextHandler(w, opts(level))
+	}
+
+	var handlers multiHandler
+	if config.LogStdout {
+		handlers = append(handlers, newHandler(os.Stdout, config.logLevel))
+	}
+
+	if config.LogDir != "" {
+		maxSize := config.LogMaxSize * 1024 * 1024
+		maxAge := time.Duration(config.LogMaxAge) * 24 * time.Hour
+
+		f, err := openRotatingFile(config.LogDir, runLogName(""), "run-*.log", maxSize, config.LogKeep, maxAge)
+		if err != nil {
+			return fmt.Errorf("open log file: %v", err)
+		}
+		runLog = f
+		handlers = append(handlers, newHandler(f, config.logLevel))
+
+		if config.ErrorLog {
+			ef, err := openRotatingFile(config.LogDir, "errors.log", "errors-*.log", maxSize, config.LogKeep, maxAge)
+			if err != nil {
+				return fmt.Errorf("open error log: %v", err)
+			}
+			handlers = append(handlers, newHandler(ef, slog.LevelWarn))
+		}
+	}
+
+	// 标准库 log 的输出也经由默认 logger，以 info 级别记录
+	slog.SetDefault(slog.New(handlers))
+	return nil
+}
+
+// startRunLog daemon 中每次运行任务时换一个日志文件
+func startRunLog(job string) {
+	if runLog == nil {
+		return
+	}
+	if err := runLog.reopen(runLogName(job)); err != nil {
+		fmt.Fprintf(os.Stderr, "open log file: %v\n", err)
+	}
+}
+
+func runLogName(job string) string {
+	name := "run-" + time.Now().Format("20060102-150405")
+	if job != "" {
+		name += "-" + job
+	}
+	return name + ".log"
+}
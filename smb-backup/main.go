@@ -4,10 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -17,61 +18,239 @@ import (
 )
 
 type Config struct {
-	Routines   int      `json:"routines"`
-	SrcPath    []string `json:"src_path"`
-	Host       string   `json:"host"`
-	Port       int      `json:"port"`
-	Username   string   `json:"username"`
-	Password   string   `json:"password"`
-	Share      string   `json:"share"`
-	DestPath   string   `json:"dest_path"`
-	BufferSize int      `json:"buffer_size"`
-	RetryTimes int      `json:"retry_times"`
-	PoolSize   int      `json:"pool_size"`
-	Verbose    bool     `json:"verbose"` // 详细日志
+	path       string        // 配置文件路径，写入失败报告供 retry-failed 使用
+	stateRoot  string        // 未加任务名的 state_dir，放置各任务共用的文件
+	schedule   *cronSchedule // 解析后的 Schedule
+	window     *timeWindow   // 解析后的 Window，nil 表示不限制
+	minDialect uint16        // 解析后的 MinDialect
+	logLevel   slog.Level    // 解析后的 LogLevel
+
+	bandwidthLimit  int64 // 解析后的 BandwidthLimit，字节/秒
+	connectionLimit int64 // 解析后的 ConnectionBandwidthLimit
+
+	Name string `json:"name"` // 任务名，只在 jobs 中使用
+
+	Routines    int          `json:"routines"`
+	SrcPath     []SourcePath `json:"src_path"`
+	Host        string       `json:"host"`
+	Port        int          `json:"port"`
+	Username    string       `json:"username"`
+	Password    string       `json:"password"`
+	Domain      string       `json:"domain"`      // NTLM 域
+	Workstation string       `json:"workstation"` // NTLM 工作站名
+	Share       string       `json:"share"`
+	DestPath    string       `json:"dest_path"`
+	BufferSize  int          `json:"buffer_size"`
+	RetryTimes  int          `json:"retry_times"`
+	PoolSize    int          `json:"pool_size"`
+	Verbose     bool         `json:"verbose"` // 已由 log_level 取代，为 true 且未设置 log_level 时相当于 debug
+
+	// 大文件分块并行上传
+	ChunkThreshold   int64  `json:"chunk_threshold"`   // 超过该大小的文件分块上传，0 表示关闭
+	ChunkSize        int64  `json:"chunk_size"`        // 每个分块的大小
+	ChunkConnections int    `json:"chunk_connections"` // 单个大文件最多同时使用的连接数
+	StateDir         string `json:"state_dir"`         // 断点状态保存目录
+
+	// 部分上传文件的续传
+	ResumeMode      string `json:"resume_mode"`       // off / sample / full，只续传本工具记录为中断的上传
+	ResumeMinSize   int64  `json:"resume_min_size"`   // 小于该大小的文件直接重传
+	ResumeBlockSize int    `json:"resume_block_size"` // 校验块大小
+	ResumeSamples   int    `json:"resume_samples"`    // sample 模式下抽样校验的块数
+
+	// 按文件大小调度
+	SmallFileThreshold int64 `json:"small_file_threshold"` // 小于该大小的文件走小文件通道，0 表示不区分
+	SmallRoutines      int   `json:"small_routines"`       // 小文件通道 worker 数
+	LargeRoutines      int   `json:"large_routines"`       // 大文件通道 worker 数
+	LargestFirst       bool  `json:"largest_first"`        // 大文件通道优先上传最大的文件（在最多 10 万个排队的文件中）
+	SmallFilePack      bool  `json:"small_file_pack"`      // 小文件打包为 tar 分段上传
+	PackSize           int64 `json:"pack_size"`            // 每个 tar 分段的目标大小
+
+	// 扫描
+	ScanWorkers  int    `json:"scan_workers"`  // 并发扫描目录的 goroutine 数
+	PreScan      bool   `json:"pre_scan"`      // 先完整扫描再开始上传，进度和 ETA 从一开始就准确
+	Symlinks     string `json:"symlinks"`      // record 记录到链接清单、restore 时重建 / follow 上传目标的内容 / skip 忽略
+	PreserveDirs bool   `json:"preserve_dirs"` // 在共享上创建空目录，全部上传结束后设置目录的修改时间
+
+	// 自动调优并发数，routines 和 pool_size 作为上限
+	AutoTune     bool `json:"auto_tune"`
+	MinRoutines  int  `json:"min_routines"`
+	MinPoolSize  int  `json:"min_pool_size"`
+	TuneInterval int  `json:"tune_interval"` // 调整间隔（秒）
+
+	// 连接健康检查
+	MaxConnections      int `json:"max_connections"`       // 包括临时连接在内的总连接数上限
+	HealthCheckInterval int `json:"health_check_interval"` // 探测空闲连接的间隔（秒），0 表示关闭
+	MaxIdleTime         int `json:"max_idle_time"`         // 空闲超过该时间（秒）的会话主动重建，0 表示不重建
+
+	// 停止与暂停
+	ShutdownTimeout int    `json:"shutdown_timeout"` // 收到停止信号后等待正在上传的文件完成的时间（秒）
+	PauseFile       string `json:"pause_file"`       // 该文件存在时暂停传输
+
+	// 远端文件名映射
+	MaxNameLength       int  `json:"max_name_length"`       // 单个文件名的最大字节数，超出时截断并附加哈希
+	MaxPathLength       int  `json:"max_path_length"`       // 共享内完整路径的最大字节数，超出时改存到 .smb-backup/long，0 表示不限制
+	CaseInsensitiveDest bool `json:"case_insensitive_dest"` // 目标不区分大小写（NTFS 等），检测只有大小写不同的文件
+
+	// 上传过程中被修改的文件
+	ChangedFileRetries int    `json:"changed_file_retries"` // 复制前后大小或修改时间不一致时重新复制的次数
+	ChangedFilePolicy  string `json:"changed_file_policy"`  // 重试后仍不一致时：flag 保留副本并在报告中标记，skip 删除副本记为失败
+
+	// daemon 模式
+	Schedule string `json:"schedule"` // cron 表达式（分 时 日 月 周），daemon 按此运行任务
+	Window   string `json:"window"`   // 只在该时间段内传输，如 "01:00-06:00"，窗口外暂停
+	CatchUp  bool   `json:"catch_up"` // 设备休眠或 daemon 未运行时错过的运行，恢复后立即补上
+
+	// 启动前检查
+	WakeOnLAN       string `json:"wake_on_lan"`       // NAS 的 MAC 地址，设置后先发送唤醒包并等待端口可连接
+	WakeBroadcast   string `json:"wake_broadcast"`    // 唤醒包发送地址
+	WakeTimeout     int    `json:"wake_timeout"`      // 等待 NAS 启动的时间（秒）
+	FreeSpaceCheck  string `json:"free_space_check"`  // off / warn / abort，开启时先完整扫描再比较共享的可用空间
+	FreeSpaceMargin int64  `json:"free_space_margin"` // 在需要写入的字节数之外额外保留的空间
+
+	// 去重
+	Dedup bool `json:"dedup"` // 相同内容只上传一次，存放在 .smb-backup/objects，路径记录在清单中。打包的小文件不参与去重
+
+	// 压缩
+	Compress        bool  `json:"compress"`          // 文本、数据库等可压缩的文件用 zstd 压缩后上传，远端名字附加 .smb-zst。分块上传、打包和去重的文件不压缩
+	CompressMinSize int64 `json:"compress_min_size"` // 小于该大小的文件不压缩
+
+	// 仓库模式（smb-backup repo）
+	RepoPath           string `json:"repo_path"`            // 仓库在共享上的目录，默认为 dest_path/.smb-backup/repo
+	RepoEncryption     bool   `json:"repo_encryption"`      // 创建仓库时开启加密，之后以仓库配置为准
+	RepoPassphraseFile string `json:"repo_passphrase_file"` // 仓库口令文件，未设置时读取 SMB_BACKUP_REPO_PASSPHRASE 或在终端输入
+	RepoPackSize       int64  `json:"repo_pack_size"`       // 每个 pack 文件的目标大小
+
+	// 限速
+	BandwidthLimit           string            `json:"bandwidth_limit"`            // 全部 worker 共用的上传速率上限，如 "5MB"，空或 0 表示不限速
+	BandwidthSchedule        []BandwidthPeriod `json:"bandwidth_schedule"`         // 按时段的限速，覆盖 bandwidth_limit
+	ConnectionBandwidthLimit string            `json:"connection_bandwidth_limit"` // 单个连接的速率上限
+
+	// 日志
+	LogLevel   string `json:"log_level"`    // debug / info / warn / error，默认 info
+	LogFormat  string `json:"log_format"`   // text / json
+	LogDir     string `json:"log_dir"`      // 日志文件目录，默认 state_dir/logs，"off" 表示不写文件
+	LogStdout  bool   `json:"log_stdout"`   // 同时输出到标准输出
+	LogMaxSize int64  `json:"log_max_size"` // 单个日志文件的最大大小（MB），超过后轮转
+	LogKeep    int    `json:"log_keep"`     // 每类日志最多保留的文件数
+	LogMaxAge  int    `json:"log_max_age"`  // 日志文件最多保留的天数，0 表示不按时间清理
+	ErrorLog   bool   `json:"error_log"`    // 另外把警告和错误写入 errors.log
+
+	// 状态页
+	StatusListen string `json:"status_listen"` // 内置 HTTP 状态服务的监听地址，如 "0.0.0.0:8090"，空表示关闭
+
+	// 运行前后的钩子和通知
+	PreRun      string `json:"pre_run"`      // 备份前执行的 shell 命令，失败时不开始备份
+	PostRun     string `json:"post_run"`     // 备份后执行的 shell 命令，结果通过 SMB_BACKUP_* 环境变量传入
+	Webhook     string `json:"webhook"`      // 备份后以 JSON POST 运行结果的地址
+	WebhookOn   string `json:"webhook_on"`   // always / failure，failure 只在失败或部分失败时发送
+	HookTimeout int    `json:"hook_timeout"` // 钩子命令和 webhook 的超时（秒）
+
+	// 传输安全，不满足时拒绝运行
+	RequireSigning    bool   `json:"require_signing"`    // 要求消息签名
+	RequireEncryption bool   `json:"require_encryption"` // 要求 SMB3 加密，服务端需为共享开启加密
+	MinDialect        string `json:"min_dialect"`        // 最低协议版本：2.0.2 / 2.1 / 3.0 / 3.0.2 / 3.1.1
+
+	// 密码来源，与 password 只能设置其一
+	PasswordEnv     string `json:"password_env"`     // 从该环境变量读取密码
+	PasswordFile    string `json:"password_file"`    // 读取该文件第一行作为密码，相对路径相对配置文件所在目录
+	Credential      string `json:"credential"`       // 加密凭据库中的条目名，用 smb-backup credentials set 添加
+	CredentialStore string `json:"credential_store"` // 凭据库文件，默认为配置文件旁的 credentials.enc
+	PassphraseFile  string `json:"passphrase_file"`  // 凭据库口令文件，未设置时读取 SMB_BACKUP_PASSPHRASE 或在终端输入
 }
 
 type FileTask struct {
 	SourcePath string
 	RelPath    string
 	Size       int64
-	BaseDir    string // 新增：源路径的基础目录名
+	ModTime    time.Time
+	BaseDir    string // 远端子目录（src_path 的 dest）
+	Object     string // 去重模式下的对象路径，非空时代替按源路径映射的远端路径
+	Compressed bool   // 压缩上传，远端路径附加 compressSuffix
+	Dir        bool   // 目录任务，只创建目录和设置修改时间
 }
 
 type Stats struct {
-	TotalFiles     int64
-	TotalBytes     int64
-	ProcessedFiles int64
-	ProcessedBytes int64
-	FailedFiles    int64
-	StartTime      time.Time
+	TotalFiles        int64
+	TotalBytes        int64
+	ProcessedFiles    int64
+	ProcessedBytes    int64
+	FailedFiles       int64
+	ScannedDirs       int64
+	ScanComplete      int32 // 扫描结束后置 1，此后总量不再增长
+	SkippedFiles      int64 // 停止后未开始上传的文件
+	InterruptedFiles  int64 // 上传过程中被中止的文件
+	InconsistentFiles int64 // 复制期间发生变化、按 flag 策略保留的文件
+	ErrorCount        int64 // 上传过程中遇到的错误次数（含重试成功的）
+	LatencyCount      int64 // 参与延迟统计的小文件数
+	LatencyNanos      int64 // 小文件上传总耗时
+	DedupedFiles      int64 // 内容已在共享上、没有重复上传的文件
+	DedupedBytes      int64
+	CompressedFiles   int64 // 压缩上传的文件
+	CompressedBytes   int64 // 压缩上传的文件的原始大小
+	CompressedStored  int64 // 压缩后写入共享的大小
+	SpecialFiles      int64 // 跳过的套接字、管道、设备文件
+	LinkFiles         int64 // 记录在链接清单中、没有上传内容的符号链接和硬链接
+	Dirs              int64 // 创建并设置了修改时间的目录
+	DirFailures       int64
+	StartTime         time.Time
+
+	failures   failureList
+	live       liveState
+	reportPath string     // 本次运行写出的失败报告
+	links      *LinkTable // 扫描时记录链接，nil 表示不记录也不识别硬链接
+	dirs       *DirTasks  // 扫描时记录目录任务，nil 表示不记录
+	scanErrors int64      // 扫描时无法访问的路径数
+	fullScan   bool       // 完整扫描了全部源目录，按失败报告重试时为 false
+}
+
+// latencyFileSize 小于该大小的文件上传耗时主要取决于往返延迟
+const latencyFileSize = 256 * 1024
+
+// recordLatency 记录小文件的上传耗时，供自动调优判断延迟变化
+func (s *Stats) recordLatency(task FileTask, d time.Duration) {
+	if task.Size >= latencyFileSize {
+		return
+	}
+	atomic.AddInt64(&s.LatencyCount, 1)
+	atomic.AddInt64(&s.LatencyNanos, int64(d))
 }
 
 type SMBConnection struct {
-	session *smb2.Session
-	share   *smb2.Share
-	id      int
+	session   *smb2.Session
+	share     *smb2.Share
+	id        int
+	lastUsed  time.Time // 最近一次被 worker 取出的时间
+	lastProbe time.Time // 最近一次健康检查的时间
 }
 
 type SMBPool struct {
 	connChan  chan *SMBConnection
 	config    *Config
 	closeOnce sync.Once
-	wg        sync.WaitGroup
-	mu        sync.Mutex
+	mu        sync.Mutex // 保护 closed，放回连接和关闭 connChan 在锁内进行
 	closed    bool
 	connCount int32 // 跟踪当前连接数
+	nextID    int32 // 下一个新建连接的 ID
+	lost      int32 // 重建失败丢掉的常驻连接，健康检查时补回
+
+	total     int32 // 所有已打开的连接（含使用中和临时连接），不超过 max_connections
+	emergency int32 // 当前临时连接数
+	recreated int64 // 重建成功次数
+	failed    int64 // 建立连接失败次数
 }
 
-// 全局目录创建锁，避免并发创建同一目录
+// DirCreator 记录本次运行在共享上已创建的目录，names 负责源端路径到远端路径的映射
 type DirCreator struct {
 	mu      sync.Mutex
 	created map[string]bool
+	names   *NameMapper
+	objects *ObjectStore // 去重模式下的对象区，未开启时为 nil
 }
 
-func NewDirCreator() *DirCreator {
+func NewDirCreator(names *NameMapper) *DirCreator {
 	return &DirCreator{
 		created: make(map[string]bool),
+		names:   names,
 	}
 }
 
@@ -242,14 +421,21 @@ func isFileSystemError(err error) bool {
 	return false
 }
 
-func NewSMBPool(config *Config, size int) (*SMBPool, error) {
-	if size > 16 {
-		log.Printf("Warning: Pool size %d may exceed SMB connection limit, reducing to 16", size)
-		size = 16
+// NewSMBPool 预创建 size 个连接，capacity 为之后 Grow 能达到的上限
+func NewSMBPool(config *Config, size int, capacity int) (*SMBPool, error) {
+	if capacity > config.MaxConnections {
+		slog.Warn("Pool size may exceed SMB connection limit, reducing", "pool_size", capacity, "max_connections", config.MaxConnections)
+		capacity = config.MaxConnections
+	}
+	if capacity < size {
+		capacity = size
+	}
+	if size > capacity {
+		size = capacity
 	}
 
 	pool := &SMBPool{
-		connChan:  make(chan *SMBConnection, size),
+		connChan:  make(chan *SMBConnection, capacity),
 		config:    config,
 		closed:    false,
 		connCount: 0,
@@ -257,117 +443,236 @@ func NewSMBPool(config *Config, size int) (*SMBPool, error) {
 
 	// 预创建所有连接
 	for i := 0; i < size; i++ {
+		pool.reserve()
 		share, session, err := pool.createConnection(i)
 		if err != nil {
+			pool.unreserve()
 			pool.Close()
 			return nil, fmt.Errorf("failed to create connection %d: %v", i, err)
 		}
+		if sec, ok := inspectSMBSecurity(share); ok {
+			slog.Info("SMB connection security", "conn", i, "security", sec)
+		}
 
 		conn := &SMBConnection{
-			session: session,
-			share:   share,
-			id:      i,
+			session:   session,
+			share:     share,
+			id:        i,
+			lastUsed:  time.Now(),
+			lastProbe: time.Now(),
 		}
 		pool.connChan <- conn
 		atomic.AddInt32(&pool.connCount, 1)
 	}
+	pool.nextID = int32(size)
 
-	log.Printf("SMB connection pool initialized with %d connections", size)
+	slog.Info("SMB connection pool initialized", "connections", size)
 	return pool, nil
 }
 
+// Size 当前池中常驻连接数（不含临时连接）
+func (p *SMBPool) Size() int {
+	return int(atomic.LoadInt32(&p.connCount))
+}
+
+// Grow 新建一个常驻连接放入池中
+func (p *SMBPool) Grow() error {
+	if p.Size() >= cap(p.connChan) {
+		return fmt.Errorf("pool is at capacity %d", cap(p.connChan))
+	}
+
+	if !p.reserve() {
+		return fmt.Errorf("connection limit %d reached", p.config.MaxConnections)
+	}
+
+	id := int(atomic.AddInt32(&p.nextID, 1) - 1)
+	share, session, err := p.createConnection(id)
+	if err != nil {
+		p.unreserve()
+		return err
+	}
+
+	atomic.AddInt32(&p.connCount, 1)
+	p.Put(&SMBConnection{
+		session:   session,
+		share:     share,
+		id:        id,
+		lastUsed:  time.Now(),
+		lastProbe: time.Now(),
+	})
+	return nil
+}
+
+// Shrink 关闭一个空闲的常驻连接，没有空闲连接时返回 false
+func (p *SMBPool) Shrink() bool {
+	conn := p.TryGet()
+	if conn == nil {
+		return false
+	}
+
+	p.discard(conn)
+	return true
+}
+
+// reserve 为新连接占用一个名额，达到 max_connections 时返回 false
+func (p *SMBPool) reserve() bool {
+	for {
+		current := atomic.LoadInt32(&p.total)
+		if int(current) >= p.config.MaxConnections {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.total, current, current+1) {
+			return true
+		}
+	}
+}
+
+func (p *SMBPool) unreserve() {
+	atomic.AddInt32(&p.total, -1)
+}
+
+// discard 关闭连接并释放其名额
+func (p *SMBPool) discard(conn *SMBConnection) {
+	p.closeConnection(conn)
+	p.unreserve()
+	if conn.id >= 0 {
+		atomic.AddInt32(&p.connCount, -1)
+	} else {
+		atomic.AddInt32(&p.emergency, -1)
+	}
+}
+
 func (p *SMBPool) createConnection(id int) (*smb2.Share, *smb2.Session, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", p.config.Host, p.config.Port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(p.config.Host, strconv.Itoa(p.config.Port)))
 	if err != nil {
+		atomic.AddInt64(&p.failed, 1)
 		return nil, nil, err
 	}
 
 	d := &smb2.Dialer{
+		Negotiator: smb2.Negotiator{
+			RequireMessageSigning: p.config.RequireSigning,
+		},
 		Initiator: &smb2.NTLMInitiator{
-			User:     p.config.Username,
-			Password: p.config.Password,
+			User:        p.config.Username,
+			Password:    p.config.Password,
+			Domain:      p.config.Domain,
+			Workstation: p.config.Workstation,
 		},
 	}
 
 	session, err := d.Dial(conn)
 	if err != nil {
 		conn.Close()
+		atomic.AddInt64(&p.failed, 1)
 		return nil, nil, err
 	}
 
 	share, err := session.Mount(p.config.Share)
 	if err != nil {
 		session.Logoff()
+		atomic.AddInt64(&p.failed, 1)
+		return nil, nil, err
+	}
+
+	if err := checkSMBSecurity(p.config, share); err != nil {
+		share.Umount()
+		session.Logoff()
+		atomic.AddInt64(&p.failed, 1)
 		return nil, nil, err
 	}
 
 	return share, session, nil
 }
 
-// GetOrCreate 获取连接，如果超时则尝试创建新连接
+// GetOrCreate 获取连接，如果超时则尝试创建新连接。
+// 临时连接同样计入 max_connections，达到上限后继续等待池中连接归还。
 func (p *SMBPool) GetOrCreate(timeout time.Duration) (*SMBConnection, error) {
-	select {
-	case conn := <-p.connChan:
-		return conn, nil
-	case <-time.After(timeout):
-		// 超时后尝试创建临时连接
-		p.mu.Lock()
-		if p.closed {
+	for {
+		select {
+		case conn := <-p.connChan:
+			conn.lastUsed = time.Now()
+			return conn, nil
+		case <-time.After(timeout):
+			// 超时后尝试创建临时连接
+			p.mu.Lock()
+			if p.closed {
+				p.mu.Unlock()
+				return nil, fmt.Errorf("pool is closed")
+			}
 			p.mu.Unlock()
-			return nil, fmt.Errorf("pool is closed")
-		}
 
-		currentCount := atomic.LoadInt32(&p.connCount)
-		log.Printf("[Pool] Timeout waiting for connection, current pool has %d connections, attempting to create new one", currentCount)
-		p.mu.Unlock()
+			total := atomic.LoadInt32(&p.total)
+			if !p.reserve() {
+				slog.Warn("Timeout waiting for connection, waiting for one to be returned", "open", total, "max_connections", p.config.MaxConnections)
+				continue
+			}
+			slog.Warn("Timeout waiting for connection, creating an emergency connection", "open", total)
 
-		// 尝试创建新连接
-		share, session, err := p.createConnection(-1) // -1 表示临时连接
-		if err != nil {
-			return nil, fmt.Errorf("failed to create emergency connection: %v", err)
-		}
+			// 尝试创建新连接
+			share, session, err := p.createConnection(-1) // -1 表示临时连接
+			if err != nil {
+				p.unreserve()
+				return nil, fmt.Errorf("failed to create emergency connection: %v", err)
+			}
+			atomic.AddInt32(&p.emergency, 1)
 
-		newConn := &SMBConnection{
-			session: session,
-			share:   share,
-			id:      -1, // 临时连接ID
+			newConn := &SMBConnection{
+				session:  session,
+				share:    share,
+				id:       -1, // 临时连接ID
+				lastUsed: time.Now(),
+			}
+
+			slog.Info("Created emergency connection")
+			return newConn, nil
 		}
+	}
+}
 
-		log.Printf("[Pool] Successfully created emergency connection")
-		return newConn, nil
+// TryGet 立即从池中取出空闲连接，没有空闲连接时返回 nil
+func (p *SMBPool) TryGet() *SMBConnection {
+	select {
+	case conn := <-p.connChan:
+		conn.lastUsed = time.Now()
+		return conn
+	default:
+		return nil
 	}
 }
 
 func (p *SMBPool) Get(timeout time.Duration) (*SMBConnection, error) {
 	select {
 	case conn := <-p.connChan:
+		conn.lastUsed = time.Now()
 		return conn, nil
 	case <-time.After(timeout):
 		return nil, fmt.Errorf("timeout waiting for SMB connection")
 	}
 }
 
-// RecreateConnection 重建损坏的连接，确保成功后放回池子
+// RecreateConnection 重建损坏的连接，确保成功后放回池子。
+// 建立连接可能要重试好几秒，不持有 p.mu，以免阻塞其他 worker 放回连接
 func (p *SMBPool) RecreateConnection(oldConn *SMBConnection) (*SMBConnection, error) {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	if p.closed {
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
 		return nil, fmt.Errorf("pool is closed")
 	}
 
-	// 关闭旧连接
+	// 关闭旧连接，新连接沿用它的名额和 ID（临时连接仍是临时连接）
+	id := 0
 	if oldConn != nil {
 		p.closeConnection(oldConn)
 		if oldConn.id >= 0 {
 			atomic.AddInt32(&p.connCount, -1)
+		} else {
+			atomic.AddInt32(&p.emergency, -1)
 		}
-	}
-
-	// 创建新连接，使用重试机制
-	id := 0
-	if oldConn != nil && oldConn.id >= 0 {
 		id = oldConn.id
+	} else if !p.reserve() {
+		return nil, fmt.Errorf("connection limit %d reached", p.config.MaxConnections)
 	}
 
 	var share *smb2.Share
@@ -380,24 +685,35 @@ func (p *SMBPool) RecreateConnection(oldConn *SMBConnection) (*SMBConnection, er
 		if err == nil {
 			break
 		}
-		log.Printf("[Pool] Failed to recreate connection (attempt %d/%d): %v", i+1, maxRetries, err)
-		if i < maxRetries-1 {
-			time.Sleep(time.Second * time.Duration(i+1))
+		slog.Warn("Failed to recreate connection", "attempt", i+1, "retries", maxRetries, "err", err)
+		if i < maxRetries-1 && control.Sleep(time.Second*time.Duration(i+1)) != nil {
+			break
 		}
 	}
 
 	if err != nil {
+		p.unreserve()
+		if id >= 0 {
+			atomic.AddInt32(&p.lost, 1)
+		}
 		return nil, fmt.Errorf("failed to recreate connection after %d attempts: %v", maxRetries, err)
 	}
 
 	newConn := &SMBConnection{
-		session: session,
-		share:   share,
-		id:      id,
+		session:   session,
+		share:     share,
+		id:        id,
+		lastUsed:  time.Now(),
+		lastProbe: time.Now(),
 	}
 
-	atomic.AddInt32(&p.connCount, 1)
-	log.Printf("[Pool] Successfully recreated connection %d, current pool count: %d", id, atomic.LoadInt32(&p.connCount))
+	if id >= 0 {
+		atomic.AddInt32(&p.connCount, 1)
+	} else {
+		atomic.AddInt32(&p.emergency, 1)
+	}
+	atomic.AddInt64(&p.recreated, 1)
+	slog.Info("Recreated connection", "conn", id, "pool_count", atomic.LoadInt32(&p.connCount))
 
 	return newConn, nil
 }
@@ -407,26 +723,27 @@ func (p *SMBPool) Put(conn *SMBConnection) {
 		return
 	}
 
+	// 临时连接用完即关闭，不留在池中；关闭后放回的连接同样关闭。
+	// 放回在锁内进行，Close 关闭 connChan 之后不会再有发送
 	p.mu.Lock()
-	closed := p.closed
+	returned, full := false, false
+	if !p.closed && conn.id >= 0 {
+		select {
+		case p.connChan <- conn:
+			returned = true
+		default:
+			full = true
+		}
+	}
 	p.mu.Unlock()
 
-	if closed {
-		p.closeConnection(conn)
+	if returned {
 		return
 	}
-
-	select {
-	case p.connChan <- conn:
-		// 成功放回池子
-	default:
-		// 池子满了，关闭连接
-		log.Printf("Warning: connection pool full, closing connection %d", conn.id)
-		p.closeConnection(conn)
-		if conn.id >= 0 {
-			atomic.AddInt32(&p.connCount, -1)
-		}
+	if full {
+		slog.Warn("Connection pool full, closing connection", "conn", conn.id)
 	}
+	p.discard(conn)
 }
 
 func (p *SMBPool) closeConnection(conn *SMBConnection) {
@@ -442,15 +759,15 @@ func (p *SMBPool) Close() {
 	p.closeOnce.Do(func() {
 		p.mu.Lock()
 		p.closed = true
+		close(p.connChan)
 		p.mu.Unlock()
 
-		close(p.connChan)
 		count := 0
 		for conn := range p.connChan {
-			p.closeConnection(conn)
+			p.discard(conn)
 			count++
 		}
-		log.Printf("Closed %d SMB connections", count)
+		slog.Info("Closed SMB connections", "connections", count)
 	})
 }
 
@@ -461,106 +778,309 @@ func normalizeSMBPath(path string) string {
 	return path
 }
 
-// joinSMBPath 拼接 SMB 路径
+// joinSMBPath 拼接 SMB 路径，每个分量都做 Windows 安全编码（见 encodeSMBName）
 func joinSMBPath(parts ...string) string {
 	var cleaned []string
 	for _, part := range parts {
 		normalized := normalizeSMBPath(part)
-		if normalized != "" {
-			cleaned = append(cleaned, normalized)
+		if normalized == "" {
+			continue
+		}
+		for _, name := range strings.Split(normalized, "/") {
+			if name != "" {
+				cleaned = append(cleaned, encodeSMBName(name))
+			}
 		}
 	}
 	result := strings.Join(cleaned, "/")
 	return result
 }
 
-func loadConfig(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
-
+// parseConfig 在默认值上依次应用各层 JSON（顶层配置、任务配置），再做校验和标准化
+func parseConfig(filename string, layers ...[]byte) (*Config, error) {
 	config := &Config{
 		Port:       445,
 		BufferSize: 1024 * 1024 * 2, // 2MB 默认缓冲
 		RetryTimes: 3,
 		PoolSize:   12,
-		Verbose:    false,
+
+		ChunkThreshold:   1024 * 1024 * 1024, // 1GB 以上分块上传
+		ChunkSize:        1024 * 1024 * 64,   // 64MB 分块
+		ChunkConnections: 4,
+
+		ResumeMode:      "sample",
+		ResumeMinSize:   1024 * 1024 * 16, // 16MB 以上才尝试续传
+		ResumeBlockSize: 1024 * 1024,
+		ResumeSamples:   8,
+
+		PackSize: 1024 * 1024 * 64, // 64MB 每个分段
+
+		ScanWorkers: 4,
+
+		MinRoutines:  2,
+		MinPoolSize:  2,
+		TuneInterval: 30,
+
+		MaxConnections:      16,
+		HealthCheckInterval: 60,
+
+		ShutdownTimeout: 30,
+
+		MaxNameLength:       255,
+		CaseInsensitiveDest: true,
+
+		ChangedFileRetries: 2,
+		ChangedFilePolicy:  changedPolicyFlag,
+
+		CatchUp: true,
+
+		WakeBroadcast:  "255.255.255.255:9",
+		WakeTimeout:    120,
+		FreeSpaceCheck: freeSpaceOff,
+
+		Symlinks:     symlinkRecord,
+		PreserveDirs: true,
+
+		RepoPackSize: 1024 * 1024 * 16, // 16MB 每个 pack
+
+		CompressMinSize: 4096,
+
+		WebhookOn:   webhookAlways,
+		HookTimeout: 300,
+
+		LogFormat:  "text",
+		LogStdout:  true,
+		LogMaxSize: 10,
+		LogKeep:    20,
+		LogMaxAge:  30,
+		ErrorLog:   true,
 	}
 
-	err = json.Unmarshal(data, config)
-	if err != nil {
-		return nil, err
+	for _, data := range layers {
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, err
+		}
 	}
+	config.path = filename
 
 	// 标准化目标路径
 	config.DestPath = normalizeSMBPath(config.DestPath)
 
-	// 连接池大小限制
-	if config.PoolSize > 16 {
-		log.Printf("Warning: pool_size %d too large, limiting to 16 for Windows compatibility", config.PoolSize)
-		config.PoolSize = 16
+	if config.StateDir == "" {
+		config.StateDir = filepath.Join(filepath.Dir(filename), "state")
 	}
-	if config.PoolSize < 1 {
-		config.PoolSize = 1
+	config.stateRoot = config.StateDir
+	switch config.LogDir {
+	case "":
+		config.LogDir = filepath.Join(config.stateRoot, "logs")
+	case "off":
+		config.LogDir = ""
+	default:
+		config.LogDir = configRelative(filename, config.LogDir)
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = "info"
+		if config.Verbose {
+			config.LogLevel = "debug"
+		}
+	}
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	config.logLevel = level
+	switch config.LogFormat {
+	case "text", "json":
+	default:
+		return nil, fmt.Errorf("invalid log_format %q, expected text or json", config.LogFormat)
+	}
+	if config.PauseFile == "" {
+		config.PauseFile = filepath.Join(config.StateDir, "pause")
+	}
+	if config.ChunkSize < int64(config.BufferSize) {
+		config.ChunkSize = int64(config.BufferSize)
+	}
+	if config.ChunkConnections < 1 {
+		config.ChunkConnections = 1
 	}
 
-	return config, nil
-}
+	config.CredentialStore = defaultCredentialStore(filename, config.CredentialStore)
+	config.PasswordFile = configRelative(filename, config.PasswordFile)
+	config.PassphraseFile = configRelative(filename, config.PassphraseFile)
+	config.RepoPassphraseFile = configRelative(filename, config.RepoPassphraseFile)
+	if config.RepoPath == "" {
+		config.RepoPath = config.DestPath + "/.smb-backup/repo"
+	}
+	config.RepoPath = normalizeSMBPath(config.RepoPath)
+	if config.RepoPackSize < repoChunkMax {
+		config.RepoPackSize = repoChunkMax
+	}
+	if err := resolvePassword(config); err != nil {
+		return nil, err
+	}
+
+	switch config.ResumeMode {
+	case "off", "sample", "full":
+	default:
+		return nil, fmt.Errorf("invalid resume_mode %q, expected off, sample or full", config.ResumeMode)
+	}
+	if err := validateSources(config.SrcPath, config.CaseInsensitiveDest); err != nil {
+		return nil, err
+	}
 
-func scanFiles(paths []string, taskChan chan<- FileTask, stats *Stats) {
-	defer close(taskChan)
+	if config.Schedule != "" {
+		schedule, err := parseCron(config.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule: %v", err)
+		}
+		config.schedule = schedule
+	}
+	if config.Window != "" {
+		window, err := parseTimeWindow(config.Window)
+		if err != nil {
+			return nil, err
+		}
+		config.window = window
+	}
 
-	for _, rootPath := range paths {
-		baseDir := filepath.Base(rootPath)
-		log.Printf("Scanning %s -> base directory: %s", rootPath, baseDir)
+	if err := parseBandwidth(config); err != nil {
+		return nil, err
+	}
 
-		err := filepath.Walk(rootPath, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				log.Printf("Error accessing path %s: %v", path, err)
-				return nil
-			}
+	if config.MinDialect != "" {
+		dialect, ok := smbDialectNames[config.MinDialect]
+		if !ok {
+			return nil, fmt.Errorf("invalid min_dialect %q, expected 2.0.2, 2.1, 3.0, 3.0.2 or 3.1.1", config.MinDialect)
+		}
+		config.minDialect = dialect
+	}
+	if config.RequireEncryption && config.minDialect < smbDialect300 {
+		// 加密从 SMB 3.0 开始才有
+		config.MinDialect = "3.0"
+		config.minDialect = smbDialect300
+	}
 
-			if !info.IsDir() {
-				relPath, err := filepath.Rel(rootPath, path)
-				if err != nil {
-					log.Printf("Error getting relative path: %v", err)
-					return nil
-				}
+	if config.WakeOnLAN != "" {
+		if _, err := net.ParseMAC(config.WakeOnLAN); err != nil {
+			return nil, fmt.Errorf("invalid wake_on_lan: %v", err)
+		}
+	}
 
-				task := FileTask{
-					SourcePath: path,
-					RelPath:    filepath.ToSlash(relPath),
-					Size:       info.Size(),
-					BaseDir:    baseDir,
-				}
+	switch config.WebhookOn {
+	case webhookAlways, webhookFailure:
+	default:
+		return nil, fmt.Errorf("invalid webhook_on %q, expected always or failure", config.WebhookOn)
+	}
+	if config.HookTimeout < 1 {
+		config.HookTimeout = 1
+	}
 
-				atomic.AddInt64(&stats.TotalFiles, 1)
-				atomic.AddInt64(&stats.TotalBytes, info.Size())
+	switch config.FreeSpaceCheck {
+	case freeSpaceOff, freeSpaceWarn, freeSpaceAbort:
+	default:
+		return nil, fmt.Errorf("invalid free_space_check %q, expected off, warn or abort", config.FreeSpaceCheck)
+	}
 
-				taskChan <- task
-			}
-			return nil
-		})
+	switch config.Symlinks {
+	case symlinkRecord, symlinkFollow, symlinkSkip:
+	default:
+		return nil, fmt.Errorf("invalid symlinks %q, expected record, follow or skip", config.Symlinks)
+	}
 
-		if err != nil {
-			log.Printf("Error walking path %s: %v", rootPath, err)
+	switch config.ChangedFilePolicy {
+	case changedPolicyFlag, changedPolicySkip:
+	default:
+		return nil, fmt.Errorf("invalid changed_file_policy %q, expected flag or skip", config.ChangedFilePolicy)
+	}
+	if config.ChangedFileRetries < 0 {
+		config.ChangedFileRetries = 0
+	}
+
+	if config.ResumeBlockSize < 4096 {
+		config.ResumeBlockSize = 4096
+	}
+	if config.ResumeSamples < 2 {
+		config.ResumeSamples = 2
+	}
+
+	if config.Routines < 1 {
+		config.Routines = 1
+	}
+	if config.ScanWorkers < 1 {
+		config.ScanWorkers = 1
+	}
+	if config.SmallFileThreshold > 0 {
+		if config.LargeRoutines < 1 {
+			config.LargeRoutines = max(1, config.Routines/3)
+		}
+		if config.SmallRoutines < 1 {
+			config.SmallRoutines = max(1, config.Routines-config.LargeRoutines)
+		}
+	}
+
+	// 连接池大小限制
+	if config.MaxConnections < 1 {
+		config.MaxConnections = 1
+	}
+	if config.PoolSize > config.MaxConnections {
+		slog.Warn("pool_size too large, limiting to max_connections", "pool_size", config.PoolSize, "max_connections", config.MaxConnections)
+		config.PoolSize = config.MaxConnections
+	}
+	if config.PoolSize < 1 {
+		config.PoolSize = 1
+	}
+
+	if config.AutoTune {
+		config.MinRoutines = max(1, min(config.MinRoutines, config.Routines))
+		config.MinPoolSize = max(1, min(config.MinPoolSize, config.PoolSize))
+		if config.TuneInterval < 5 {
+			config.TuneInterval = 5
 		}
 	}
 
-	log.Printf("Scan complete: %d files, %.2f GB",
-		atomic.LoadInt64(&stats.TotalFiles),
-		float64(atomic.LoadInt64(&stats.TotalBytes))/1024/1024/1024)
+	return config, nil
 }
 
 func uploadFile(pool *SMBPool, task FileTask, config *Config, stats *Stats, dirCreator *DirCreator) error {
+	if dirCreator.objects != nil && task.Object == "" {
+		return uploadDeduped(pool, task, config, stats, dirCreator)
+	}
+
+	if config.ChunkThreshold > 0 && task.Size >= config.ChunkThreshold {
+		for attempt := 1; ; attempt++ {
+			err := uploadFileChunked(pool, task, config, stats, dirCreator)
+			if !isFileChanged(err) {
+				return err
+			}
+			if attempt > config.ChangedFileRetries {
+				return settleChangedFile(pool, task, dirCreator.names.RemotePath(task), err, attempt, config, stats)
+			}
+			slog.Warn("Changed during upload, retrying", "path", task.SourcePath, "attempt", attempt, "retries", config.ChangedFileRetries, "err", err)
+			if control.Sleep(changedRetryDelay(attempt)) != nil {
+				atomic.AddInt64(&stats.InterruptedFiles, 1)
+				return errAborted
+			}
+		}
+	}
+
+	task.Compressed = shouldCompress(task, config)
+
 	var conn *SMBConnection
 	var lastErr error
 	fileRetryCount := 0
+	changedRetryCount := 0
 	tcpRetryCount := 0
 	consecutiveTCPErrors := 0
 
 	for {
+		if control.Aborted() {
+			if conn != nil {
+				pool.Put(conn)
+			}
+			atomic.AddInt64(&stats.InterruptedFiles, 1)
+			return errAborted
+		}
+
 		// 如果没有连接，尝试获取或创建
 		if conn == nil {
 			timeout := 10 * time.Second
@@ -571,58 +1091,75 @@ func uploadFile(pool *SMBPool, task FileTask, config *Config, stats *Stats, dirC
 
 			if err != nil {
 				tcpRetryCount++
-				log.Printf("[Connection Error] Failed to get/create connection (attempt %d): %v", tcpRetryCount, err)
-
 				// 指数退避，但最多等待30秒
 				waitTime := time.Second * time.Duration(min(tcpRetryCount, 30))
-				log.Printf("[Connection Error] Waiting %v before retry...", waitTime)
-				time.Sleep(waitTime)
+				slog.Warn("Failed to get connection, waiting before retry", "attempt", tcpRetryCount, "wait", waitTime, "err", err)
+				control.Sleep(waitTime)
 				continue // 无限重试获取连接
 			}
 
 			// 成功获取连接，重置计数
 			if tcpRetryCount > 0 {
-				log.Printf("[Connection Restored] Successfully obtained connection after %d attempts", tcpRetryCount)
+				slog.Info("Connection restored", "attempts", tcpRetryCount)
 				tcpRetryCount = 0
 			}
 		}
 
 		// 执行上传
-		err := uploadFileOnce(conn.share, task, config, dirCreator)
+		err := uploadFileOnce(conn.share, task, config, stats, dirCreator)
 
 		if err == nil {
 			// 上传成功
 			pool.Put(conn)
 			atomic.AddInt64(&stats.ProcessedFiles, 1)
 			atomic.AddInt64(&stats.ProcessedBytes, task.Size)
-			if config.Verbose {
-				log.Printf("[OK] %s", task.SourcePath)
-			}
+			slog.Debug("Uploaded", "path", task.SourcePath, "bytes", task.Size)
 			return nil
 		}
 
+		if control.Aborted() {
+			// 停止期限已到，放弃当前文件，已写入的部分下次续传
+			pool.Put(conn)
+			atomic.AddInt64(&stats.InterruptedFiles, 1)
+			slog.Warn("Upload interrupted", "path", task.SourcePath)
+			return errAborted
+		}
+
+		// 源文件在复制过程中变化，不是传输错误，单独计数重试
+		if isFileChanged(err) {
+			changedRetryCount++
+			pool.Put(conn)
+			conn = nil
+			if changedRetryCount > config.ChangedFileRetries {
+				return settleChangedFile(pool, task, dirCreator.names.RemotePath(task), err, changedRetryCount, config, stats)
+			}
+			slog.Warn("Changed during upload, retrying", "path", task.SourcePath, "attempt", changedRetryCount, "retries", config.ChangedFileRetries, "err", err)
+			control.Sleep(changedRetryDelay(changedRetryCount))
+			continue
+		}
+
 		// 判断错误类型
+		stats.noteError(task.SourcePath, err)
 		if isTCPConnectionError(err) {
 			// TCP 连接错误 - 无限重试
 			consecutiveTCPErrors++
 			tcpRetryCount++
 
-			log.Printf("[TCP Connection Error] %s (TCP retry #%d): %v - Recreating connection...",
-				task.SourcePath, consecutiveTCPErrors, err)
+			slog.Warn("TCP connection error, recreating connection", "path", task.SourcePath, "attempt", consecutiveTCPErrors, "err", err)
 
 			// 尝试重建连接
 			newConn, recreateErr := pool.RecreateConnection(conn)
 			if recreateErr != nil {
-				log.Printf("[TCP Connection Error] Failed to recreate connection: %v - Will get new connection", recreateErr)
+				slog.Warn("Failed to recreate connection, getting a new one", "err", recreateErr)
 				conn = nil
 				waitTime := time.Duration(min(consecutiveTCPErrors, 10)) * time.Second
-				time.Sleep(waitTime)
+				control.Sleep(waitTime)
 			} else {
-				log.Printf("[TCP Connection Restored] Connection recreated successfully")
+				slog.Info("Connection recreated")
 				// 立即放回池子，让其他等待的worker也能使用
 				pool.Put(newConn)
 				conn = nil // 下次循环重新获取
-				time.Sleep(time.Millisecond * 500)
+				control.Sleep(time.Millisecond * 500)
 			}
 			continue
 
@@ -633,29 +1170,28 @@ func uploadFile(pool *SMBPool, task FileTask, config *Config, stats *Stats, dirC
 			lastErr = err
 
 			if fileRetryCount <= config.RetryTimes {
-				log.Printf("[SMB Session Error - Retry %d/%d] %s: %v - Recreating connection...",
-					fileRetryCount, config.RetryTimes, task.SourcePath, err)
+				slog.Warn("SMB session error, recreating connection", "path", task.SourcePath,
+					"attempt", fileRetryCount, "retries", config.RetryTimes, "err", err)
 
 				newConn, recreateErr := pool.RecreateConnection(conn)
 				if recreateErr != nil {
-					log.Printf("[SMB Session Error] Failed to recreate connection: %v", recreateErr)
+					slog.Warn("Failed to recreate connection", "err", recreateErr)
 					conn = nil
-					time.Sleep(time.Millisecond * time.Duration(200*fileRetryCount))
+					control.Sleep(time.Millisecond * time.Duration(200*fileRetryCount))
 				} else {
-					log.Printf("[SMB Session Restored] Connection recreated")
+					slog.Info("Connection recreated")
 					// 放回池子
 					pool.Put(newConn)
 					conn = nil
-					time.Sleep(time.Millisecond * time.Duration(200*fileRetryCount))
+					control.Sleep(time.Millisecond * time.Duration(200*fileRetryCount))
 				}
 				continue
 			} else {
 				if conn != nil {
 					pool.Put(conn)
 				}
-				atomic.AddInt64(&stats.FailedFiles, 1)
-				log.Printf("[FAILED] %s - SMB Session Error: %v (after %d retries)",
-					task.SourcePath, lastErr, config.RetryTimes)
+				stats.recordFailure(task, errorClassSMBSession, lastErr, fileRetryCount)
+				slog.Error("Upload failed", "path", task.SourcePath, "class", errorClassSMBSession, "attempts", fileRetryCount, "err", lastErr)
 				return lastErr
 			}
 
@@ -666,20 +1202,19 @@ func uploadFile(pool *SMBPool, task FileTask, config *Config, stats *Stats, dirC
 			lastErr = err
 
 			if fileRetryCount <= config.RetryTimes {
-				log.Printf("[File System Error - Retry %d/%d] %s: %v",
-					fileRetryCount, config.RetryTimes, task.SourcePath, err)
+				slog.Warn("File system error, retrying", "path", task.SourcePath,
+					"attempt", fileRetryCount, "retries", config.RetryTimes, "err", err)
 
 				pool.Put(conn)
 				conn = nil
-				time.Sleep(time.Millisecond * time.Duration(100*fileRetryCount))
+				control.Sleep(time.Millisecond * time.Duration(100*fileRetryCount))
 				continue
 			} else {
 				if conn != nil {
 					pool.Put(conn)
 				}
-				atomic.AddInt64(&stats.FailedFiles, 1)
-				log.Printf("[FAILED] %s - File System Error: %v (after %d retries)",
-					task.SourcePath, lastErr, config.RetryTimes)
+				stats.recordFailure(task, errorClassFileSystem, lastErr, fileRetryCount)
+				slog.Error("Upload failed", "path", task.SourcePath, "class", errorClassFileSystem, "attempts", fileRetryCount, "err", lastErr)
 				return lastErr
 			}
 
@@ -690,39 +1225,45 @@ func uploadFile(pool *SMBPool, task FileTask, config *Config, stats *Stats, dirC
 			lastErr = err
 
 			if fileRetryCount <= config.RetryTimes {
-				log.Printf("[Unknown Error - Retry %d/%d] %s: %v",
-					fileRetryCount, config.RetryTimes, task.SourcePath, err)
+				slog.Warn("Upload error, retrying", "path", task.SourcePath,
+					"attempt", fileRetryCount, "retries", config.RetryTimes, "err", err)
 
 				pool.Put(conn)
 				conn = nil
-				time.Sleep(time.Millisecond * time.Duration(100*fileRetryCount))
+				control.Sleep(time.Millisecond * time.Duration(100*fileRetryCount))
 				continue
 			} else {
 				if conn != nil {
 					pool.Put(conn)
 				}
-				atomic.AddInt64(&stats.FailedFiles, 1)
-				log.Printf("[FAILED] %s - Unknown Error: %v (after %d retries)",
-					task.SourcePath, lastErr, config.RetryTimes)
+				stats.recordFailure(task, errorClassUnknown, lastErr, fileRetryCount)
+				slog.Error("Upload failed", "path", task.SourcePath, "class", errorClassUnknown, "attempts", fileRetryCount, "err", lastErr)
 				return lastErr
 			}
 		}
 	}
 }
 
-func uploadFileOnce(share *smb2.Share, task FileTask, config *Config, dirCreator *DirCreator) error {
+func uploadFileOnce(share *smb2.Share, task FileTask, config *Config, stats *Stats, dirCreator *DirCreator) error {
 	srcFile, err := os.Open(task.SourcePath)
 	if err != nil {
 		return fmt.Errorf("open source: %v", err)
 	}
 	defer srcFile.Close()
 
-	destPath := joinSMBPath(config.DestPath, task.BaseDir, task.RelPath)
-
-	if config.Verbose {
-		log.Printf("[PATH] src=%s, base=%s, rel=%s, dst=%s",
-			task.SourcePath, task.BaseDir, task.RelPath, destPath)
+	// 复制前的快照，复制结束后比较以发现正在被写入的文件
+	before, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat source: %v", err)
+	}
+	if err := checkObjectSource(task, before); err != nil {
+		return err
 	}
+	task.Size = before.Size()
+
+	destPath := dirCreator.names.RemotePath(task)
+
+	slog.Debug("Upload path", "path", task.SourcePath, "base", task.BaseDir, "rel", task.RelPath, "dest", destPath)
 
 	destDir := ""
 	if idx := strings.LastIndex(destPath, "/"); idx != -1 {
@@ -730,42 +1271,92 @@ func uploadFileOnce(share *smb2.Share, task FileTask, config *Config, dirCreator
 	}
 
 	if destDir != "" {
-		if config.Verbose {
-			log.Printf("[MKDIR] %s", destDir)
-		}
+		slog.Debug("Ensure dir", "dest", destDir)
 		err = dirCreator.EnsureDir(share, destDir)
 		if err != nil {
 			return fmt.Errorf("create dir '%s': %v", destDir, err)
 		}
 	}
 
-	if config.Verbose {
-		log.Printf("[CREATE] %s", destPath)
+	var dstFile *smb2.File
+	offset := verifiedResumeOffset(share, srcFile, destPath, task, config)
+	if resumable(task, config) && offset == 0 {
+		// 写入前留下记录，中断后下次运行才会续传
+		markUploading(config, task, destPath)
 	}
-	dstFile, err := share.Create(destPath)
-	if err != nil {
-		return fmt.Errorf("create dest '%s': %v", destPath, err)
+	if offset > 0 {
+		slog.Info("Resuming upload", "path", task.SourcePath, "offset", offset, "bytes", task.Size)
+		dstFile, err = openForResume(share, srcFile, destPath, offset)
+		if err != nil {
+			return err
+		}
+	} else {
+		slog.Debug("Create", "dest", destPath)
+		dstFile, err = share.Create(destPath)
+		if err != nil {
+			return fmt.Errorf("create dest '%s': %v", destPath, err)
+		}
 	}
 	defer dstFile.Close()
 
 	buffer := make([]byte, config.BufferSize)
-	written, err := io.CopyBuffer(dstFile, srcFile, buffer)
+	var written, stored int64
+	if task.Compressed {
+		// 限速按实际写入共享的字节计算
+		written, stored, err = copyCompressed(bandwidth.Writer(newConnLimiter(config).Writer(dstFile)), control.Reader(srcFile), buffer)
+	} else {
+		written, err = io.CopyBuffer(dstFile, bandwidth.Reader(newConnLimiter(config).Reader(control.Reader(srcFile))), buffer)
+	}
+	written += offset
 	if err != nil {
 		return fmt.Errorf("copy data: %v", err)
 	}
 
+	if err := checkUnchanged(task.SourcePath, before); err != nil {
+		return err
+	}
 	if written != task.Size {
 		return fmt.Errorf("size mismatch: expected %d, wrote %d", task.Size, written)
 	}
+	if resumable(task, config) {
+		clearUploading(config, destPath)
+	}
 
+	if task.Compressed {
+		atomic.AddInt64(&stats.CompressedFiles, 1)
+		atomic.AddInt64(&stats.CompressedBytes, written)
+		atomic.AddInt64(&stats.CompressedStored, stored)
+	}
+	// 以前以另一种方式（压缩或不压缩）上传的副本已过时
+	if config.Compress {
+		share.Remove(staleRemotePath(destPath, task.Compressed))
+	}
 	return nil
 }
 
-func worker(id int, pool *SMBPool, taskChan <-chan FileTask, config *Config, stats *Stats, dirCreator *DirCreator, wg *sync.WaitGroup) {
+func worker(id int, pool *SMBPool, queue *TaskQueue, gate *WorkGate, config *Config, stats *Stats, dirCreator *DirCreator, wg *sync.WaitGroup) {
 	defer wg.Done()
+	name := fmt.Sprintf("worker-%02d", id)
+
+	for {
+		task, ok := queue.Pop()
+		if !ok {
+			return
+		}
+
+		if control.Stopping() || control.Wait() != nil {
+			atomic.AddInt64(&stats.SkippedFiles, 1)
+			continue
+		}
 
-	for task := range taskChan {
+		gate.Acquire()
+		start := time.Now()
+		stats.setWorker(name, task.SourcePath, task.Size)
 		err := uploadFile(pool, task, config, stats, dirCreator)
+		stats.clearWorker(name)
+		gate.Release()
+		stats.recordLatency(task, time.Since(start))
+
 		if err != nil {
 			// 错误已在 uploadFile 中记录
 			_ = err
@@ -773,6 +1364,9 @@ func worker(id int, pool *SMBPool, taskChan <-chan FileTask, config *Config, sta
 	}
 }
 
+// etaWindow 计算 ETA 时参考的最近采样数（每 5 秒一次）
+const etaWindow = 12
+
 func statsReporter(stats *Stats, done <-chan struct{}) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
@@ -780,6 +1374,13 @@ func statsReporter(stats *Stats, done <-chan struct{}) {
 	lastBytes := int64(0)
 	lastTime := stats.StartTime
 
+	// 最近一段时间的字节进度，用于按字节估算剩余时间
+	type sample struct {
+		at    time.Time
+		bytes int64
+	}
+	window := []sample{{stats.StartTime, 0}}
+
 	for {
 		select {
 		case <-ticker.C:
@@ -787,20 +1388,46 @@ func statsReporter(stats *Stats, done <-chan struct{}) {
 			processed := atomic.LoadInt64(&stats.ProcessedFiles)
 			total := atomic.LoadInt64(&stats.TotalFiles)
 			processedBytes := atomic.LoadInt64(&stats.ProcessedBytes)
+			totalBytes := atomic.LoadInt64(&stats.TotalBytes)
 			failed := atomic.LoadInt64(&stats.FailedFiles)
+			scanDone := atomic.LoadInt32(&stats.ScanComplete) == 1
 
 			now := time.Now()
 			intervalSeconds := now.Sub(lastTime).Seconds()
 			intervalBytes := processedBytes - lastBytes
-			instantSpeed := float64(intervalBytes) / intervalSeconds / 1024 / 1024
+			instantSpeed := int64(float64(intervalBytes) / intervalSeconds)
+			avgSpeed := int64(float64(processedBytes) / elapsed)
 
-			avgSpeed := float64(processedBytes) / elapsed / 1024 / 1024
-			progress := float64(processed) / float64(total) * 100
-
-			if total > 0 && processed > 0 {
-				eta := time.Duration(float64(elapsed)/float64(processed)*float64(total-processed)) * time.Second
-				log.Printf("Progress: %d/%d (%.1f%%) | Speed: %.2f MB/s (avg: %.2f MB/s) | Failed: %d | ETA: %v",
-					processed, total, progress, instantSpeed, avgSpeed, failed, eta.Round(time.Second))
+			window = append(window, sample{now, processedBytes})
+			if len(window) > etaWindow+1 {
+				window = window[1:]
+			}
+			windowSpeed := float64(processedBytes-window[0].bytes) / now.Sub(window[0].at).Seconds()
+
+			eta := "unknown"
+			etaDuration := time.Duration(-1)
+			if windowSpeed > 0 {
+				remaining := max(totalBytes-processedBytes, 0)
+				etaDuration = (time.Duration(float64(remaining)/windowSpeed) * time.Second).Round(time.Second)
+				eta = etaDuration.String()
+			}
+			stats.setRate(float64(intervalBytes)/intervalSeconds, float64(processedBytes)/elapsed, etaDuration)
+
+			if control.Paused() {
+				slog.Info("Paused", "processed_files", processed, "bytes", processedBytes)
+			} else if !scanDone {
+				// 扫描尚未结束，总量还在增长，ETA 只是下限
+				slog.Info("Progress (scan in progress)",
+					"processed_files", processed, "bytes", processedBytes,
+					"found_files", total, "found_bytes", totalBytes, "scanned_dirs", atomic.LoadInt64(&stats.ScannedDirs),
+					"speed", formatByteRate(instantSpeed), "avg_speed", formatByteRate(avgSpeed),
+					"failed_files", failed, "eta_at_least", eta)
+			} else if total > 0 {
+				progress := float64(processedBytes) / float64(max(totalBytes, 1)) * 100
+				slog.Info("Progress",
+					"processed_files", processed, "total_files", total, "bytes", processedBytes, "total_bytes", totalBytes,
+					"percent", fmt.Sprintf("%.1f", progress), "speed", formatByteRate(instantSpeed), "avg_speed", formatByteRate(avgSpeed),
+					"failed_files", failed, "eta", eta)
 			}
 
 			lastBytes = processedBytes
@@ -820,116 +1447,404 @@ func min(a, b int) int {
 }
 
 func main() {
-	var configPath string
-
-	if len(os.Args) < 2 {
-		exePath, err := os.Executable()
-		if err != nil {
-			log.Fatalf("Failed to get executable path: %v", err)
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "retry-failed":
+			retryFailedCommand(args[1:])
+			return
+		case "restore":
+			restoreCommand(args[1:])
+			return
+		case "run":
+			runCommand(args[1:])
+			return
+		case "daemon":
+			daemonCommand(args[1:])
+			return
+		case "credentials":
+			credentialsCommand(args[1:])
+			return
+		case "repo":
+			repoCommand(args[1:])
+			return
 		}
-		exeDir := filepath.Dir(exePath)
-		defaultConfig := filepath.Join(exeDir, "config.json")
+	}
 
-		if _, err := os.Stat(defaultConfig); err == nil {
-			configPath = defaultConfig
-			log.Printf("Using default config file: %s", configPath)
-		} else {
-			log.Println("Error: No config file specified and config.json not found in program directory")
-			log.Fatal("Usage: smb-backup [config.json]")
-		}
+	var configPath string
+	if len(args) > 0 {
+		configPath = args[0]
 	} else {
-		configPath = os.Args[1]
+		configPath = defaultConfigPath()
+	}
+
+	jobs, err := loadJobs(configPath)
+	if err != nil {
+		fatalConfig("Failed to load config", "err", err)
+	}
+	if err := setupLogging(jobs[0]); err != nil {
+		fatalConfig("Failed to set up logging", "err", err)
+	}
+
+	control.handleSignals(time.Duration(jobs[0].ShutdownTimeout) * time.Second)
+
+	os.Exit(runJobs(jobs))
+}
+
+// defaultConfigPath 未指定配置文件时使用程序所在目录下的 config.json
+func defaultConfigPath() string {
+	exePath, err := os.Executable()
+	if err != nil {
+		fatal("Failed to get executable path", "err", err)
+	}
+	exeDir := filepath.Dir(exePath)
+	defaultConfig := filepath.Join(exeDir, "config.json")
+
+	if _, err := os.Stat(defaultConfig); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: No config file specified and config.json not found in program directory")
+		fmt.Fprintln(os.Stderr, "Usage: smb-backup [config.json]")
+		fmt.Fprintln(os.Stderr, "       smb-backup run [-config config.json] [job ...]")
+		fmt.Fprintln(os.Stderr, "       smb-backup daemon [-config config.json]")
+		fmt.Fprintln(os.Stderr, "       smb-backup retry-failed <report.json> [config.json]")
+		fmt.Fprintln(os.Stderr, "       smb-backup restore [-job name] <config.json> <local_dir> [path_prefix]")
+		fmt.Fprintln(os.Stderr, "       smb-backup repo [-config config.json] [-job name] backup|snapshots|restore|check|prune")
+		os.Exit(exitConfigError)
+	}
+
+	slog.Info("Using default config file", "path", defaultConfig)
+	return defaultConfig
+}
+
+// retryFailedCommand 按失败报告重新上传，默认使用报告中记录的配置文件
+func retryFailedCommand(args []string) {
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: smb-backup retry-failed <report.json> [config.json]")
+		os.Exit(exitConfigError)
+	}
+
+	report, err := loadFailureReport(args[0])
+	if err != nil {
+		fatal("Failed to load failure report", "err", err)
 	}
 
-	config, err := loadConfig(configPath)
+	configPath := report.Config
+	if len(args) > 1 {
+		configPath = args[1]
+	}
+	if configPath == "" {
+		configPath = defaultConfigPath()
+	}
+
+	config, err := loadJobConfig(configPath, report.Job)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
-	}
-
-	log.Printf("Configuration loaded:")
-	log.Printf("  Routines: %d", config.Routines)
-	log.Printf("  Pool Size: %d", config.PoolSize)
-	log.Printf("  Retry Times: %d (for SMB session and file system errors)", config.RetryTimes)
-	log.Printf("  Buffer Size: %d bytes", config.BufferSize)
-	log.Printf("  Verbose: %v", config.Verbose)
-	log.Printf("  Source paths: %v", config.SrcPath)
-	log.Printf("  Destination: //%s/%s/%s", config.Host, config.Share, config.DestPath)
-	log.Printf("")
-	log.Printf("Error Handling Strategy:")
-	log.Printf("  - TCP Connection Errors: Retry indefinitely with exponential backoff")
-	log.Printf("  - SMB Session Errors: Retry up to %d times with connection recreation", config.RetryTimes)
-	log.Printf("  - File System Errors: Retry up to %d times", config.RetryTimes)
-	log.Printf("  - Connection Pool Timeout: Automatically create emergency connections")
-	log.Printf("")
+		fatalConfig("Failed to load config", "err", err)
+	}
+	if err := setupLogging(config); err != nil {
+		fatalConfig("Failed to set up logging", "err", err)
+	}
+
+	control.handleSignals(time.Duration(config.ShutdownTimeout) * time.Second)
+
+	start := time.Now()
+	stats, err := runBackup(config, feedFailedFiles(report))
+	if err != nil {
+		slog.Error("Backup failed", "err", err)
+	}
+	notifyRunResult(config, start, stats, err)
+
+	switch runStatus(stats, err) {
+	case runStatusFailed:
+		os.Exit(exitFailed)
+	case runStatusPartial:
+		os.Exit(exitPartial)
+	}
+}
+
+// runBackup 建立连接池并启动 worker，由 feed 提供上传任务，结束后输出统计。
+// 无法连接目标时返回错误，此时没有上传任何文件
+func runBackup(config *Config, feed func(sched *Scheduler, stats *Stats)) (*Stats, error) {
+	attrs := []any{"routines", config.Routines}
+	if config.Name != "" {
+		attrs = append(attrs, "job", config.Name)
+	}
+	if config.SmallFileThreshold > 0 {
+		attrs = append(attrs, "small_file_threshold", config.SmallFileThreshold, "small_routines", config.SmallRoutines,
+			"small_file_pack", config.SmallFilePack, "large_routines", config.LargeRoutines)
+	}
+	attrs = append(attrs, "largest_first", config.LargestFirst,
+		"pool_size", config.PoolSize, "max_connections", config.MaxConnections)
+	if config.HealthCheckInterval > 0 {
+		attrs = append(attrs, "health_check_interval", config.HealthCheckInterval, "max_idle_time", config.MaxIdleTime)
+	}
+	if config.AutoTune {
+		attrs = append(attrs, "auto_tune_routines", fmt.Sprintf("%d-%d", config.MinRoutines, config.Routines),
+			"auto_tune_pool_size", fmt.Sprintf("%d-%d", config.MinPoolSize, config.PoolSize), "tune_interval", config.TuneInterval)
+	}
+	attrs = append(attrs, "retry_times", config.RetryTimes, "buffer_size", config.BufferSize)
+	if config.ChunkThreshold > 0 {
+		attrs = append(attrs, "chunk_threshold", config.ChunkThreshold, "chunk_size", config.ChunkSize,
+			"chunk_connections", config.ChunkConnections)
+	}
+	attrs = append(attrs, "state_dir", config.StateDir,
+		"shutdown_timeout", config.ShutdownTimeout, "pause_file", config.PauseFile,
+		"log_level", config.logLevel.String(), "log_dir", config.LogDir)
+	sources := make([]string, len(config.SrcPath))
+	for i, src := range config.SrcPath {
+		sources[i] = src.String()
+	}
+	attrs = append(attrs, "sources", strings.Join(sources, "; "),
+		"scan_workers", config.ScanWorkers, "pre_scan", config.PreScan,
+		"symlinks", config.Symlinks, "preserve_dirs", config.PreserveDirs,
+		"destination", fmt.Sprintf("//%s/%s/%s", config.Host, config.Share, config.DestPath))
+	if config.RequireSigning || config.RequireEncryption || config.MinDialect != "" {
+		attrs = append(attrs, "require_signing", config.RequireSigning,
+			"require_encryption", config.RequireEncryption, "min_dialect", config.MinDialect)
+	}
+	if config.bandwidthLimit > 0 || len(config.BandwidthSchedule) > 0 || config.connectionLimit > 0 {
+		attrs = append(attrs, "bandwidth", formatByteRate(config.bandwidthLimit),
+			"bandwidth_periods", len(config.BandwidthSchedule), "connection_bandwidth", formatByteRate(config.connectionLimit))
+	}
+	if config.Compress {
+		attrs = append(attrs, "compress_min_size", config.CompressMinSize)
+	}
+	if config.Dedup {
+		attrs = append(attrs, "dedup_objects", joinSMBPath(config.DestPath, objectDirName))
+	}
+	if config.StatusListen != "" {
+		attrs = append(attrs, "status_server", "http://"+config.StatusListen+"/")
+	}
+	if config.WakeOnLAN != "" {
+		attrs = append(attrs, "wake_on_lan", config.WakeOnLAN, "wake_broadcast", config.WakeBroadcast,
+			"wake_timeout", config.WakeTimeout)
+	}
+	if config.FreeSpaceCheck != freeSpaceOff {
+		attrs = append(attrs, "free_space_check", config.FreeSpaceCheck, "free_space_margin", config.FreeSpaceMargin)
+	}
+	attrs = append(attrs, "max_name_length", config.MaxNameLength, "max_path_length", config.MaxPathLength,
+		"case_insensitive_dest", config.CaseInsensitiveDest)
+	slog.Info("Configuration loaded", attrs...)
+
+	// TCP 连接错误无限重试；SMB 会话错误和文件系统错误、分块上传失败的范围最多重试 retry_times 次；
+	// 连接池等待超时时最多临时建立到 max_connections 个连接
+	slog.Info("Error handling",
+		"session_and_fs_retries", config.RetryTimes,
+		"emergency_connections_up_to", config.MaxConnections,
+		"resume_mode", config.ResumeMode,
+		"changed_file_retries", config.ChangedFileRetries, "changed_file_policy", config.ChangedFilePolicy)
 
 	stats := &Stats{
 		StartTime: time.Now(),
+		links:     NewLinkTable(config),
+	}
+	if config.PreserveDirs {
+		stats.dirs = NewDirTasks()
 	}
 
-	pool, err := NewSMBPool(config, config.PoolSize)
+	status.start(config.StatusListen)
+	status.attach(config, stats, nil)
+	defer status.detach()
+
+	if err := preflightReachability(config); err != nil {
+		return nil, err
+	}
+
+	// 可用空间检查需要先知道本次要写入多少数据，扫描结果暂存后再交给 worker
+	if config.FreeSpaceCheck != freeSpaceOff {
+		slog.Info("Scanning files before free space check")
+		tasks := collectTasks(feed, stats)
+		if err := checkFreeSpace(config, tasks); err != nil {
+			return nil, err
+		}
+		feed = replayTasks(tasks)
+	}
+
+	poolSize := config.PoolSize
+	if config.AutoTune {
+		poolSize = config.MinPoolSize
+	}
+	doneChan := make(chan struct{})
+	pool, err := NewSMBPool(config, poolSize, config.PoolSize)
 	if err != nil {
-		log.Fatalf("Failed to create SMB pool: %v", err)
+		return nil, fmt.Errorf("create SMB pool: %v", err)
 	}
 	defer pool.Close()
 
-	dirCreator := NewDirCreator()
+	status.attach(config, stats, pool)
+
+	names := NewNameMapper(config)
+	dirCreator := NewDirCreator(names)
+	if config.Dedup {
+		dirCreator.objects = NewObjectStore(config)
+	}
 
-	log.Println("Testing destination path...")
+	slog.Info("Testing destination path")
 	testConn, err := pool.Get(10 * time.Second)
 	if err != nil {
-		log.Fatalf("Failed to get test connection: %v", err)
+		return nil, fmt.Errorf("get test connection: %v", err)
 	}
 
 	testPath := joinSMBPath(config.DestPath, ".test")
-	log.Printf("  Test path: %s", testPath)
 
-	err = dirCreator.EnsureDir(testConn.share, config.DestPath)
+	err = dirCreator.EnsureDir(testConn.share, joinSMBPath(config.DestPath))
 	if err != nil {
-		log.Printf("  Warning: Failed to create base dir: %v", err)
+		slog.Warn("Failed to create base dir", "dest", config.DestPath, "err", err)
 	} else {
-		log.Printf("  Base directory OK")
+		slog.Info("Base directory OK", "dest", config.DestPath)
 	}
 
 	testFile, err := testConn.share.Create(testPath)
 	if err != nil {
-		log.Printf("  Warning: Failed to create test file: %v", err)
+		slog.Warn("Failed to create test file", "dest", testPath, "err", err)
 	} else {
 		testFile.Write([]byte("test"))
 		testFile.Close()
 		testConn.share.Remove(testPath)
-		log.Printf("  Test file creation OK")
+		slog.Info("Test file creation OK", "dest", testPath)
+	}
+
+	if err := names.Load(testConn.share); err != nil {
+		slog.Warn("Failed to load name manifest", "err", err)
+	}
+	if err := stats.links.Load(testConn.share); err != nil {
+		slog.Warn("Failed to load link manifest", "err", err)
+	}
+	if dirCreator.objects != nil {
+		if err := dirCreator.objects.Load(testConn.share); err != nil {
+			return nil, fmt.Errorf("load dedup manifest: %v", err)
+		}
 	}
 
 	pool.Put(testConn)
 
-	taskChan := make(chan FileTask, config.Routines*2)
+	go control.watchPauseFile(config.PauseFile, doneChan)
+
+	applyBandwidth(config)
+	go bandwidthScheduler(config, doneChan)
+
+	// 健康检查和自动调节会取出、重建连接，关闭连接池之前等它们退出
+	var poolUsers sync.WaitGroup
+	if config.HealthCheckInterval > 0 {
+		poolUsers.Add(1)
+		go func() {
+			defer poolUsers.Done()
+			pool.healthCheck(time.Duration(config.HealthCheckInterval)*time.Second,
+				time.Duration(config.MaxIdleTime)*time.Second, doneChan)
+		}()
+	}
+
+	sched := NewScheduler(config)
+
+	var gate *WorkGate
+	if config.AutoTune {
+		gate = NewWorkGate(config.MinRoutines)
+		poolUsers.Add(1)
+		go func() {
+			defer poolUsers.Done()
+			newAutoTuner(config, pool, gate, stats).run(doneChan)
+		}()
+	}
 
-	doneChan := make(chan struct{})
 	go statsReporter(stats, doneChan)
 
 	var wg sync.WaitGroup
-	for i := 0; i < config.Routines; i++ {
-		wg.Add(1)
-		go worker(i, pool, taskChan, config, stats, dirCreator, &wg)
+	if sched.Split() {
+		for i := 0; i < config.LargeRoutines; i++ {
+			wg.Add(1)
+			go worker(i, pool, sched.large, gate, config, stats, dirCreator, &wg)
+		}
+		for i := 0; i < config.SmallRoutines; i++ {
+			wg.Add(1)
+			if config.SmallFilePack {
+				go packWorker(i, pool, sched.small, gate, config, stats, dirCreator, &wg)
+			} else {
+				go worker(config.LargeRoutines+i, pool, sched.small, gate, config, stats, dirCreator, &wg)
+			}
+		}
+	} else {
+		for i := 0; i < config.Routines; i++ {
+			wg.Add(1)
+			go worker(i, pool, sched.large, gate, config, stats, dirCreator, &wg)
+		}
 	}
 
-	log.Println("Scanning files...")
-	scanFiles(config.SrcPath, taskChan, stats)
+	slog.Info("Scanning files")
+	feed(sched, stats)
 
 	wg.Wait()
+	recordOrphanLinks(stats)
 	close(doneChan)
+	poolUsers.Wait()
+
+	if conn, err := pool.Get(30 * time.Second); err != nil {
+		slog.Warn("Failed to save name manifest", "err", err)
+	} else {
+		// 中断时目录中的文件可能还没写完，目录留到下次运行
+		if stats.dirs != nil && !control.Stopping() {
+			applyDirTasks(conn.share, stats.dirs.Tasks(), names, dirCreator, stats)
+		}
+		if err := names.Save(conn.share, dirCreator); err != nil {
+			slog.Warn("Failed to save name manifest", "err", err)
+		}
+		prunePacks(conn.share, config, stats)
+		if err := stats.links.Save(conn.share, dirCreator); err != nil {
+			slog.Warn("Failed to save link manifest", "err", err)
+		}
+		if dirCreator.objects != nil {
+			if err := dirCreator.objects.Save(conn.share, dirCreator); err != nil {
+				slog.Warn("Failed to save dedup manifest", "err", err)
+			}
+		}
+		pool.Put(conn)
+	}
 
 	elapsed := time.Since(stats.StartTime)
-	log.Println("========================================")
-	log.Printf("Backup completed in %v", elapsed.Round(time.Second))
-	log.Printf("Total files: %d", stats.TotalFiles)
-	log.Printf("Processed files: %d", stats.ProcessedFiles)
-	log.Printf("Failed files: %d", stats.FailedFiles)
-	log.Printf("Total size: %.2f GB", float64(stats.TotalBytes)/1024/1024/1024)
-	log.Printf("Average speed: %.2f MB/s", float64(stats.ProcessedBytes)/elapsed.Seconds()/1024/1024)
-	log.Println("========================================")
-
-	if stats.FailedFiles > 0 {
-		os.Exit(1)
+	msg := "Backup completed"
+	if control.Stopping() {
+		msg = "Backup interrupted"
+	}
+	summary := []any{"elapsed", elapsed.Round(time.Second),
+		"total_files", stats.TotalFiles, "processed_files", stats.ProcessedFiles, "failed_files", stats.FailedFiles,
+		"total_bytes", stats.TotalBytes, "bytes", stats.ProcessedBytes,
+		"avg_speed", formatByteRate(int64(float64(stats.ProcessedBytes) / elapsed.Seconds()))}
+	if stats.DedupedFiles > 0 {
+		summary = append(summary, "deduped_files", stats.DedupedFiles, "deduped_bytes", stats.DedupedBytes)
+	}
+	if stats.Dirs > 0 || stats.DirFailures > 0 {
+		summary = append(summary, "dirs", stats.Dirs, "dir_failures", stats.DirFailures)
+	}
+	if stats.LinkFiles > 0 {
+		summary = append(summary, "link_files", stats.LinkFiles, "link_manifest", linkManifestPath)
+	}
+	if stats.SpecialFiles > 0 {
+		summary = append(summary, "special_files", stats.SpecialFiles)
 	}
+	if stats.CompressedFiles > 0 {
+		summary = append(summary, "compressed_files", stats.CompressedFiles,
+			"compressed_bytes", stats.CompressedBytes, "compressed_stored", stats.CompressedStored)
+	}
+	if stats.InconsistentFiles > 0 {
+		summary = append(summary, "inconsistent_files", stats.InconsistentFiles)
+	}
+	if control.Stopping() {
+		summary = append(summary, "skipped_files", stats.SkippedFiles, "interrupted_files", stats.InterruptedFiles)
+	}
+	summary = append(summary, "connections", pool.Metrics())
+	if n := names.Len(); n > 0 {
+		summary = append(summary, "mapped_names", n, "name_manifest", joinSMBPath(config.DestPath, nameManifestPath))
+	}
+	slog.Info(msg, summary...)
+
+	if err := saveRunSummary(config, newRunSummary(config, stats)); err != nil {
+		slog.Warn("Failed to save run summary", "err", err)
+	}
+
+	reportPath, err := writeFailureReport(config, stats)
+	if err != nil {
+		slog.Warn("Failed to write failure report", "err", err)
+	} else if reportPath != "" {
+		stats.reportPath = reportPath
+		slog.Info("Failure report written", "path", reportPath, "retry", "smb-backup retry-failed "+reportPath)
+	}
+
+	return stats, nil
 }
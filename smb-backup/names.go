@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// Windows 不允许的字符、结尾的点和空格、保留设备名的首字符映射到私用区 U+F000+c，
+// 与 Cygwin / WSL 的做法相同，解码时减去 0xF000 即可还原。
+// 以 compressSuffix 结尾的名字转义后缀的点，不和压缩上传附加的后缀混淆
+const nameEscapeBase = 0xF000
+
+// 超长路径和无法直接还原的名字记录在目标目录下的映射清单中
+const (
+	nameManifestPath = ".smb-backup/names.json"
+	longPathDirName  = ".smb-backup/long"
+)
+
+// encodeSMBName 把单个路径分量编码为 Windows 可接受的名字，合法的名字保持不变
+func encodeSMBName(name string) string {
+	if name == "." || name == ".." {
+		return name
+	}
+
+	runes := []rune(name)
+	end := len(runes)
+	for end > 0 && (runes[end-1] == '.' || runes[end-1] == ' ') {
+		end--
+	}
+	reserved := isReservedName(name)
+	suffixDot := -1
+	if n := len(runes) - len(compressSuffix); n >= 0 && strings.ToLower(string(runes[n:])) == compressSuffix {
+		suffixDot = n
+	}
+
+	var b strings.Builder
+	for i, r := range runes {
+		if (i == 0 && reserved) || i >= end || i == suffixDot || r < 0x20 || strings.ContainsRune(`"*:<>?|\`, r) {
+			b.WriteRune(nameEscapeBase + r)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// decodeSMBName 还原 encodeSMBName 的结果
+func decodeSMBName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r > nameEscapeBase && r < nameEscapeBase+0x80 {
+			return r - nameEscapeBase
+		}
+		return r
+	}, name)
+}
+
+func decodeSMBPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = decodeSMBName(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// isReservedName CON、NUL、COM1 等设备名，带扩展名时同样不可用
+func isReservedName(name string) bool {
+	base := name
+	if i := strings.IndexByte(base, '.'); i != -1 {
+		base = base[:i]
+	}
+	base = strings.ToUpper(strings.TrimRight(base, " "))
+
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return base[3] >= '1' && base[3] <= '9'
+	}
+	return false
+}
+
+// originalPath 文件在源端的相对路径（BaseDir/RelPath），也是映射清单和打包条目中使用的名字
+func originalPath(baseDir, relPath string) string {
+	var parts []string
+	for _, part := range []string{baseDir, filepath.ToSlash(relPath)} {
+		if part = strings.Trim(part, "/"); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// shortenName 超过 limit 字节的名字截断，并附加原始路径的哈希保证唯一，保留扩展名
+func shortenName(name string, limit int, original string) string {
+	if limit <= 0 || len(name) <= limit {
+		return name
+	}
+
+	ext := path.Ext(name)
+	if ext == name || len(ext) > 16 {
+		ext = ""
+	}
+	suffix := "~" + pathHash(original)[:8] + ext
+
+	cut := limit - len(suffix)
+	if cut < 1 {
+		return pathHash(original)[:limit]
+	}
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut] + suffix
+}
+
+func pathHash(p string) string {
+	sum := sha1.Sum([]byte(p))
+	return hex.EncodeToString(sum[:])
+}
+
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// withHashSuffix 在扩展名前插入原始路径的哈希，用于区分大小写冲突的文件
+func withHashSuffix(p string, original string) string {
+	dir, name := "", p
+	if idx := strings.LastIndex(p, "/"); idx != -1 {
+		dir, name = p[:idx+1], p[idx+1:]
+	}
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	return dir + strings.TrimSuffix(name, ext) + "~" + pathHash(original)[:8] + ext
+}
+
+// nameEntry 映射清单中的一条记录
+type nameEntry struct {
+	Remote   string `json:"remote"`   // 相对 dest_path 的远端路径
+	Original string `json:"original"` // 源端相对路径
+}
+
+type nameManifest struct {
+	Version int         `json:"version"`
+	Entries []nameEntry `json:"entries"`
+}
+
+// NameMapper 把源端路径映射为共享上可用的路径：
+// 逐个分量做 Windows 安全编码，超长的名字和路径缩短，
+// 目标不区分大小写时避免只有大小写不同的文件互相覆盖。
+// 无法通过解码还原的映射写入清单，restore 时优先查清单。
+type NameMapper struct {
+	destPath        string
+	maxName         int
+	maxPath         int
+	caseInsensitive bool
+
+	mu      sync.Mutex
+	seen    map[uint64]uint64    // 归一后远端路径的哈希 -> 原始路径的哈希，文件数很多时节省内存
+	dirs    map[string]string    // 小写远端目录 -> 第一次出现时的写法
+	entries map[string]nameEntry // 归一后的远端路径 -> 映射记录
+	dirty   bool
+}
+
+func NewNameMapper(config *Config) *NameMapper {
+	return &NameMapper{
+		destPath:        config.DestPath,
+		maxName:         config.MaxNameLength,
+		maxPath:         config.MaxPathLength,
+		caseInsensitive: config.CaseInsensitiveDest,
+		seen:            make(map[uint64]uint64),
+		dirs:            make(map[string]string),
+		entries:         make(map[string]nameEntry),
+	}
+}
+
+func (m *NameMapper) key(remote string) string {
+	if m.caseInsensitive {
+		return strings.ToLower(remote)
+	}
+	return remote
+}
+
+// RemotePath 返回任务在共享上的完整路径（包含 dest_path）
+func (m *NameMapper) RemotePath(task FileTask) string {
+	if task.Object != "" {
+		return task.Object
+	}
+	remote := joinSMBPath(m.destPath, m.Map(originalPath(task.BaseDir, task.RelPath)))
+	if task.Compressed {
+		remote += compressSuffix
+	}
+	return remote
+}
+
+// Map 返回原始相对路径对应的远端相对路径，同一路径多次调用结果相同
+func (m *NameMapper) Map(original string) string {
+	parts := strings.Split(original, "/")
+	for i, part := range parts {
+		parts[i] = shortenName(encodeSMBName(part), m.maxName, original)
+	}
+	remote := strings.Join(parts, "/")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.caseInsensitive {
+		remote = m.canonicalDirs(remote)
+		// 谁占用原名取决于扫描到的先后。冲突一旦发生就按清单中的记录分配，
+		// 否则下次运行顺序颠倒时两个文件会互换远端路径，互相覆盖
+		if e, ok := m.entries[m.key(withHashSuffix(remote, original))]; ok && e.Original == original {
+			remote = withHashSuffix(remote, original)
+		} else if prev, ok := m.seen[hash64(m.key(remote))]; ok && prev != hash64(original) {
+			renamed := withHashSuffix(remote, original)
+			slog.Warn("Case-only name collision, storing under a renamed path", "path", original, "remote", renamed)
+			remote = renamed
+		}
+	}
+
+	if m.maxPath > 0 && len(joinSMBPath(m.destPath, remote)) > m.maxPath {
+		ext := path.Ext(parts[len(parts)-1])
+		if len(ext) > 16 {
+			ext = ""
+		}
+		remote = longPathDirName + "/" + pathHash(original)[:20] + ext
+	}
+
+	key := m.key(remote)
+	m.seen[hash64(key)] = hash64(original)
+	if decodeSMBPath(remote) != original {
+		if e, ok := m.entries[key]; !ok || e.Remote != remote || e.Original != original {
+			m.entries[key] = nameEntry{Remote: remote, Original: original}
+			m.dirty = true
+		}
+	} else if _, ok := m.entries[key]; ok {
+		// 以前的映射已经过时
+		delete(m.entries, key)
+		m.dirty = true
+	}
+
+	return remote
+}
+
+// canonicalDirs 目录名只有大小写不同时在 NTFS 上是同一个目录，统一使用第一次出现的写法
+func (m *NameMapper) canonicalDirs(remote string) string {
+	parts := strings.Split(remote, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		dir := strings.Join(parts[:i+1], "/")
+		lower := strings.ToLower(dir)
+		if first, ok := m.dirs[lower]; ok {
+			parts[i] = first[strings.LastIndex(first, "/")+1:]
+		} else {
+			m.dirs[lower] = dir
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// Lookup 远端相对路径对应的原始路径，清单中没有时按编码规则解码
+func (m *NameMapper) Lookup(remote string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[m.key(remote)]; ok {
+		return e.Original
+	}
+	return decodeSMBPath(remote)
+}
+
+func (m *NameMapper) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// Load 读取共享上已有的映射清单，不存在时视为空清单。必须在映射任何路径之前调用
+func (m *NameMapper) Load(share *smb2.Share) error {
+	f, err := share.Open(joinSMBPath(m.destPath, nameManifestPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	var manifest nameManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("parse name manifest: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range manifest.Entries {
+		m.entries[m.key(e.Remote)] = e
+	}
+	return nil
+}
+
+// Save 清单有变化时写回共享，先写临时文件再改名
+func (m *NameMapper) Save(share *smb2.Share, dirCreator *DirCreator) error {
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	manifest := nameManifest{Version: 1}
+	for _, e := range m.entries {
+		manifest.Entries = append(manifest.Entries, e)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(manifest.Entries, func(i, j int) bool {
+		return manifest.Entries[i].Remote < manifest.Entries[j].Remote
+	})
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	manifestPath := joinSMBPath(m.destPath, nameManifestPath)
+	if err := dirCreator.EnsureDir(share, manifestPath[:strings.LastIndex(manifestPath, "/")]); err != nil {
+		return err
+	}
+
+	tmpPath := manifestPath + ".tmp"
+	if err := share.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	share.Remove(manifestPath)
+	if err := share.Rename(tmpPath, manifestPath); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.dirty = false
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeSMBName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"report.txt", "report.txt"},
+		{".hidden", ".hidden"},
+		{".", "."},
+		{"..", ".."},
+		{"CON", "ON"},
+		{"con", "on"},
+		{"nul.txt", "ul.txt"},
+		{"COM1", "OM1"},
+		{"lpt9.log", "pt9.log"},
+		{"COM0", "COM0"},
+		{"CONSOLE", "CONSOLE"},
+		{"AUX .txt", "UX .txt"},
+		{"name.", "name"},
+		{"name ", "name"},
+		{"name. .", "name"},
+		{"a b.c", "a b.c"},
+		{`a:b`, "ab"},
+		{`x*?"<>|\y`, "xy"},
+		{"tab\there", "tabhere"},
+		{"a.log.smb-zst", "a.logsmb-zst"},
+		{"A.LOG.SMB-ZST", "A.LOGSMB-ZST"},
+		{".smb-zst", "smb-zst"},
+		{"a.smb-zstd", "a.smb-zstd"},
+		{"日本語.txt", "日本語.txt"},
+	}
+	for _, tt := range tests {
+		got := encodeSMBName(tt.name)
+		if got != tt.want {
+			t.Errorf("encodeSMBName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if back := decodeSMBName(got); back != tt.name {
+			t.Errorf("decodeSMBName(%q) = %q, want %q", got, back, tt.name)
+		}
+		// 编码结果再编码不变
+		if again := encodeSMBName(got); again != got {
+			t.Errorf("encodeSMBName(%q) = %q, encoding is not idempotent", got, again)
+		}
+	}
+}
+
+func TestDecodeSMBPath(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"dir/file.txt", "dir/file.txt"},
+		{"ON/ab", "CON/a:b"},
+		{"dir/name", "dir./name "},
+		{"logs/a.logsmb-zst", "logs/a.log.smb-zst"},
+		// 私用区中超出转义范围的字符原样保留
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := decodeSMBPath(tt.remote); got != tt.want {
+			t.Errorf("decodeSMBPath(%q) = %q, want %q", tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestJoinSMBPathIdempotent(t *testing.T) {
+	tests := []struct {
+		parts []string
+		want  string
+	}{
+		{[]string{"backup", "dir/file.txt"}, "backup/dir/file.txt"},
+		{[]string{`\backup\`, `dir\sub`, "file"}, "backup/dir/sub/file"},
+		{[]string{"backup", "", "/", "file"}, "backup/file"},
+		{[]string{"backup", "CON/aux.txt"}, "backup/ON/ux.txt"},
+		{[]string{"backup", "dir./name "}, "backup/dir/name"},
+		{[]string{"backup", "a:b/c?.smb-zst"}, "backup/ab/csmb-zst"},
+	}
+	for _, tt := range tests {
+		got := joinSMBPath(tt.parts...)
+		if got != tt.want {
+			t.Errorf("joinSMBPath(%q) = %q, want %q", tt.parts, got, tt.want)
+		}
+		if again := joinSMBPath(got); again != got {
+			t.Errorf("joinSMBPath(%q) = %q, joining is not idempotent", got, again)
+		}
+	}
+
+	// Map 的结果已经编码，和 dest_path 拼接时不能再变
+	m := NewNameMapper(&Config{DestPath: "backup", MaxNameLength: 255, CaseInsensitiveDest: true})
+	for _, original := range []string{"CON/nul.txt", "a:b/c.", `x\y`, "a.log.smb-zst"} {
+		remote := m.Map(original)
+		if got := joinSMBPath("backup", remote); got != "backup/"+remote {
+			t.Errorf("joinSMBPath(backup, %q) = %q, want backup/%s", remote, got, remote)
+		}
+	}
+}
+
+// reloadNameMapper 模拟保存清单后下一次运行重新加载：只保留清单中的记录
+func reloadNameMapper(config *Config, prev *NameMapper) *NameMapper {
+	m := NewNameMapper(config)
+	for _, e := range prev.entries {
+		m.entries[m.key(e.Remote)] = e
+	}
+	return m
+}
+
+func TestNameMapperCaseCollisionStable(t *testing.T) {
+	config := &Config{DestPath: "backup", MaxNameLength: 255, CaseInsensitiveDest: true}
+	files := []string{"docs/Readme.md", "docs/README.md", "docs/readme.md", "Docs/other.txt"}
+
+	first := NewNameMapper(config)
+	want := make(map[string]string)
+	seen := make(map[string]string)
+	for _, f := range files {
+		remote := first.Map(f)
+		want[f] = remote
+		if prev, ok := seen[strings.ToLower(remote)]; ok {
+			t.Fatalf("%q and %q both map to %q", prev, f, remote)
+		}
+		seen[strings.ToLower(remote)] = f
+	}
+	// 目录只有大小写不同时沿用第一次出现的写法
+	if want["Docs/other.txt"] != "docs/other.txt" {
+		t.Errorf("Docs/other.txt maps to %q, want docs/other.txt", want["Docs/other.txt"])
+	}
+
+	// 第二次运行扫描顺序颠倒，每个文件仍落在同一个远端位置。
+	// 目录的写法取决于先扫描到哪一个，在不区分大小写的目标上是同一个目录
+	second := reloadNameMapper(config, first)
+	for i := len(files) - 1; i >= 0; i-- {
+		if got := second.Map(files[i]); !strings.EqualFold(got, want[files[i]]) {
+			t.Errorf("run 2: %q maps to %q, was %q", files[i], got, want[files[i]])
+		}
+	}
+}
+
+func TestNameMapperLookupRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300) + ".txt"
+	deep := strings.Repeat("directory/", 30) + "file.dat"
+
+	tests := []struct {
+		name   string
+		config Config
+		paths  []string
+	}{
+		{"plain", Config{DestPath: "backup", MaxNameLength: 255}, []string{"a/b.txt", "CON/nul.txt", "a:b/c.", "x.log.smb-zst"}},
+		{"long name", Config{DestPath: "backup", MaxNameLength: 255}, []string{long, "dir/" + long}},
+		{"long path", Config{DestPath: "backup", MaxNameLength: 255, MaxPathLength: 120}, []string{deep, "short.txt"}},
+		{"case insensitive", Config{DestPath: "backup", MaxNameLength: 255, CaseInsensitiveDest: true}, []string{"A.txt", "a.txt", "DIR/x", "dir/X"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewNameMapper(&tt.config)
+			for _, p := range tt.paths {
+				remote := m.Map(p)
+				if got := m.Lookup(remote); got != p {
+					t.Errorf("Lookup(Map(%q)) = %q (remote %q)", p, got, remote)
+				}
+				if tt.config.MaxNameLength > 0 {
+					for _, part := range strings.Split(remote, "/") {
+						if len(part) > tt.config.MaxNameLength {
+							t.Errorf("%q: component %d bytes long", p, len(part))
+						}
+					}
+				}
+				if full := joinSMBPath(tt.config.DestPath, remote); tt.config.MaxPathLength > 0 && len(full) > tt.config.MaxPathLength {
+					t.Errorf("%q: remote path %q is %d bytes long", p, full, len(full))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// 小文件打包分段在共享目录中的存放位置（相对 dest_path）
+const packDirName = ".smb-backup/packs"
+
+// packWorker 小文件通道的打包 worker：把多个小文件顺序写进同一个 tar 分段，
+// 省去每个文件各自的创建、写入、关闭往返
+func packWorker(id int, pool *SMBPool, queue *TaskQueue, gate *WorkGate, config *Config, stats *Stats, dirCreator *DirCreator, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	runID := packRunID(config, stats)
+	workerName := fmt.Sprintf("pack-%02d", id)
+	for seq := 1; ; seq++ {
+		batch, more := nextPackBatch(queue, config.PackSize)
+		if len(batch) > 0 && (control.Stopping() || control.Wait() != nil) {
+			atomic.AddInt64(&stats.SkippedFiles, int64(len(batch)))
+		} else if len(batch) > 0 {
+			name := fmt.Sprintf("%s-w%02d-%05d.tar", runID, id, seq)
+			var size int64
+			for _, task := range batch {
+				size += task.Size
+			}
+			gate.Acquire()
+			stats.setWorker(workerName, fmt.Sprintf("%s (%d files)", name, len(batch)), size)
+			uploadPack(pool, batch, name, config, stats, dirCreator)
+			stats.clearWorker(workerName)
+			gate.Release()
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+// packRunID 分段名的前缀，同一次运行写出的分段相同。
+// 多任务时以 "<任务名>+" 开头，清理旧分段时只动自己任务的；任务名中不会出现 "+"
+func packRunID(config *Config, stats *Stats) string {
+	id := stats.StartTime.Format("20060102-150405")
+	if config.Name != "" {
+		id = config.Name + "+" + id
+	}
+	return id
+}
+
+// packOwner 分段所属的任务名，匿名任务写出的分段返回空
+func packOwner(name string) string {
+	if i := strings.Index(name, "+"); i != -1 {
+		return name[:i]
+	}
+	return ""
+}
+
+// packSortKey 去掉任务名后的分段名，以运行时间开头
+func packSortKey(name string) string {
+	return strings.TrimPrefix(name, packOwner(name)+"+")
+}
+
+// prunePacks 删除本任务以前运行写出的分段。只在完整扫描且全部文件都上传成功后进行：
+// 这时所有小文件都已重新打包进本次的分段（或单独上传），旧分段中的内容都已过时，
+// 留着只会让共享不断增长，restore 时也要逐个解开
+func prunePacks(share *smb2.Share, config *Config, stats *Stats) {
+	if !stats.fullScan || control.Stopping() ||
+		atomic.LoadInt64(&stats.scanErrors) > 0 ||
+		atomic.LoadInt64(&stats.FailedFiles) > 0 ||
+		atomic.LoadInt64(&stats.InterruptedFiles) > 0 {
+		return
+	}
+
+	packDir := joinSMBPath(config.DestPath, packDirName)
+	entries, err := share.ReadDir(packDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Failed to list pack segments", "err", err)
+		}
+		return
+	}
+
+	prefix := packRunID(config, stats) + "-"
+	var removed int
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".tar") || strings.HasPrefix(name, prefix) || packOwner(name) != config.Name {
+			continue
+		}
+		if err := share.Remove(joinSMBPath(packDir, name)); err != nil {
+			slog.Warn("Failed to remove old pack segment", "pack", name, "err", err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		slog.Info("Removed pack segments from previous runs", "packs", removed)
+	}
+}
+
+// nextPackBatch 从队列中取出一批总大小达到 limit 的任务，队列关闭时返回 false
+func nextPackBatch(queue *TaskQueue, limit int64) ([]FileTask, bool) {
+	var batch []FileTask
+	var size int64
+	for size < limit {
+		task, ok := queue.Pop()
+		if !ok {
+			return batch, false
+		}
+		batch = append(batch, task)
+		size += task.Size
+	}
+	return batch, true
+}
+
+// uploadPack 写入一个 tar 分段，失败时整段重写
+func uploadPack(pool *SMBPool, batch []FileTask, name string, config *Config, stats *Stats, dirCreator *DirCreator) {
+	packPath := joinSMBPath(config.DestPath, packDirName, name)
+	retryCount := 0
+
+	interrupted := func() {
+		atomic.AddInt64(&stats.InterruptedFiles, int64(len(batch)))
+		slog.Warn("Pack interrupted", "pack", name, "files", len(batch))
+	}
+
+	conn, err := acquireConnection(pool)
+	if err != nil {
+		interrupted()
+		return
+	}
+
+	for {
+		packed, unreadable, err := writePack(conn.share, packPath, batch, config, dirCreator)
+		if err == nil {
+			pool.Put(conn)
+
+			var bytes int64
+			for _, task := range packed {
+				bytes += task.Size
+				slog.Debug("Packed", "path", task.SourcePath, "pack", name, "bytes", task.Size)
+			}
+			atomic.AddInt64(&stats.ProcessedFiles, int64(len(packed)))
+			atomic.AddInt64(&stats.ProcessedBytes, bytes)
+
+			for _, u := range unreadable {
+				switch {
+				case !isFileChanged(u.err):
+					stats.recordFailure(u.task, errorClassRead, u.err, 1)
+					slog.Error("Upload failed", "path", u.task.SourcePath, "class", errorClassRead, "err", u.err)
+				case config.ChangedFilePolicy == changedPolicySkip:
+					stats.recordFailure(u.task, errorClassChanged, u.err, config.ChangedFileRetries+1)
+					slog.Error("Changed during upload, not packed", "path", u.task.SourcePath, "err", u.err)
+				default:
+					stats.recordInconsistent(u.task, u.err, config.ChangedFileRetries+1)
+					slog.Warn("Changed during upload, packed anyway", "path", u.task.SourcePath, "err", u.err)
+				}
+			}
+			return
+		}
+
+		if control.Aborted() {
+			conn.share.Remove(packPath)
+			pool.Put(conn)
+			interrupted()
+			return
+		}
+
+		stats.noteError(packPath, err)
+		if isTCPConnectionError(err) {
+			slog.Warn("TCP connection error, recreating connection", "pack", name, "err", err)
+			if conn, err = reconnect(pool, conn); err != nil {
+				interrupted()
+				return
+			}
+			control.Sleep(time.Millisecond * 500)
+			continue
+		}
+
+		retryCount++
+		if retryCount > config.RetryTimes {
+			conn.share.Remove(packPath)
+			pool.Put(conn)
+			for _, task := range batch {
+				stats.recordFailure(task, errorClass(err), err, retryCount)
+				slog.Error("Pack upload failed", "path", task.SourcePath, "pack", name, "attempts", retryCount, "err", err)
+			}
+			return
+		}
+
+		slog.Warn("Pack upload failed, retrying", "pack", name, "attempt", retryCount, "retries", config.RetryTimes, "err", err)
+		if isSMBSessionError(err) {
+			if conn, err = reconnect(pool, conn); err != nil {
+				interrupted()
+				return
+			}
+		}
+		control.Sleep(time.Millisecond * time.Duration(200*retryCount))
+	}
+}
+
+// unreadableFile 打包时无法读取或读取期间一直在变化的本地文件。
+// 按 flag 策略处理的变化文件仍会写入分段，同时出现在 packed 中
+type unreadableFile struct {
+	task FileTask
+	err  error
+}
+
+// writePack 创建分段并依次写入每个文件；无法读取的本地文件会被跳过并单独返回，
+// 读取期间发生变化的文件重读 changed_file_retries 次后按 changed_file_policy 处理
+func writePack(share *smb2.Share, packPath string, batch []FileTask, config *Config, dirCreator *DirCreator) ([]FileTask, []unreadableFile, error) {
+	if idx := strings.LastIndex(packPath, "/"); idx != -1 {
+		if err := dirCreator.EnsureDir(share, packPath[:idx]); err != nil {
+			return nil, nil, fmt.Errorf("create dir '%s': %v", packPath[:idx], err)
+		}
+	}
+
+	dstFile, err := share.Create(packPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create pack '%s': %v", packPath, err)
+	}
+	defer dstFile.Close()
+
+	bw := bufio.NewWriterSize(bandwidth.Writer(newConnLimiter(config).Writer(dstFile)), config.BufferSize)
+	tw := tar.NewWriter(bw)
+
+	var packed []FileTask
+	var unreadable []unreadableFile
+	for _, task := range batch {
+		if err := control.Wait(); err != nil {
+			return nil, nil, err
+		}
+
+		// 小文件整体读入内存，保证写入的头部大小和内容一致
+		data, err := readStable(task.SourcePath, config.ChangedFileRetries)
+		if err != nil {
+			unreadable = append(unreadable, unreadableFile{task: task, err: err})
+			if !isFileChanged(err) || config.ChangedFilePolicy == changedPolicySkip {
+				continue
+			}
+		}
+
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     originalPath(task.BaseDir, task.RelPath),
+			Mode:     0644,
+			Size:     int64(len(data)),
+			ModTime:  task.ModTime,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, nil, fmt.Errorf("write pack header: %v", err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, nil, fmt.Errorf("write pack data: %v", err)
+		}
+		packed = append(packed, task)
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, nil, fmt.Errorf("finish pack: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, nil, fmt.Errorf("write pack data: %v", err)
+	}
+
+	return packed, unreadable, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// PoolMetrics 连接池状态快照
+type PoolMetrics struct {
+	Total     int   `json:"total"`
+	InUse     int   `json:"in_use"`
+	Idle      int   `json:"idle"`
+	Emergency int   `json:"emergency"`
+	Recreated int64 `json:"recreated"`
+	Failed    int64 `json:"failed"`
+}
+
+func (m PoolMetrics) String() string {
+	return fmt.Sprintf("total %d, in use %d, idle %d, emergency %d, recreated %d, failed %d",
+		m.Total, m.InUse, m.Idle, m.Emergency, m.Recreated, m.Failed)
+}
+
+func (p *SMBPool) Metrics() PoolMetrics {
+	total := int(atomic.LoadInt32(&p.total))
+	idle := len(p.connChan)
+	return PoolMetrics{
+		Total:     total,
+		InUse:     max(total-idle, 0),
+		Idle:      idle,
+		Emergency: int(atomic.LoadInt32(&p.emergency)),
+		Recreated: atomic.LoadInt64(&p.recreated),
+		Failed:    atomic.LoadInt64(&p.failed),
+	}
+}
+
+// healthCheck 定期检查池中的空闲连接：
+// 空闲超过 maxIdle 的会话直接重建，其余超过 interval 未使用的连接发送一次探测，失败则重建
+func (p *SMBPool) healthCheck(interval time.Duration, maxIdle time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkIdle(interval, maxIdle)
+			p.refill()
+			slog.Debug("Pool metrics", "metrics", p.Metrics())
+		case <-done:
+			return
+		}
+	}
+}
+
+func (p *SMBPool) checkIdle(interval time.Duration, maxIdle time.Duration) {
+	// 只检查本轮开始时已空闲的连接，避免反复取出刚放回的连接
+	for n := len(p.connChan); n > 0; n-- {
+		var conn *SMBConnection
+		select {
+		case conn = <-p.connChan:
+		default:
+			return
+		}
+
+		idle := time.Since(conn.lastUsed)
+		switch {
+		case maxIdle > 0 && idle >= maxIdle:
+			slog.Info("Connection idle, reconnecting", "conn", conn.id, "idle", idle.Round(time.Second))
+		case time.Since(conn.lastProbe) >= interval && idle >= interval:
+			err := p.probe(conn)
+			if err == nil {
+				p.Put(conn)
+				continue
+			}
+			slog.Warn("Health check failed, recreating connection", "conn", conn.id, "err", err)
+		default:
+			p.Put(conn)
+			continue
+		}
+
+		newConn, err := p.RecreateConnection(conn)
+		if err != nil {
+			slog.Warn("Failed to recreate connection", "conn", conn.id, "err", err)
+			continue
+		}
+		p.Put(newConn)
+	}
+}
+
+// refill 补回重建失败丢掉的常驻连接，服务器仍不可用时留到下一轮
+func (p *SMBPool) refill() {
+	for atomic.LoadInt32(&p.lost) > 0 {
+		// 自动调节期间池可能已经长回上限
+		if p.Size() >= cap(p.connChan) {
+			atomic.StoreInt32(&p.lost, 0)
+			return
+		}
+		if err := p.Grow(); err != nil {
+			slog.Warn("Failed to replace lost connection", "err", err)
+			return
+		}
+		atomic.AddInt32(&p.lost, -1)
+	}
+}
+
+// probe 对共享根目录做一次 stat，确认会话仍然可用
+func (p *SMBPool) probe(conn *SMBConnection) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn.lastProbe = time.Now()
+	_, err := conn.share.WithContext(ctx).Stat("")
+	return err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// free_space_check 的取值
+const (
+	freeSpaceOff   = "off"
+	freeSpaceWarn  = "warn"
+	freeSpaceAbort = "abort"
+)
+
+// preflightReachability 建立连接池之前确认目标可达。
+// 配置了 wake_on_lan 时先发送唤醒包，再等待端口在 wake_timeout 内可以连接
+func preflightReachability(config *Config) error {
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+
+	if config.WakeOnLAN == "" {
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		if err != nil {
+			return fmt.Errorf("destination %s unreachable: %v", addr, err)
+		}
+		conn.Close()
+		return nil
+	}
+
+	// 已经醒着就不必唤醒
+	if conn, err := net.DialTimeout("tcp", addr, 3*time.Second); err == nil {
+		conn.Close()
+		return nil
+	}
+
+	slog.Info("Sending Wake-on-LAN packet", "mac", config.WakeOnLAN, "broadcast", config.WakeBroadcast)
+	if err := sendWakeOnLAN(config.WakeOnLAN, config.WakeBroadcast); err != nil {
+		return fmt.Errorf("wake-on-lan: %v", err)
+	}
+
+	timeout := time.Duration(config.WakeTimeout) * time.Second
+	slog.Info("Waiting for server", "addr", addr, "timeout", timeout)
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for attempt := 1; ; attempt++ {
+		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
+		if err == nil {
+			conn.Close()
+			slog.Info("Server is up", "addr", addr, "elapsed", time.Since(start).Round(time.Second))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("destination %s did not come up within %v: %v", addr, timeout, err)
+		}
+		// 唤醒包是 UDP，可能丢失，每隔一段时间重发
+		if attempt%10 == 0 {
+			sendWakeOnLAN(config.WakeOnLAN, config.WakeBroadcast)
+		}
+		if err := control.Sleep(2 * time.Second); err != nil {
+			return err
+		}
+		if control.Stopping() {
+			return errAborted
+		}
+	}
+}
+
+// sendWakeOnLAN 发送魔术包：6 个 0xFF 加 16 次 MAC 地址
+func sendWakeOnLAN(mac, broadcast string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	packet := append(bytes.Repeat([]byte{0xFF}, 6), bytes.Repeat(hw, 16)...)
+
+	conn, err := net.Dial("udp", broadcast)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectTasks 在上传开始前完整扫描，返回全部任务（数量已计入 stats）
+func collectTasks(feed func(sched *Scheduler, stats *Stats), stats *Stats) []FileTask {
+	q := NewTaskQueue(0, false)
+	feed(&Scheduler{small: q, large: q}, stats)
+
+	var tasks []FileTask
+	for {
+		task, ok := q.Pop()
+		if !ok {
+			return tasks
+		}
+		tasks = append(tasks, task)
+	}
+}
+
+// replayTasks 把预先收集的任务按原顺序交给调度器
+func replayTasks(tasks []FileTask) func(sched *Scheduler, stats *Stats) {
+	return func(sched *Scheduler, stats *Stats) {
+		defer sched.Close()
+		for _, task := range tasks {
+			if control.Stopping() {
+				return
+			}
+			sched.Submit(task)
+		}
+	}
+}
+
+// checkFreeSpace 用 Statfs 取得共享的可用空间，与本次需要写入的字节数比较。
+// 覆盖已有文件只需要增量部分，所以先列出目标目录下已有文件的大小。
+// 远端路径用一个单独加载了名字清单的 NameMapper 计算，不影响备份用的映射顺序
+func checkFreeSpace(config *Config, tasks []FileTask) error {
+	pool, err := NewSMBPool(config, 1, 1)
+	if err != nil {
+		return fmt.Errorf("create SMB pool: %v", err)
+	}
+	defer pool.Close()
+
+	conn, err := pool.Get(10 * time.Second)
+	if err != nil {
+		return err
+	}
+	defer pool.Put(conn)
+
+	names := NewNameMapper(config)
+	if err := names.Load(conn.share); err != nil {
+		slog.Warn("Failed to load name manifest", "err", err)
+	}
+
+	info, err := conn.share.Statfs("")
+	if err != nil {
+		return fmt.Errorf("statfs: %v", err)
+	}
+	available := int64(info.AvailableBlockCount() * info.FragmentSize() * info.BlockSize())
+
+	existing := make(map[uint64]int64)
+	remoteSizes(conn.share, joinSMBPath(config.DestPath), names, existing)
+
+	var needed int64
+	for _, task := range tasks {
+		if config.SmallFilePack && task.Size < config.SmallFileThreshold {
+			needed += task.Size // 打包分段每次都是新文件
+			continue
+		}
+		needed += max(0, task.Size-existing[hash64(names.key(names.RemotePath(task)))])
+	}
+	needed += config.FreeSpaceMargin
+
+	slog.Info("Free space check", "share", fmt.Sprintf("//%s/%s", config.Host, config.Share),
+		"available_bytes", available, "needed_bytes", needed, "files", len(tasks))
+
+	if needed > available {
+		msg := fmt.Sprintf("not enough free space: need %.2f GB, %.2f GB available",
+			float64(needed)/1024/1024/1024, float64(available)/1024/1024/1024)
+		if config.FreeSpaceCheck == freeSpaceAbort {
+			return fmt.Errorf("%s", msg)
+		}
+		slog.Warn("Free space check failed", "err", msg)
+	}
+	return nil
+}
+
+// remoteSizes 递归列出目录下的文件大小，以归一化远端路径的哈希为键
+func remoteSizes(share *smb2.Share, dir string, names *NameMapper, sizes map[uint64]int64) {
+	entries, err := share.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		p := entry.Name()
+		if dir != "" {
+			p = dir + "/" + p
+		}
+		if entry.IsDir() {
+			remoteSizes(share, p, names, sizes)
+			continue
+		}
+		sizes[hash64(names.key(p))] = entry.Size()
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// TaskQueue 扫描器和上传 worker 之间的任务队列。
+// 普通模式下先进先出，largestFirst 模式下总是先取出队列中最大的文件。
+// 两种模式都限制长度，扫描不会把整棵目录树的任务堆在内存中；limit 为 0 时不限，只用于预扫描收集任务
+type TaskQueue struct {
+	mu           sync.Mutex
+	notEmpty     *sync.Cond
+	notFull      *sync.Cond
+	tasks        taskHeap
+	largestFirst bool
+	limit        int
+	closed       bool
+}
+
+func NewTaskQueue(limit int, largestFirst bool) *TaskQueue {
+	q := &TaskQueue{
+		largestFirst: largestFirst,
+		limit:        limit,
+	}
+	// 排序只在队列内进行，队列太短时起不到作用，放宽上限。
+	// 每个任务约占几百字节，largestFirstWindow 个任务约几十 MB
+	if largestFirst && limit > 0 {
+		q.limit = max(limit, largestFirstWindow)
+	}
+	q.notEmpty = sync.NewCond(&q.mu)
+	q.notFull = sync.NewCond(&q.mu)
+	return q
+}
+
+// largestFirstWindow largestFirst 模式下队列的最小长度，文件数不超过该值时严格按大小从大到小上传
+const largestFirstWindow = 100000
+
+// Push 放入任务，队列已满时阻塞
+func (q *TaskQueue) Push(task FileTask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.limit > 0 && len(q.tasks) >= q.limit && !q.closed {
+		q.notFull.Wait()
+	}
+	if q.closed {
+		return
+	}
+
+	if q.largestFirst {
+		heap.Push(&q.tasks, task)
+	} else {
+		q.tasks = append(q.tasks, task)
+	}
+	q.notEmpty.Signal()
+}
+
+// Pop 取出任务，队列为空时阻塞，关闭且取空后返回 false
+func (q *TaskQueue) Pop() (FileTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.tasks) == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if len(q.tasks) == 0 {
+		return FileTask{}, false
+	}
+
+	var task FileTask
+	if q.largestFirst {
+		task = heap.Pop(&q.tasks).(FileTask)
+	} else {
+		task = q.tasks[0]
+		q.tasks[0] = FileTask{}
+		q.tasks = q.tasks[1:]
+	}
+	q.notFull.Signal()
+	return task, true
+}
+
+// Close 标记不再有新任务，已入队的任务仍会被取完
+func (q *TaskQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+func (q *TaskQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+// taskHeap 按文件大小排列的最大堆
+type taskHeap []FileTask
+
+func (h taskHeap) Len() int           { return len(h) }
+func (h taskHeap) Less(i, j int) bool { return h[i].Size > h[j].Size }
+func (h taskHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *taskHeap) Push(x any) {
+	*h = append(*h, x.(FileTask))
+}
+
+func (h *taskHeap) Pop() any {
+	old := *h
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = FileTask{}
+	*h = old[:n-1]
+	return task
+}
+
+// Scheduler 按文件大小把任务分发到小文件通道和大文件通道
+type Scheduler struct {
+	small     *TaskQueue
+	large     *TaskQueue
+	threshold int64
+}
+
+// NewScheduler 未设置 small_file_threshold 时两个通道共用同一个队列
+func NewScheduler(config *Config) *Scheduler {
+	if config.SmallFileThreshold <= 0 {
+		q := NewTaskQueue(config.Routines*2, config.LargestFirst)
+		return &Scheduler{small: q, large: q}
+	}
+
+	return &Scheduler{
+		small:     NewTaskQueue(config.SmallRoutines*2, false),
+		large:     NewTaskQueue(config.LargeRoutines*2, config.LargestFirst),
+		threshold: config.SmallFileThreshold,
+	}
+}
+
+func (s *Scheduler) Submit(task FileTask) {
+	if task.Size < s.threshold {
+		s.small.Push(task)
+	} else {
+		s.large.Push(task)
+	}
+}
+
+func (s *Scheduler) Close() {
+	s.small.Close()
+	s.large.Close()
+}
+
+// Split 是否启用了独立的小文件通道
+func (s *Scheduler) Split() bool {
+	return s.small != s.large
+}
@@ -0,0 +1,862 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 仓库模式：文件按内容定义分块切开，每块压缩、可选加密后写入共享上的 pack 文件，
+// 每次备份生成一个快照记录全部文件由哪些块组成。块按明文的 SHA-256 去重，
+// 每天只有少量变化的大文件（应用数据库等）只需要上传变化的块。
+//
+// 仓库目录结构：
+//
+//	config              仓库参数和加密后的主密钥
+//	data/<xx>/<id>      pack 文件，由若干编码后的块依次拼接，id 为文件内容的 SHA-256
+//	index/<id>          块在 pack 中的位置
+//	snapshots/<id>      快照
+//	lock/               备份和清理时的互斥锁
+//
+// index 和快照与块使用相同的编码：1 字节压缩方式 + 数据，开启加密时整体用 AES-GCM 加密
+const (
+	repoVersion       = 1
+	repoPassphraseEnv = "SMB_BACKUP_REPO_PASSPHRASE"
+
+	repoChunkMin = 512 * 1024
+	repoChunkAvg = 1024 * 1024
+	repoChunkMax = 8 * 1024 * 1024
+
+	blobRaw  = 0
+	blobZstd = 1
+)
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// repoEncryption 主密钥用口令派生的密钥加密后保存在仓库配置中，修改口令不需要重写数据
+type repoEncryption struct {
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Key        []byte `json:"key"`
+}
+
+// repoConfig 仓库根目录下的 config，创建后不再改变
+type repoConfig struct {
+	Version    int             `json:"version"`
+	ID         string          `json:"id"`
+	Created    time.Time       `json:"created"`
+	ChunkMin   int             `json:"chunk_min"`
+	ChunkAvg   int             `json:"chunk_avg"`
+	ChunkMax   int             `json:"chunk_max"`
+	Encryption *repoEncryption `json:"encryption,omitempty"`
+}
+
+// repoFS 仓库用到的共享操作，*smb2.Share 满足该接口
+type repoFS interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	ReadDir(name string) ([]os.FileInfo, error)
+	Stat(name string) (os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+}
+
+var _ repoFS = (*smb2.Share)(nil)
+
+// blobLocation 块在 pack 中的位置
+type blobLocation struct {
+	Pack   string
+	Offset int64
+	Length int64
+	Raw    int64
+}
+
+// repoBlob index 中的一条记录
+type repoBlob struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`     // 编码后的长度
+	Raw    int64  `json:"raw_length"` // 明文长度
+}
+
+type repoPack struct {
+	ID    string     `json:"id"`
+	Blobs []repoBlob `json:"blobs"`
+}
+
+type repoIndex struct {
+	Packs []repoPack `json:"packs"`
+}
+
+// repoFile 快照中的一个文件
+type repoFile struct {
+	Path    string      `json:"path"` // 源端相对路径，与普通模式的 original 相同
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mod_time"`
+	Mode    os.FileMode `json:"mode"`
+	Chunks  []string    `json:"chunks"`
+}
+
+type repoSnapshot struct {
+	Time    time.Time   `json:"time"`
+	Host    string      `json:"host"`
+	Job     string      `json:"job,omitempty"`
+	Sources []string    `json:"sources"`
+	Parent  string      `json:"parent,omitempty"`
+	Files   []repoFile  `json:"files"`
+	Links   []linkEntry `json:"links,omitempty"` // 符号链接和没有重复存储的硬链接
+	Dirs    []repoFile  `json:"dirs,omitempty"`  // 目录及其修改时间，包括空目录
+
+	id string
+}
+
+func (s *repoSnapshot) size() int64 {
+	var total int64
+	for _, f := range s.Files {
+		total += f.Size
+	}
+	return total
+}
+
+// repository 打开的仓库。with 取得一个共享连接执行操作，连接错误时重连重试
+type repository struct {
+	config *Config
+	root   string
+	with   func(fn func(fs repoFS) error) error
+
+	params repoConfig
+	aead   cipher.AEAD // nil 表示不加密
+	gear   *gearTable
+
+	mu       sync.Mutex
+	blobs    map[string]blobLocation
+	packs    map[string]int64 // pack -> 大小
+	indexes  []string         // 已有的 index 文件
+	pending  map[string]bool  // 已加入尚未写出的 pack 的块
+	newPacks []repoPack       // 本次写出、还没有写入 index 的 pack
+
+	dirsMu sync.Mutex
+	dirs   map[string]bool
+}
+
+func newRepository(config *Config, with func(fn func(fs repoFS) error) error) *repository {
+	return &repository{
+		config:  config,
+		root:    joinSMBPath(config.RepoPath),
+		with:    with,
+		blobs:   make(map[string]blobLocation),
+		packs:   make(map[string]int64),
+		pending: make(map[string]bool),
+		dirs:    make(map[string]bool),
+	}
+}
+
+// poolRunner 用连接池执行仓库操作，TCP 和会话错误时重建连接，最多重试 retry_times 次
+func poolRunner(pool *SMBPool, config *Config) func(fn func(fs repoFS) error) error {
+	return func(fn func(fs repoFS) error) error {
+		for attempt := 1; ; attempt++ {
+			conn, err := pool.GetOrCreate(10 * time.Second)
+			if err != nil {
+				return err
+			}
+			err = fn(conn.share)
+			if err == nil || attempt > config.RetryTimes || !(isTCPConnectionError(err) || isSMBSessionError(err)) {
+				pool.Put(conn)
+				return err
+			}
+
+			slog.Warn("Repository connection error, recreating connection", "attempt", attempt, "retries", config.RetryTimes, "err", err)
+			if conn, err := pool.RecreateConnection(conn); err == nil {
+				pool.Put(conn)
+			}
+			if err := control.Sleep(time.Second * time.Duration(attempt)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *repository) path(parts ...string) string {
+	return joinSMBPath(append([]string{r.root}, parts...)...)
+}
+
+func (r *repository) packPath(id string) string {
+	return r.path("data", id[:2], id)
+}
+
+// mkdirAll 创建目录及其上级目录，已创建过的目录只记一次
+func (r *repository) mkdirAll(fs repoFS, dir string) error {
+	r.dirsMu.Lock()
+	defer r.dirsMu.Unlock()
+
+	parts := strings.Split(dir, "/")
+	for i := range parts {
+		p := strings.Join(parts[:i+1], "/")
+		if r.dirs[p] {
+			continue
+		}
+		if err := fs.Mkdir(p, 0755); err != nil && !os.IsExist(err) {
+			if _, serr := fs.Stat(p); serr != nil {
+				return err
+			}
+		}
+		r.dirs[p] = true
+	}
+	return nil
+}
+
+// writeFile 先写临时文件再改名，中途断开不会留下内容不完整的文件
+func (r *repository) writeFile(path string, data []byte) error {
+	throttle(len(data), nil)
+	return r.with(func(fs repoFS) error {
+		if err := r.mkdirAll(fs, path[:strings.LastIndex(path, "/")]); err != nil {
+			return err
+		}
+		tmpPath := path + ".tmp"
+		if err := fs.WriteFile(tmpPath, data, 0644); err != nil {
+			return err
+		}
+		fs.Remove(path)
+		return fs.Rename(tmpPath, path)
+	})
+}
+
+func (r *repository) readFile(path string) ([]byte, error) {
+	var data []byte
+	err := r.with(func(fs repoFS) error {
+		var err error
+		data, err = fs.ReadFile(path)
+		return err
+	})
+	return data, err
+}
+
+// list 列出目录下的文件名，目录不存在时返回空
+func (r *repository) list(dir string) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+	err := r.with(func(fs repoFS) error {
+		var err error
+		entries, err = fs.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+	var files []os.FileInfo
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasSuffix(e.Name(), ".tmp") {
+			files = append(files, e)
+		}
+	}
+	return files, err
+}
+
+func (r *repository) remove(path string) error {
+	return r.with(func(fs repoFS) error {
+		err := fs.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// encode 压缩后加密，压缩没有效果时保存原始数据
+func (r *repository) encode(plain []byte) ([]byte, error) {
+	data := append([]byte{blobRaw}, plain...)
+	if compressed := zstdEncoder.EncodeAll(plain, []byte{blobZstd}); len(compressed) < len(data) {
+		data = compressed
+	}
+	if r.aead == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, r.aead.NonceSize(), r.aead.NonceSize()+len(data)+r.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return r.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (r *repository) decode(data []byte) ([]byte, error) {
+	if r.aead != nil {
+		n := r.aead.NonceSize()
+		if len(data) < n {
+			return nil, errors.New("encrypted data too short")
+		}
+		plain, err := r.aead.Open(nil, data[:n], data[n:], nil)
+		if err != nil {
+			return nil, errors.New("decryption failed, data is corrupted or the passphrase is wrong")
+		}
+		data = plain
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty data")
+	}
+
+	switch data[0] {
+	case blobRaw:
+		return data[1:], nil
+	case blobZstd:
+		return zstdDecoder.DecodeAll(data[1:], nil)
+	}
+	return nil, fmt.Errorf("unknown compression %d", data[0])
+}
+
+func (r *repository) encodeJSON(v any) ([]byte, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return r.encode(plain)
+}
+
+func (r *repository) decodeJSON(data []byte, v any) error {
+	plain, err := r.decode(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+func hashID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// repoPassphrase 仓库口令依次取自 repo_passphrase_file、环境变量 SMB_BACKUP_REPO_PASSPHRASE，都没有时在终端输入
+func repoPassphrase(config *Config, confirm bool) (string, error) {
+	var passphrase string
+	switch {
+	case config.RepoPassphraseFile != "":
+		secret, err := readSecretFile(config.RepoPassphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("read repo_passphrase_file: %v", err)
+		}
+		passphrase = secret
+	case os.Getenv(repoPassphraseEnv) != "":
+		passphrase = os.Getenv(repoPassphraseEnv)
+	default:
+		p, err := prompt("Repository passphrase: ")
+		if err != nil {
+			return "", fmt.Errorf("read passphrase: %v", err)
+		}
+		if confirm {
+			again, err := prompt("Repeat passphrase: ")
+			if err != nil || again != p {
+				return "", errors.New("passphrases do not match")
+			}
+		}
+		passphrase = p
+	}
+	if passphrase == "" {
+		return "", errors.New("empty passphrase")
+	}
+	return passphrase, nil
+}
+
+// open 读取仓库配置并解开主密钥。仓库不存在且 create 为 true 时按配置创建
+func (r *repository) open(create bool) error {
+	data, err := r.readFile(r.path("config"))
+	if os.IsNotExist(err) {
+		if !create {
+			return fmt.Errorf("no repository at %s, run smb-backup repo backup first", r.root)
+		}
+		return r.create()
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, &r.params); err != nil {
+		return fmt.Errorf("parse repository config: %v", err)
+	}
+	if r.params.Version != repoVersion {
+		return fmt.Errorf("unsupported repository version %d", r.params.Version)
+	}
+
+	seed := []byte(r.params.ID)
+	if enc := r.params.Encryption; enc != nil {
+		passphrase, err := repoPassphrase(r.config, false)
+		if err != nil {
+			return err
+		}
+		keyAEAD, err := deriveCredentialKey(passphrase, enc.Salt, enc.Iterations)
+		if err != nil {
+			return err
+		}
+		key, err := keyAEAD.Open(nil, enc.Nonce, enc.Key, nil)
+		if err != nil {
+			return errors.New("wrong repository passphrase")
+		}
+		if err := r.setKey(key); err != nil {
+			return err
+		}
+		seed = key
+	}
+	r.gear = newGearTable(seed)
+	return nil
+}
+
+func (r *repository) setKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	r.aead, err = cipher.NewGCM(block)
+	return err
+}
+
+// create 新建仓库，repo_encryption 开启时生成随机主密钥
+func (r *repository) create() error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	r.params = repoConfig{
+		Version:  repoVersion,
+		ID:       hex.EncodeToString(id),
+		Created:  time.Now(),
+		ChunkMin: repoChunkMin,
+		ChunkAvg: repoChunkAvg,
+		ChunkMax: repoChunkMax,
+	}
+
+	seed := []byte(r.params.ID)
+	if r.config.RepoEncryption {
+		passphrase, err := repoPassphrase(r.config, true)
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 32)
+		enc := &repoEncryption{KDF: credentialKDF, Iterations: credentialIterations, Salt: make([]byte, 16)}
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if _, err := rand.Read(enc.Salt); err != nil {
+			return err
+		}
+		keyAEAD, err := deriveCredentialKey(passphrase, enc.Salt, enc.Iterations)
+		if err != nil {
+			return err
+		}
+		enc.Nonce = make([]byte, keyAEAD.NonceSize())
+		if _, err := rand.Read(enc.Nonce); err != nil {
+			return err
+		}
+		enc.Key = keyAEAD.Seal(nil, enc.Nonce, key, nil)
+		r.params.Encryption = enc
+		if err := r.setKey(key); err != nil {
+			return err
+		}
+		seed = key
+	}
+	r.gear = newGearTable(seed)
+
+	data, err := json.MarshalIndent(r.params, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := r.writeFile(r.path("config"), data); err != nil {
+		return err
+	}
+	slog.Info("Created repository", "id", r.params.ID[:8],
+		"location", fmt.Sprintf("//%s/%s/%s", r.config.Host, r.config.Share, r.root), "encryption", r.aead != nil)
+	return nil
+}
+
+// lock 创建锁目录，已存在时说明另一个备份或清理正在进行
+func (r *repository) lock() error {
+	lockDir := r.path("lock")
+	host, _ := os.Hostname()
+	info := fmt.Sprintf("%s pid %d since %s\n", host, os.Getpid(), time.Now().Format(time.RFC3339))
+
+	return r.with(func(fs repoFS) error {
+		if err := r.mkdirAll(fs, r.root); err != nil {
+			return err
+		}
+		if err := fs.Mkdir(lockDir, 0755); err != nil {
+			owner, _ := fs.ReadFile(lockDir + "/owner")
+			return fmt.Errorf("repository is locked by %s, remove %s if no other process is using it",
+				strings.TrimSpace(string(owner)), lockDir)
+		}
+		return fs.WriteFile(lockDir+"/owner", []byte(info), 0644)
+	})
+}
+
+func (r *repository) unlock() {
+	lockDir := r.path("lock")
+	err := r.with(func(fs repoFS) error {
+		fs.Remove(lockDir + "/owner")
+		return fs.Remove(lockDir)
+	})
+	if err != nil {
+		slog.Warn("Failed to remove repository lock", "path", lockDir, "err", err)
+	}
+}
+
+// loadIndex 读取全部 index 文件
+func (r *repository) loadIndex() error {
+	files, err := r.list(r.path("index"))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		data, err := r.readFile(r.path("index", f.Name()))
+		if err != nil {
+			return err
+		}
+		var idx repoIndex
+		if err := r.decodeJSON(data, &idx); err != nil {
+			return fmt.Errorf("index %s: %v", f.Name(), err)
+		}
+		r.addPacks(idx.Packs)
+		r.indexes = append(r.indexes, f.Name())
+	}
+	return nil
+}
+
+func (r *repository) addPacks(packs []repoPack) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range packs {
+		var size int64
+		for _, b := range p.Blobs {
+			r.blobs[b.ID] = blobLocation{Pack: p.ID, Offset: b.Offset, Length: b.Length, Raw: b.Raw}
+			delete(r.pending, b.ID)
+			size = max(size, b.Offset+b.Length)
+		}
+		r.packs[p.ID] = size
+	}
+}
+
+// hasBlob 块已在仓库中，或已加入正在写的 pack
+func (r *repository) hasBlob(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.blobs[id]
+	return ok || r.pending[id]
+}
+
+// saveIndex 把本次写出的 pack 记录为一个新的 index 文件
+func (r *repository) saveIndex() error {
+	r.mu.Lock()
+	packs := r.newPacks
+	r.newPacks = nil
+	r.mu.Unlock()
+	if len(packs) == 0 {
+		return nil
+	}
+
+	data, err := r.encodeJSON(repoIndex{Packs: packs})
+	if err != nil {
+		return err
+	}
+	id := hashID(data)
+	if err := r.writeFile(r.path("index", id), data); err != nil {
+		return err
+	}
+	r.indexes = append(r.indexes, id)
+	return nil
+}
+
+// packBlobs 按 pack 分组的全部块，块按偏移排序
+func (r *repository) packBlobs() map[string][]repoBlob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	packs := make(map[string][]repoBlob)
+	for id, loc := range r.blobs {
+		packs[loc.Pack] = append(packs[loc.Pack], repoBlob{ID: id, Offset: loc.Offset, Length: loc.Length, Raw: loc.Raw})
+	}
+	for _, blobs := range packs {
+		sort.Slice(blobs, func(i, j int) bool { return blobs[i].Offset < blobs[j].Offset })
+	}
+	return packs
+}
+
+// rewriteIndex 把当前全部块的位置写成一个 index 文件，再删除旧的 index 文件
+func (r *repository) rewriteIndex() error {
+	var idx repoIndex
+	for id, blobs := range r.packBlobs() {
+		idx.Packs = append(idx.Packs, repoPack{ID: id, Blobs: blobs})
+	}
+	sort.Slice(idx.Packs, func(i, j int) bool { return idx.Packs[i].ID < idx.Packs[j].ID })
+
+	data, err := r.encodeJSON(idx)
+	if err != nil {
+		return err
+	}
+	id := hashID(data)
+	if err := r.writeFile(r.path("index", id), data); err != nil {
+		return err
+	}
+
+	old := r.indexes
+	r.indexes = []string{id}
+	r.mu.Lock()
+	r.newPacks = nil
+	r.mu.Unlock()
+	for _, name := range old {
+		if name == id {
+			continue
+		}
+		if err := r.remove(r.path("index", name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetPack 从内存中的索引去掉一个 pack 及其中的块
+func (r *repository) forgetPack(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for blob, loc := range r.blobs {
+		if loc.Pack == id {
+			delete(r.blobs, blob)
+		}
+	}
+	delete(r.packs, id)
+}
+
+// listPacks 共享上实际存在的 pack 及其大小
+func (r *repository) listPacks() (map[string]int64, error) {
+	packs := make(map[string]int64)
+	var dirs []os.FileInfo
+	err := r.with(func(fs repoFS) error {
+		var err error
+		dirs, err = fs.ReadDir(r.path("data"))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := r.list(r.path("data", dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			packs[f.Name()] = f.Size()
+		}
+	}
+	return packs, nil
+}
+
+// packer 把编码后的块攒成 pack，达到 repo_pack_size 后写出
+type packer struct {
+	repo *repository
+	size int64
+
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	blobs []repoBlob
+}
+
+func newPacker(repo *repository) *packer {
+	return &packer{repo: repo, size: repo.config.RepoPackSize}
+}
+
+// add 加入一个块，data 为编码后的数据。块已存在时跳过，返回是否实际加入
+func (p *packer) add(id string, data []byte, raw int64) (bool, error) {
+	p.mu.Lock()
+	p.repo.mu.Lock()
+	_, exists := p.repo.blobs[id]
+	if exists || p.repo.pending[id] {
+		p.repo.mu.Unlock()
+		p.mu.Unlock()
+		return false, nil
+	}
+	p.repo.pending[id] = true
+	p.repo.mu.Unlock()
+
+	p.blobs = append(p.blobs, repoBlob{ID: id, Offset: int64(p.buf.Len()), Length: int64(len(data)), Raw: raw})
+	p.buf.Write(data)
+	if int64(p.buf.Len()) < p.size {
+		p.mu.Unlock()
+		return true, nil
+	}
+
+	data, blobs := p.take()
+	p.mu.Unlock()
+	return true, p.write(data, blobs)
+}
+
+// take 取出当前 pack 的内容，调用时持有 p.mu
+func (p *packer) take() ([]byte, []repoBlob) {
+	data := append([]byte(nil), p.buf.Bytes()...)
+	blobs := p.blobs
+	p.buf.Reset()
+	p.blobs = nil
+	return data, blobs
+}
+
+// flush 写出未满的 pack
+func (p *packer) flush() error {
+	p.mu.Lock()
+	if len(p.blobs) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	data, blobs := p.take()
+	p.mu.Unlock()
+	return p.write(data, blobs)
+}
+
+func (p *packer) write(data []byte, blobs []repoBlob) error {
+	id := hashID(data)
+	if err := p.repo.writeFile(p.repo.packPath(id), data); err != nil {
+		return fmt.Errorf("write pack %s: %v", id[:8], err)
+	}
+	pack := repoPack{ID: id, Blobs: blobs}
+	p.repo.addPacks([]repoPack{pack})
+
+	p.repo.mu.Lock()
+	p.repo.newPacks = append(p.repo.newPacks, pack)
+	p.repo.mu.Unlock()
+	slog.Debug("Wrote pack", "id", id[:8], "blobs", len(blobs), "bytes", len(data))
+	return nil
+}
+
+// loadSnapshots 读取全部快照，按时间排序
+func (r *repository) loadSnapshots() ([]*repoSnapshot, error) {
+	files, err := r.list(r.path("snapshots"))
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []*repoSnapshot
+	for _, f := range files {
+		data, err := r.readFile(r.path("snapshots", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		snap := &repoSnapshot{id: f.Name()}
+		if err := r.decodeJSON(data, snap); err != nil {
+			return nil, fmt.Errorf("snapshot %s: %v", f.Name(), err)
+		}
+		snapshots = append(snapshots, snap)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+func (r *repository) saveSnapshot(snap *repoSnapshot) error {
+	data, err := r.encodeJSON(snap)
+	if err != nil {
+		return err
+	}
+	snap.id = hashID(data)
+	return r.writeFile(r.path("snapshots", snap.id), data)
+}
+
+// findSnapshot 按 ID 前缀查找快照，"latest" 为当前任务最新的快照
+func findSnapshot(snapshots []*repoSnapshot, ref, job string) (*repoSnapshot, error) {
+	if ref == "latest" {
+		for i := len(snapshots) - 1; i >= 0; i-- {
+			if snapshots[i].Job == job {
+				return snapshots[i], nil
+			}
+		}
+		return nil, errors.New("repository has no snapshots for this job")
+	}
+
+	var found *repoSnapshot
+	for _, s := range snapshots {
+		if strings.HasPrefix(s.id, ref) {
+			if found != nil {
+				return nil, fmt.Errorf("snapshot ID %q is ambiguous", ref)
+			}
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("snapshot %q not found", ref)
+	}
+	return found, nil
+}
+
+// packCache 保留最近读过的几个 pack，恢复时同一 pack 中的块通常连续读取
+type packCache struct {
+	repo  *repository
+	limit int
+	order []string
+	data  map[string][]byte
+}
+
+func newPackCache(repo *repository, limit int) *packCache {
+	return &packCache{repo: repo, limit: limit, data: make(map[string][]byte)}
+}
+
+func (c *packCache) get(id string) ([]byte, error) {
+	if data, ok := c.data[id]; ok {
+		return data, nil
+	}
+	data, err := c.repo.readFile(c.repo.packPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(c.order) >= c.limit {
+		delete(c.data, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.order = append(c.order, id)
+	c.data[id] = data
+	return data, nil
+}
+
+// readBlob 读取并解码一个块，校验内容与 ID 一致
+func (c *packCache) readBlob(id string) ([]byte, error) {
+	c.repo.mu.Lock()
+	loc, ok := c.repo.blobs[id]
+	c.repo.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("blob %s not in index", id[:8])
+	}
+
+	pack, err := c.get(loc.Pack)
+	if err != nil {
+		return nil, fmt.Errorf("read pack %s: %v", loc.Pack[:8], err)
+	}
+	if loc.Offset+loc.Length > int64(len(pack)) {
+		return nil, fmt.Errorf("pack %s is truncated", loc.Pack[:8])
+	}
+	plain, err := c.repo.decode(pack[loc.Offset : loc.Offset+loc.Length])
+	if err != nil {
+		return nil, fmt.Errorf("blob %s: %v", id[:8], err)
+	}
+	if hashID(plain) != id {
+		return nil, fmt.Errorf("blob %s: content does not match its ID", id[:8])
+	}
+	return plain, nil
+}
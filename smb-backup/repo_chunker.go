@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// 内容定义分块（FastCDC）：按滚动哈希的值决定切分点，
+// 文件中间插入或删除数据只影响附近的块，其余块的边界和内容不变，可以直接复用。
+// 平均块大小之前用较严的掩码、之后用较宽的掩码（归一化分块），块大小更集中在平均值附近
+
+// gearTable 滚动哈希每个字节值对应的随机数，由仓库的种子生成，
+// 加密的仓库种子来自主密钥，从块的边界推测不出文件内容
+type gearTable [256]uint64
+
+func newGearTable(seed []byte) *gearTable {
+	var g gearTable
+	var buf [4]byte
+	for i := range g {
+		binary.BigEndian.PutUint32(buf[:], uint32(i))
+		sum := sha256.Sum256(append(append([]byte(nil), seed...), buf[:]...))
+		g[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return &g
+}
+
+// chunker 从 r 中依次切出块，返回的切片在下一次调用 Next 前有效
+type chunker struct {
+	r    io.Reader
+	gear *gearTable
+
+	min, avg, max int
+	maskS, maskL  uint64
+
+	buf   []byte
+	start int // buf 中未切分数据的起点
+	end   int // buf 中有效数据的终点
+	eof   bool
+}
+
+func newChunker(r io.Reader, gear *gearTable, minSize, avgSize, maxSize int) *chunker {
+	b := bits.Len(uint(avgSize)) - 1 // log2(avgSize)
+	return &chunker{
+		r:     r,
+		gear:  gear,
+		min:   minSize,
+		avg:   avgSize,
+		max:   maxSize,
+		maskS: 1<<uint(b+2) - 1,
+		maskL: 1<<uint(b-2) - 1,
+		buf:   make([]byte, 2*maxSize),
+	}
+}
+
+// fill 把未切分的数据移到缓冲区开头并尽量读满
+func (c *chunker) fill() error {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for !c.eof && c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+		if n == 0 && err == nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Next 返回下一个块，没有更多数据时返回 io.EOF
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.max && !c.eof {
+		if err := c.fill(); err != nil {
+			return nil, err
+		}
+	}
+	data := c.buf[c.start:c.end]
+	if len(data) == 0 {
+		return nil, io.EOF
+	}
+
+	n := c.cut(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// cut 返回 data 中第一个切分点
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := min(c.avg, n)
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = fp<<1 + c.gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + c.gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+const (
+	testChunkMin = 2 * 1024
+	testChunkAvg = 8 * 1024
+	testChunkMax = 64 * 1024
+)
+
+func randomData(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// chunkAll 切分 r 中的全部数据，返回每个块的副本
+func chunkAll(t *testing.T, r io.Reader, gear *gearTable) [][]byte {
+	t.Helper()
+	c := newChunker(r, gear, testChunkMin, testChunkAvg, testChunkMax)
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func TestChunkerSizesAndContent(t *testing.T) {
+	data := randomData(1, 2*1024*1024)
+	chunks := chunkAll(t, bytes.NewReader(data), newGearTable([]byte("seed")))
+
+	if got := bytes.Join(chunks, nil); !bytes.Equal(got, data) {
+		t.Fatal("chunks do not reassemble to the input")
+	}
+	for i, c := range chunks {
+		if len(c) > testChunkMax {
+			t.Errorf("chunk %d is %d bytes, above max %d", i, len(c), testChunkMax)
+		}
+		if len(c) < testChunkMin && i != len(chunks)-1 {
+			t.Errorf("chunk %d is %d bytes, below min %d", i, len(c), testChunkMin)
+		}
+	}
+	// 平均块大小应在设定值附近
+	if avg := len(data) / len(chunks); avg < testChunkAvg/2 || avg > testChunkAvg*2 {
+		t.Errorf("average chunk size %d, want about %d", avg, testChunkAvg)
+	}
+}
+
+func TestChunkerDeterministic(t *testing.T) {
+	data := randomData(2, 1024*1024)
+	gear := newGearTable([]byte("seed"))
+
+	want := chunkAll(t, bytes.NewReader(data), gear)
+	// 读取方式不同（每次只返回一部分）不影响切分点
+	for name, r := range map[string]io.Reader{
+		"same":     bytes.NewReader(data),
+		"half":     iotest.HalfReader(bytes.NewReader(data)),
+		"one byte": iotest.OneByteReader(bytes.NewReader(data)),
+	} {
+		got := chunkAll(t, r, newGearTable([]byte("seed")))
+		if len(got) != len(want) {
+			t.Errorf("%s: %d chunks, want %d", name, len(got), len(want))
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i], want[i]) {
+				t.Errorf("%s: chunk %d differs", name, i)
+				break
+			}
+		}
+	}
+
+	// 不同的种子得到不同的切分点
+	other := chunkAll(t, bytes.NewReader(data), newGearTable([]byte("other")))
+	if len(other) == len(want) && bytes.Equal(other[0], want[0]) {
+		t.Error("different seeds produced the same boundaries")
+	}
+}
+
+func TestChunkerInsertionStaysLocal(t *testing.T) {
+	data := randomData(3, 2*1024*1024)
+	gear := newGearTable([]byte("seed"))
+	before := chunkAll(t, bytes.NewReader(data), gear)
+
+	mid := len(data) / 2
+	edited := append(append(append([]byte(nil), data[:mid]...), randomData(4, 100)...), data[mid:]...)
+	after := chunkAll(t, bytes.NewReader(edited), gear)
+
+	known := make(map[string]bool)
+	for _, c := range before {
+		known[hashID(c)] = true
+	}
+	var changed int
+	for _, c := range after {
+		if !known[hashID(c)] {
+			changed++
+		}
+	}
+	// 插入点所在的块改变，切分点很快重新对齐
+	if changed == 0 || changed > 3 {
+		t.Errorf("%d of %d chunks changed after a 100 byte insertion, want 1 to 3", changed, len(after))
+	}
+	for i := 0; i < len(before) && i < len(after); i++ {
+		if !bytes.Equal(before[i], after[i]) {
+			if offset := len(bytes.Join(before[:i], nil)); offset+len(before[i]) <= mid {
+				t.Errorf("chunk %d ends before the insertion but changed", i)
+			}
+			break
+		}
+	}
+}
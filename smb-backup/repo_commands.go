@@ -0,0 +1,812 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// repoCommand smb-backup repo [-config config.json] [-job name] <backup|snapshots|restore|check|prune> [args]
+func repoCommand(args []string) {
+	fs := flag.NewFlagSet("repo", flag.ExitOnError)
+	configPath := fs.String("config", "", "config file (default: config.json next to the program)")
+	job := fs.String("job", "", "job to use when the config defines several")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: smb-backup repo [-config config.json] [-job name] backup")
+		fmt.Fprintln(fs.Output(), "       smb-backup repo [-config config.json] [-job name] snapshots")
+		fmt.Fprintln(fs.Output(), "       smb-backup repo [-config config.json] [-job name] restore [-snapshot id] <local_dir> [path_prefix]")
+		fmt.Fprintln(fs.Output(), "       smb-backup repo [-config config.json] [-job name] check [-read-data]")
+		fmt.Fprintln(fs.Output(), "       smb-backup repo [-config config.json] [-job name] prune [-keep-last n] [-keep-daily n] [-keep-weekly n] [-keep-monthly n] [-max-unused pct] [-dry-run]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	commands := map[string]func(repo *repository, args []string) int{
+		"backup":    repoBackup,
+		"snapshots": repoSnapshots,
+		"restore":   repoRestore,
+		"check":     repoCheck,
+		"prune":     repoPrune,
+	}
+	run, ok := commands[args[0]]
+	if !ok {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *configPath == "" {
+		*configPath = defaultConfigPath()
+	}
+	config, err := loadJobConfig(*configPath, *job)
+	if err != nil {
+		fatalConfig("Failed to load config", "err", err)
+	}
+	if err := setupLogging(config); err != nil {
+		fatalConfig("Failed to set up logging", "err", err)
+	}
+
+	control.handleSignals(time.Duration(config.ShutdownTimeout) * time.Second)
+
+	if err := preflightReachability(config); err != nil {
+		slog.Error("Server unreachable", "err", err)
+		os.Exit(exitFailed)
+	}
+
+	connections := 1
+	if args[0] == "backup" {
+		connections = min(config.Routines, config.PoolSize)
+	}
+	pool, err := NewSMBPool(config, connections, config.PoolSize)
+	if err != nil {
+		slog.Error("Failed to create SMB pool", "err", err)
+		os.Exit(exitFailed)
+	}
+
+	applyBandwidth(config)
+	done := make(chan struct{})
+	go bandwidthScheduler(config, done)
+
+	code := run(newRepository(config, poolRunner(pool, config)), args[1:])
+
+	close(done)
+	pool.Close()
+	os.Exit(code)
+}
+
+// repoFailed 输出错误并返回退出码
+func repoFailed(msg string, args ...any) int {
+	slog.Error(msg, args...)
+	return exitFailed
+}
+
+// repoBackupCounters 本次备份新写入的数据
+type repoBackupCounters struct {
+	blobs  int64 // 新增的块数
+	raw    int64 // 新增块的明文大小
+	stored int64 // 新增块编码后的大小
+	reused int64 // 与上次快照相比未变化、直接沿用块列表的文件
+}
+
+// repoBackup 扫描任务的源路径生成一个新快照。
+// 与上一个快照相比大小和修改时间都没变的文件直接沿用块列表，不再读取
+func repoBackup(repo *repository, args []string) int {
+	fs := flag.NewFlagSet("repo backup", flag.ExitOnError)
+	fs.Parse(args)
+	config := repo.config
+
+	if err := repo.open(true); err != nil {
+		return repoFailed("Failed to open repository", "err", err)
+	}
+	if err := repo.lock(); err != nil {
+		return repoFailed("Failed to lock repository", "err", err)
+	}
+	defer repo.unlock()
+
+	if err := repo.loadIndex(); err != nil {
+		return repoFailed("Failed to load index", "err", err)
+	}
+	snapshots, err := repo.loadSnapshots()
+	if err != nil {
+		return repoFailed("Failed to load snapshots", "err", err)
+	}
+
+	host, _ := os.Hostname()
+	snap := &repoSnapshot{Time: time.Now(), Host: host, Job: config.Name}
+	for _, src := range config.SrcPath {
+		snap.Sources = append(snap.Sources, src.Path)
+	}
+	parentFiles := make(map[string]repoFile)
+	if parent, err := findSnapshot(snapshots, "latest", config.Name); err == nil {
+		snap.Parent = parent.id
+		for _, f := range parent.Files {
+			parentFiles[f.Path] = f
+		}
+		slog.Info("Parent snapshot", "snapshot", parent.id[:8], "time", parent.Time.Format("2006-01-02 15:04:05"))
+	}
+
+	slog.Info("Backing up to repository", "location", fmt.Sprintf("//%s/%s/%s", config.Host, config.Share, repo.root))
+	stats := &Stats{StartTime: time.Now(), links: NewLinkTable(config)}
+	if config.PreserveDirs {
+		stats.dirs = NewDirTasks()
+	}
+	tasks := collectTasks(func(sched *Scheduler, stats *Stats) {
+		scanFiles(config.SrcPath, sched, stats, config)
+	}, stats)
+
+	done := make(chan struct{})
+	go statsReporter(stats, done)
+
+	var counters repoBackupCounters
+	pk := newPacker(repo)
+	files := make([]*repoFile, len(tasks))
+	// 写仓库出错时记下第一个错误，其他 worker 看到后停止
+	var writeErr atomic.Pointer[error]
+
+	var wg sync.WaitGroup
+	next := int64(-1)
+	for i := 0; i < config.Routines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				n := int(atomic.AddInt64(&next, 1))
+				if n >= len(tasks) || control.Stopping() || writeErr.Load() != nil {
+					return
+				}
+				task := tasks[n]
+
+				if prev, ok := parentFiles[originalPath(task.BaseDir, task.RelPath)]; ok && repoFileUnchanged(repo, prev, task) {
+					files[n] = &prev
+					atomic.AddInt64(&counters.reused, 1)
+					atomic.AddInt64(&stats.ProcessedFiles, 1)
+					atomic.AddInt64(&stats.ProcessedBytes, task.Size)
+					continue
+				}
+
+				f, err := repoBackupFile(repo, pk, task, stats, &counters)
+				if err != nil {
+					if isRepoWriteError(err) {
+						writeErr.CompareAndSwap(nil, &err)
+						return
+					}
+					continue
+				}
+				files[n] = f
+			}
+		}()
+	}
+	wg.Wait()
+	recordOrphanLinks(stats)
+	close(done)
+
+	var failure error
+	if p := writeErr.Load(); p != nil {
+		failure = *p
+	} else {
+		failure = pk.flush()
+	}
+	// 已经写出的 pack 即使本次失败也记入 index，下次备份可以直接复用
+	if err := repo.saveIndex(); err != nil && failure == nil {
+		failure = err
+	}
+	if failure != nil {
+		return repoFailed("Backup failed", "err", failure)
+	}
+	if control.Stopping() {
+		slog.Warn("Backup interrupted, no snapshot written (uploaded data is kept for the next run)")
+		return exitPartial
+	}
+
+	for _, f := range files {
+		if f != nil {
+			snap.Files = append(snap.Files, *f)
+		}
+	}
+	snap.Links = stats.links.Entries()
+	if stats.dirs != nil {
+		for _, task := range stats.dirs.Tasks() {
+			snap.Dirs = append(snap.Dirs, repoFile{Path: originalPath(task.BaseDir, task.RelPath), ModTime: task.ModTime})
+		}
+	}
+	if err := repo.saveSnapshot(snap); err != nil {
+		return repoFailed("Failed to save snapshot", "err", err)
+	}
+
+	elapsed := time.Since(stats.StartTime)
+	slog.Info("Snapshot saved", "snapshot", snap.id[:8], "elapsed", elapsed.Round(time.Second),
+		"files", len(snap.Files), "unchanged_files", counters.reused, "bytes", snap.size(),
+		"links", len(snap.Links), "special_files", stats.SpecialFiles, "failed_files", stats.FailedFiles,
+		"new_chunks", counters.blobs, "new_bytes", counters.raw, "stored_bytes", counters.stored)
+
+	if stats.FailedFiles > 0 {
+		return exitPartial
+	}
+	return exitOK
+}
+
+// repoFileUnchanged 大小和修改时间与上次快照相同，且用到的块都还在仓库中
+func repoFileUnchanged(repo *repository, prev repoFile, task FileTask) bool {
+	if prev.Size != task.Size || !prev.ModTime.Equal(task.ModTime) {
+		return false
+	}
+	for _, id := range prev.Chunks {
+		if !repo.hasBlob(id) {
+			return false
+		}
+	}
+	return true
+}
+
+// repoWriteError 写仓库失败，与读取本地文件失败不同，需要终止整个备份
+type repoWriteError struct{ err error }
+
+func (e *repoWriteError) Error() string { return e.err.Error() }
+
+func isRepoWriteError(err error) bool {
+	var w *repoWriteError
+	return errors.As(err, &w)
+}
+
+// repoBackupFile 分块读取一个文件，新块加入 pack。
+// 读取期间文件发生变化时重读 changed_file_retries 次，仍不一致时按 changed_file_policy 处理
+func repoBackupFile(repo *repository, pk *packer, task FileTask, stats *Stats, counters *repoBackupCounters) (*repoFile, error) {
+	config := repo.config
+	for attempt := 0; ; attempt++ {
+		f, err := repoChunkFile(repo, pk, task, counters)
+		if err == nil {
+			atomic.AddInt64(&stats.ProcessedFiles, 1)
+			atomic.AddInt64(&stats.ProcessedBytes, f.Size)
+			slog.Debug("Backed up", "path", task.SourcePath, "bytes", f.Size)
+			return f, nil
+		}
+		if isRepoWriteError(err) {
+			return nil, err
+		}
+		if err == errAborted {
+			atomic.AddInt64(&stats.InterruptedFiles, 1)
+			return nil, err
+		}
+
+		if !isFileChanged(err) {
+			stats.recordFailure(task, errorClassRead, err, 1)
+			slog.Error("Backup failed", "path", task.SourcePath, "class", errorClassRead, "err", err)
+			return nil, err
+		}
+		if attempt < config.ChangedFileRetries {
+			slog.Warn("Changed during backup, retrying", "path", task.SourcePath, "attempt", attempt+1, "retries", config.ChangedFileRetries, "err", err)
+			if control.Sleep(changedRetryDelay(attempt+1)) != nil {
+				atomic.AddInt64(&stats.InterruptedFiles, 1)
+				return nil, errAborted
+			}
+			continue
+		}
+		if config.ChangedFilePolicy == changedPolicySkip {
+			stats.recordFailure(task, errorClassChanged, err, attempt+1)
+			slog.Error("Changed during backup, not included", "path", task.SourcePath, "attempts", attempt+1, "err", err)
+			return nil, err
+		}
+
+		stats.recordInconsistent(task, err, attempt+1)
+		slog.Warn("Changed during backup, included anyway", "path", task.SourcePath, "err", err)
+		atomic.AddInt64(&stats.ProcessedFiles, 1)
+		atomic.AddInt64(&stats.ProcessedBytes, f.Size)
+		return f, nil
+	}
+}
+
+// repoChunkFile 读取一次文件。文件发生变化时同时返回已读到的结果和 fileChangedError
+func repoChunkFile(repo *repository, pk *packer, task FileTask, counters *repoBackupCounters) (*repoFile, error) {
+	src, err := os.Open(task.SourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	before, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+	f := &repoFile{
+		Path:    originalPath(task.BaseDir, task.RelPath),
+		Size:    before.Size(),
+		ModTime: before.ModTime(),
+		Mode:    before.Mode(),
+	}
+
+	p := repo.params
+	ch := newChunker(control.Reader(src), repo.gear, p.ChunkMin, p.ChunkAvg, p.ChunkMax)
+	for {
+		chunk, err := ch.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		id := hashID(chunk)
+		f.Chunks = append(f.Chunks, id)
+		if repo.hasBlob(id) {
+			continue
+		}
+		data, err := repo.encode(chunk)
+		if err != nil {
+			return nil, &repoWriteError{err}
+		}
+		added, err := pk.add(id, data, int64(len(chunk)))
+		if err != nil {
+			return nil, &repoWriteError{err}
+		}
+		if added {
+			atomic.AddInt64(&counters.blobs, 1)
+			atomic.AddInt64(&counters.raw, int64(len(chunk)))
+			atomic.AddInt64(&counters.stored, int64(len(data)))
+		}
+	}
+
+	return f, checkUnchanged(task.SourcePath, before)
+}
+
+// repoSnapshots 列出仓库中的快照
+func repoSnapshots(repo *repository, args []string) int {
+	fs := flag.NewFlagSet("repo snapshots", flag.ExitOnError)
+	fs.Parse(args)
+
+	if err := repo.open(false); err != nil {
+		return repoFailed("Failed to open repository", "err", err)
+	}
+	snapshots, err := repo.loadSnapshots()
+	if err != nil {
+		return repoFailed("Failed to load snapshots", "err", err)
+	}
+
+	fmt.Printf("%-8s  %-19s  %-16s  %-16s  %10s  %12s\n", "ID", "Time", "Host", "Job", "Files", "Size")
+	for _, s := range snapshots {
+		fmt.Printf("%-8s  %-19s  %-16s  %-16s  %10d  %9.2f GB\n",
+			s.id[:8], s.Time.Format("2006-01-02 15:04:05"), s.Host, s.Job, len(s.Files), float64(s.size())/1024/1024/1024)
+	}
+	fmt.Printf("%d snapshots\n", len(snapshots))
+	return exitOK
+}
+
+// repoRestore 把快照中的文件恢复到本地目录，可以只恢复某个路径前缀下的文件
+func repoRestore(repo *repository, args []string) int {
+	fs := flag.NewFlagSet("repo restore", flag.ExitOnError)
+	ref := fs.String("snapshot", "latest", "snapshot ID (prefix) to restore, latest is the newest snapshot of the job")
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: smb-backup repo restore [-snapshot id] <local_dir> [path_prefix]")
+		return exitConfigError
+	}
+	localDir := args[0]
+	prefix := ""
+	if len(args) > 1 {
+		prefix = strings.Trim(filepath.ToSlash(args[1]), "/")
+	}
+
+	if err := repo.open(false); err != nil {
+		return repoFailed("Failed to open repository", "err", err)
+	}
+	if err := repo.loadIndex(); err != nil {
+		return repoFailed("Failed to load index", "err", err)
+	}
+	snapshots, err := repo.loadSnapshots()
+	if err != nil {
+		return repoFailed("Failed to load snapshots", "err", err)
+	}
+	snap, err := findSnapshot(snapshots, *ref, repo.config.Name)
+	if err != nil {
+		return repoFailed("Snapshot not found", "err", err)
+	}
+
+	slog.Info("Restoring snapshot", "snapshot", snap.id[:8], "time", snap.Time.Format("2006-01-02 15:04:05"),
+		"local_dir", localDir, "prefix", prefix)
+
+	wanted := func(original string) bool {
+		return prefix == "" || original == prefix || strings.HasPrefix(original, prefix+"/")
+	}
+
+	start := time.Now()
+	cache := newPackCache(repo, 4)
+	var files, bytes, failed int64
+	for _, f := range snap.Files {
+		if control.Stopping() {
+			break
+		}
+		if !wanted(f.Path) {
+			continue
+		}
+		if err := restoreRepoFile(cache, localDir, f); err != nil {
+			slog.Error("Restore failed", "path", f.Path, "err", err)
+			failed++
+			continue
+		}
+		files++
+		bytes += f.Size
+		slog.Debug("Restored", "path", f.Path, "bytes", f.Size)
+	}
+	restored, linkFailed := restoreLinks(localDir, snap.Links, wanted)
+	files += restored
+	failed += linkFailed
+
+	var dirs []localDirTime
+	for _, d := range snap.Dirs {
+		if !wanted(d.Path) {
+			continue
+		}
+		if localPath, err := restoreTarget(localDir, d.Path); err == nil {
+			dirs = append(dirs, localDirTime{path: localPath, modTime: d.ModTime})
+		}
+	}
+	if !control.Stopping() {
+		failed += restoreDirTimes(dirs)
+	}
+
+	slog.Info("Restore finished", "elapsed", time.Since(start).Round(time.Second),
+		"restored_files", files, "bytes", bytes, "failed_files", failed)
+
+	if failed > 0 || control.Stopping() {
+		return exitPartial
+	}
+	return exitOK
+}
+
+func restoreRepoFile(cache *packCache, localDir string, f repoFile) error {
+	localPath, err := restoreTarget(localDir, f.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	dst, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+
+	var written int64
+	for _, id := range f.Chunks {
+		var data []byte
+		if data, err = cache.readBlob(id); err != nil {
+			break
+		}
+		if _, err = dst.Write(data); err != nil {
+			break
+		}
+		written += int64(len(data))
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if written != f.Size {
+		return fmt.Errorf("size mismatch: expected %d, restored %d", f.Size, written)
+	}
+
+	if perm := f.Mode.Perm(); perm != 0 {
+		os.Chmod(localPath, perm)
+	}
+	os.Chtimes(localPath, f.ModTime, f.ModTime)
+	return nil
+}
+
+// repoCheck 检查 index 中的 pack 都存在且大小正确、快照引用的块都在 index 中。
+// -read-data 时下载全部 pack，校验每个块都能解密解压且内容与 ID 一致
+func repoCheck(repo *repository, args []string) int {
+	fs := flag.NewFlagSet("repo check", flag.ExitOnError)
+	readData := fs.Bool("read-data", false, "download and verify every pack")
+	fs.Parse(args)
+
+	if err := repo.open(false); err != nil {
+		return repoFailed("Failed to open repository", "err", err)
+	}
+	if err := repo.loadIndex(); err != nil {
+		return repoFailed("Failed to load index", "err", err)
+	}
+	snapshots, err := repo.loadSnapshots()
+	if err != nil {
+		return repoFailed("Failed to load snapshots", "err", err)
+	}
+	onShare, err := repo.listPacks()
+	if err != nil {
+		return repoFailed("Failed to list packs", "err", err)
+	}
+
+	errorsFound := 0
+	problem := func(msg string, args ...any) {
+		slog.Error(msg, args...)
+		errorsFound++
+	}
+
+	packBlobs := repo.packBlobs()
+	slog.Info("Checking repository", "indexed_packs", len(packBlobs), "packs", len(onShare), "snapshots", len(snapshots))
+	for id := range packBlobs {
+		size, ok := onShare[id]
+		switch {
+		case !ok:
+			problem("Pack is missing", "pack", id[:8])
+		case size != repo.packs[id]:
+			problem("Pack size does not match the index", "pack", id[:8], "size", size, "expected", repo.packs[id])
+		}
+	}
+	for id := range onShare {
+		if _, ok := packBlobs[id]; !ok {
+			slog.Warn("Pack is not in any index, prune will remove it", "pack", id[:8])
+		}
+	}
+
+	for _, s := range snapshots {
+		missing := 0
+		for _, f := range s.Files {
+			for _, id := range f.Chunks {
+				if !repo.hasBlob(id) {
+					missing++
+				}
+			}
+		}
+		if missing > 0 {
+			problem("Snapshot references chunks that are not in the index", "snapshot", s.id[:8], "chunks", missing)
+		}
+	}
+
+	if *readData {
+		cache := newPackCache(repo, 1)
+		checked := 0
+		for id, blobs := range packBlobs {
+			if control.Stopping() {
+				break
+			}
+			if _, ok := onShare[id]; !ok {
+				continue
+			}
+			data, err := cache.get(id)
+			if err != nil {
+				problem("Failed to read pack", "pack", id[:8], "err", err)
+				continue
+			}
+			if hashID(data) != id {
+				problem("Pack content does not match its ID", "pack", id[:8])
+				continue
+			}
+			for _, b := range blobs {
+				if _, err := cache.readBlob(b.ID); err != nil {
+					problem("Pack is corrupt", "pack", id[:8], "err", err)
+				}
+			}
+			checked++
+			if checked%100 == 0 {
+				slog.Info("Reading packs", "read", checked, "packs", len(packBlobs))
+			}
+		}
+		slog.Info("Read packs", "packs", checked)
+	}
+
+	if errorsFound > 0 {
+		slog.Error("Check found errors", "errors", errorsFound)
+		return exitFailed
+	}
+	slog.Info("Check found no errors")
+	return exitOK
+}
+
+// retentionPolicy prune 的保留规则，全部为 0 时保留所有快照
+type retentionPolicy struct {
+	last, daily, weekly, monthly int
+}
+
+func (p retentionPolicy) empty() bool {
+	return p.last == 0 && p.daily == 0 && p.weekly == 0 && p.monthly == 0
+}
+
+// keep 对同一主机同一任务的快照（按时间从旧到新）应用保留规则：
+// 保留最新的 last 个，以及最近 daily 天、weekly 周、monthly 个月中每个周期最新的一个
+func (p retentionPolicy) keep(snapshots []*repoSnapshot) map[*repoSnapshot]bool {
+	kept := make(map[*repoSnapshot]bool)
+	last := p.last
+	buckets := []struct {
+		count  int
+		period func(t time.Time) string
+		prev   string
+	}{
+		{count: p.daily, period: func(t time.Time) string { return t.Format("2006-01-02") }},
+		{count: p.weekly, period: func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", y, w)
+		}},
+		{count: p.monthly, period: func(t time.Time) string { return t.Format("2006-01") }},
+	}
+
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		if last > 0 {
+			kept[s] = true
+			last--
+		}
+		for j := range buckets {
+			b := &buckets[j]
+			if b.count == 0 {
+				continue
+			}
+			if period := b.period(s.Time.Local()); period != b.prev {
+				kept[s] = true
+				b.prev = period
+				b.count--
+			}
+		}
+	}
+	return kept
+}
+
+// repoPrune 按保留规则删除旧快照，再删除不再被引用的数据：
+// 全部块都不再使用的 pack 直接删除，未使用部分超过 max-unused 的 pack 把仍在使用的块重新打包
+func repoPrune(repo *repository, args []string) int {
+	fs := flag.NewFlagSet("repo prune", flag.ExitOnError)
+	var policy retentionPolicy
+	fs.IntVar(&policy.last, "keep-last", 0, "keep the n newest snapshots")
+	fs.IntVar(&policy.daily, "keep-daily", 0, "keep the newest snapshot of each of the last n days")
+	fs.IntVar(&policy.weekly, "keep-weekly", 0, "keep the newest snapshot of each of the last n weeks")
+	fs.IntVar(&policy.monthly, "keep-monthly", 0, "keep the newest snapshot of each of the last n months")
+	maxUnused := fs.Int("max-unused", 20, "repack packs with more than this percentage of unused data")
+	dryRun := fs.Bool("dry-run", false, "only show what would be removed")
+	fs.Parse(args)
+
+	if err := repo.open(false); err != nil {
+		return repoFailed("Failed to open repository", "err", err)
+	}
+	if err := repo.lock(); err != nil {
+		return repoFailed("Failed to lock repository", "err", err)
+	}
+	defer repo.unlock()
+
+	if err := repo.loadIndex(); err != nil {
+		return repoFailed("Failed to load index", "err", err)
+	}
+	snapshots, err := repo.loadSnapshots()
+	if err != nil {
+		return repoFailed("Failed to load snapshots", "err", err)
+	}
+	onShare, err := repo.listPacks()
+	if err != nil {
+		return repoFailed("Failed to list packs", "err", err)
+	}
+
+	// 选出要删除的快照，保留规则分别作用于每个主机和任务
+	var forget, keep []*repoSnapshot
+	if policy.empty() {
+		keep = snapshots
+	} else {
+		groups := make(map[string][]*repoSnapshot)
+		for _, s := range snapshots {
+			groups[s.Host+"/"+s.Job] = append(groups[s.Host+"/"+s.Job], s)
+		}
+		kept := make(map[*repoSnapshot]bool)
+		for _, group := range groups {
+			for s := range policy.keep(group) {
+				kept[s] = true
+			}
+		}
+		for _, s := range snapshots {
+			if kept[s] {
+				keep = append(keep, s)
+			} else {
+				forget = append(forget, s)
+			}
+		}
+	}
+	for _, s := range forget {
+		slog.Info("Forget snapshot", "snapshot", s.id[:8], "time", s.Time.Format("2006-01-02 15:04:05"), "job", s.Job)
+	}
+
+	used := make(map[string]bool)
+	for _, s := range keep {
+		for _, f := range s.Files {
+			for _, id := range f.Chunks {
+				used[id] = true
+			}
+		}
+	}
+
+	// 按使用情况把 pack 分为保留、删除和重新打包
+	var remove, repack []string
+	var removeBytes, repackBytes, unusedBytes int64
+	packBlobs := repo.packBlobs()
+	for id, blobs := range packBlobs {
+		var total, unused int64
+		for _, b := range blobs {
+			total += b.Length
+			if !used[b.ID] {
+				unused += b.Length
+			}
+		}
+		switch {
+		case unused == total:
+			remove = append(remove, id)
+			removeBytes += total
+		case unused*100 > total*int64(*maxUnused):
+			repack = append(repack, id)
+			repackBytes += total
+			unusedBytes += unused
+		}
+	}
+	// 中断的备份留下的、不在任何 index 中的 pack
+	for id, size := range onShare {
+		if _, ok := packBlobs[id]; !ok {
+			remove = append(remove, id)
+			removeBytes += size
+		}
+	}
+
+	slog.Info("Prune plan", "forget", len(forget), "snapshots", len(snapshots),
+		"remove_packs", len(remove), "remove_bytes", removeBytes,
+		"repack_packs", len(repack), "repack_bytes", repackBytes, "unused_bytes", unusedBytes)
+	if *dryRun {
+		return exitOK
+	}
+
+	// 先删除快照：中途退出时只会留下多余的数据，不会有快照引用已删除的 pack
+	for _, s := range forget {
+		if err := repo.remove(repo.path("snapshots", s.id)); err != nil {
+			return repoFailed("Failed to remove snapshot", "snapshot", s.id[:8], "err", err)
+		}
+	}
+
+	pk := newPacker(repo)
+	cache := newPackCache(repo, 1)
+	for _, id := range repack {
+		if control.Stopping() {
+			return exitPartial
+		}
+		data, err := cache.get(id)
+		if err != nil {
+			return repoFailed("Failed to read pack", "pack", id[:8], "err", err)
+		}
+		repo.forgetPack(id)
+		for _, b := range packBlobs[id] {
+			if !used[b.ID] {
+				continue
+			}
+			if b.Offset+b.Length > int64(len(data)) {
+				return repoFailed("Pack is truncated, run repo check", "pack", id[:8])
+			}
+			if _, err := pk.add(b.ID, data[b.Offset:b.Offset+b.Length], b.Raw); err != nil {
+				return repoFailed("Failed to repack", "err", err)
+			}
+		}
+	}
+	if err := pk.flush(); err != nil {
+		return repoFailed("Failed to repack", "err", err)
+	}
+
+	for _, id := range remove {
+		repo.forgetPack(id)
+	}
+	if err := repo.rewriteIndex(); err != nil {
+		return repoFailed("Failed to write index", "err", err)
+	}
+
+	// index 已不再引用这些 pack，删除失败只会留下多余的文件
+	for _, id := range append(remove, repack...) {
+		if err := repo.remove(repo.packPath(id)); err != nil {
+			slog.Warn("Failed to remove pack", "pack", id[:8], "err", err)
+		}
+	}
+
+	slog.Info("Prune done", "forgotten", len(forget), "removed_packs", len(remove), "repacked_packs", len(repack))
+	return exitOK
+}
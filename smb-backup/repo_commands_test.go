@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func snapshotsAt(times ...time.Time) []*repoSnapshot {
+	var snapshots []*repoSnapshot
+	for i, t := range times {
+		snapshots = append(snapshots, &repoSnapshot{Time: t, id: fmt.Sprintf("s%02d", i)})
+	}
+	return snapshots
+}
+
+func keptIDs(p retentionPolicy, snapshots []*repoSnapshot) []string {
+	var ids []string
+	for s := range p.keep(snapshots) {
+		ids = append(ids, s.id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRetentionPolicyKeep(t *testing.T) {
+	at := func(y int, m time.Month, d, h int) time.Time { return time.Date(y, m, d, h, 0, 0, 0, time.Local) }
+
+	// 2024-12-30 是 2025 年第 1 周的周一
+	snapshots := snapshotsAt(
+		at(2024, 11, 28, 10), // s00 11 月，第 48 周
+		at(2024, 12, 20, 10), // s01 12 月，第 51 周
+		at(2024, 12, 27, 9),  // s02 12 月，第 52 周
+		at(2024, 12, 27, 21), // s03 同一天更晚
+		at(2024, 12, 29, 10), // s04 周日，第 52 周
+		at(2024, 12, 30, 10), // s05 周一，仍是 12 月但属于 2025 年第 1 周
+		at(2025, 1, 2, 8),    // s06 1 月，第 1 周
+		at(2025, 1, 2, 20),   // s07 同一天更晚
+	)
+
+	tests := []struct {
+		name   string
+		policy retentionPolicy
+		want   []string
+	}{
+		{"last", retentionPolicy{last: 3}, []string{"s05", "s06", "s07"}},
+		{"last more than available", retentionPolicy{last: 20}, []string{"s00", "s01", "s02", "s03", "s04", "s05", "s06", "s07"}},
+		{"daily newest per day", retentionPolicy{daily: 3}, []string{"s04", "s05", "s07"}},
+		{"daily skips days without snapshots", retentionPolicy{daily: 5}, []string{"s01", "s03", "s04", "s05", "s07"}},
+		{"weekly across year boundary", retentionPolicy{weekly: 3}, []string{"s01", "s04", "s07"}},
+		{"monthly", retentionPolicy{monthly: 2}, []string{"s05", "s07"}},
+		{"monthly all", retentionPolicy{monthly: 5}, []string{"s00", "s05", "s07"}},
+		{"combined", retentionPolicy{last: 1, daily: 3, monthly: 3}, []string{"s00", "s04", "s05", "s07"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := keptIDs(tt.policy, snapshots)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("kept %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// pruneFixture 在内存仓库中写入三个快照：
+// old 引用 a、b，new 引用 b、c，other（另一个任务）引用 d；a、b 在同一个 pack 中
+func pruneFixture(t *testing.T) (*memFS, map[string][]byte) {
+	t.Helper()
+	fs := newMemFS()
+	repo := newTestRepository(fs)
+	if err := repo.open(true); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs := make(map[string][]byte)
+	pk := newPacker(repo)
+	store := func(seed int64) string {
+		plain := randomData(seed, 10000)
+		id := hashID(plain)
+		data, err := repo.encode(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := pk.add(id, data, int64(len(plain))); err != nil {
+			t.Fatal(err)
+		}
+		blobs[id] = plain
+		return id
+	}
+	flush := func() {
+		if err := pk.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, b := store(1), store(2)
+	flush()
+	c := store(3)
+	flush()
+	d := store(4)
+	flush()
+	if err := repo.saveIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 中断的备份留下、不在 index 中的 pack
+	orphan := randomData(5, 100)
+	if err := repo.writeFile(repo.packPath(hashID(orphan)), orphan); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, snap := range []*repoSnapshot{
+		{Time: now.Add(-48 * time.Hour), Host: "h", Job: "docs", Files: []repoFile{{Path: "old", Chunks: []string{a, b}}}},
+		{Time: now, Host: "h", Job: "docs", Files: []repoFile{{Path: "new", Chunks: []string{b, c}}}},
+		{Time: now.Add(-72 * time.Hour), Host: "h", Job: "other", Files: []repoFile{{Path: "other", Chunks: []string{d}}}},
+	} {
+		if err := repo.saveSnapshot(snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs, blobs
+}
+
+func TestRepoPruneKeepsReferencedBlobs(t *testing.T) {
+	for _, maxUnused := range []string{"0", "20", "100"} {
+		t.Run("max-unused="+maxUnused, func(t *testing.T) {
+			fs, blobs := pruneFixture(t)
+
+			if code := repoPrune(newTestRepository(fs), []string{"-keep-last", "1", "-max-unused", maxUnused}); code != exitOK {
+				t.Fatalf("prune exited with %d", code)
+			}
+
+			repo := newTestRepository(fs)
+			if err := repo.open(false); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.loadIndex(); err != nil {
+				t.Fatal(err)
+			}
+			snapshots, err := repo.loadSnapshots()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, s := range snapshots {
+				paths = append(paths, s.Files[0].Path)
+			}
+			if fmt.Sprint(paths) != "[other new]" {
+				t.Fatalf("snapshots after prune: %v, want [other new]", paths)
+			}
+
+			// 保留的快照引用的每个块都能读出并通过校验
+			cache := newPackCache(repo, 4)
+			for _, s := range snapshots {
+				for _, id := range s.Files[0].Chunks {
+					plain, err := cache.readBlob(id)
+					if err != nil {
+						t.Errorf("%s: %v", s.Files[0].Path, err)
+						continue
+					}
+					if string(plain) != string(blobs[id]) {
+						t.Errorf("%s: blob %s has wrong content", s.Files[0].Path, id[:8])
+					}
+				}
+			}
+
+			// 共享上的 pack 与 index 一致，没有残留也没有缺失
+			onShare, err := repo.listPacks()
+			if err != nil {
+				t.Fatal(err)
+			}
+			indexed := repo.packBlobs()
+			for id := range onShare {
+				if _, ok := indexed[id]; !ok {
+					t.Errorf("pack %s is on the share but not in the index", id[:8])
+				}
+			}
+			for id := range indexed {
+				if _, ok := onShare[id]; !ok {
+					t.Errorf("pack %s is in the index but missing on the share", id[:8])
+				}
+			}
+		})
+	}
+}
+
+func TestRepoPruneDryRunChangesNothing(t *testing.T) {
+	fs, _ := pruneFixture(t)
+	before := len(fs.files)
+
+	if code := repoPrune(newTestRepository(fs), []string{"-keep-last", "1", "-dry-run"}); code != exitOK {
+		t.Fatalf("prune exited with %d", code)
+	}
+	if len(fs.files) != before {
+		t.Errorf("dry run changed the repository: %d files, had %d", len(fs.files), before)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFS 内存中的 repoFS，用于不连接共享测试仓库
+type memFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string][]byte), dirs: map[string]bool{"": true}}
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return fi.dir }
+func (fi memFileInfo) Sys() any           { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func parentDir(name string) string {
+	if dir := path.Dir(name); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[parentDir(name)] {
+		return notExist("create", name)
+	}
+	m.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[name] {
+		return nil, notExist("readdir", name)
+	}
+	var entries []os.FileInfo
+	for p, data := range m.files {
+		if parentDir(p) == name {
+			entries = append(entries, memFileInfo{name: path.Base(p), size: int64(len(data))})
+		}
+	}
+	for p := range m.dirs {
+		if p != "" && parentDir(p) == name {
+			entries = append(entries, memFileInfo{name: path.Base(p), dir: true})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if data, ok := m.files[name]; ok {
+		return memFileInfo{name: path.Base(name), size: int64(len(data))}, nil
+	}
+	if m.dirs[name] {
+		return memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	return nil, notExist("stat", name)
+}
+
+func (m *memFS) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.dirs[name] {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if !m.dirs[parentDir(name)] {
+		return notExist("mkdir", name)
+	}
+	m.dirs[name] = true
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return notExist("remove", name)
+	}
+	for p := range m.files {
+		if strings.HasPrefix(p, name+"/") {
+			return &os.PathError{Op: "remove", Path: name, Err: os.ErrInvalid}
+		}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[oldpath]
+	if !ok {
+		return notExist("rename", oldpath)
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = data
+	return nil
+}
+
+// newTestRepository 打开 fs 上 repo 目录中的仓库
+func newTestRepository(fs repoFS) *repository {
+	config := &Config{RepoPath: "repo", RepoPackSize: 64 * 1024, RetryTimes: 1}
+	return newRepository(config, func(fn func(fs repoFS) error) error { return fn(fs) })
+}
+
+func TestRepositoryEncodeDecode(t *testing.T) {
+	compressible := bytes.Repeat([]byte("smb-backup repository "), 1000)
+	random := randomData(5, 4096)
+
+	tests := []struct {
+		name    string
+		key     []byte
+		plain   []byte
+		wantTag byte // 不加密时编码结果的第一个字节
+	}{
+		{"raw empty", nil, []byte{}, blobRaw},
+		{"raw random", nil, random, blobRaw},
+		{"zstd", nil, compressible, blobZstd},
+		{"aead empty", bytes.Repeat([]byte{1}, 32), []byte{}, 0},
+		{"aead random", bytes.Repeat([]byte{2}, 32), random, 0},
+		{"aead zstd", bytes.Repeat([]byte{3}, 32), compressible, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRepository(newMemFS())
+			if tt.key != nil {
+				if err := r.setKey(tt.key); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			data, err := r.encode(tt.plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.key == nil && data[0] != tt.wantTag {
+				t.Errorf("encoded with compression %d, want %d", data[0], tt.wantTag)
+			}
+			if tt.key != nil && len(tt.plain) > 0 && bytes.Contains(data, tt.plain[:min(len(tt.plain), 64)]) {
+				t.Error("encrypted data contains the plaintext")
+			}
+
+			got, err := r.decode(data)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if !bytes.Equal(got, tt.plain) {
+				t.Error("decoded data differs from the input")
+			}
+
+			if tt.key == nil {
+				return
+			}
+			// 密文被改动或换了密钥都要报错
+			tampered := append([]byte(nil), data...)
+			tampered[len(tampered)-1] ^= 1
+			if _, err := r.decode(tampered); err == nil {
+				t.Error("decode accepted tampered data")
+			}
+			other := newTestRepository(newMemFS())
+			other.setKey(bytes.Repeat([]byte{9}, 32))
+			if _, err := other.decode(data); err == nil {
+				t.Error("decode accepted data encrypted with another key")
+			}
+		})
+	}
+}
+
+func TestRepositoryEncodeFreshNonce(t *testing.T) {
+	r := newTestRepository(newMemFS())
+	r.setKey(bytes.Repeat([]byte{4}, 32))
+	plain := []byte("same plaintext")
+	a, _ := r.encode(plain)
+	b, _ := r.encode(plain)
+	if bytes.Equal(a, b) {
+		t.Error("encrypting the same data twice gave identical output")
+	}
+}
+
+func TestRepositoryDecodeUnknownCompression(t *testing.T) {
+	r := newTestRepository(newMemFS())
+	if _, err := r.decode([]byte{7, 1, 2}); err == nil {
+		t.Error("decode accepted unknown compression")
+	}
+	if _, err := r.decode(nil); err == nil {
+		t.Error("decode accepted empty data")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 失败原因分类，与 uploadFile 中的重试策略对应
+const (
+	errorClassTCP        = "tcp"
+	errorClassSMBSession = "smb_session"
+	errorClassFileSystem = "file_system"
+	errorClassRead       = "read"
+	errorClassChanged    = "changed"
+	errorClassUnknown    = "unknown"
+)
+
+func errorClass(err error) string {
+	switch {
+	case isFileChanged(err):
+		return errorClassChanged
+	case isTCPConnectionError(err):
+		return errorClassTCP
+	case isSMBSessionError(err):
+		return errorClassSMBSession
+	case isFileSystemError(err):
+		return errorClassFileSystem
+	default:
+		return errorClassUnknown
+	}
+}
+
+// FailedFile 失败报告中的一条记录，包含重新上传所需的全部信息
+type FailedFile struct {
+	Path       string    `json:"path"`
+	BaseDir    string    `json:"base_dir"`
+	RelPath    string    `json:"rel_path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mod_time"`
+	ErrorClass string    `json:"error_class"`
+	LastError  string    `json:"last_error"`
+	Attempts   int       `json:"attempts"`
+}
+
+// FailureReport 一次运行结束时写出的失败文件列表。
+// Inconsistent 为复制过程中一直在变化、按 flag 策略保留了副本的文件，retry-failed 不会重传
+type FailureReport struct {
+	Config       string       `json:"config"`
+	Job          string       `json:"job,omitempty"`
+	StartTime    time.Time    `json:"start_time"`
+	EndTime      time.Time    `json:"end_time"`
+	Files        []FailedFile `json:"files"`
+	Inconsistent []FailedFile `json:"inconsistent,omitempty"`
+}
+
+// failureList 并发安全的失败记录
+type failureList struct {
+	mu           sync.Mutex
+	files        []FailedFile
+	inconsistent []FailedFile
+}
+
+func newFailedFile(task FileTask, class string, err error, attempts int) FailedFile {
+	return FailedFile{
+		Path:       task.SourcePath,
+		BaseDir:    task.BaseDir,
+		RelPath:    task.RelPath,
+		Size:       task.Size,
+		ModTime:    task.ModTime,
+		ErrorClass: class,
+		LastError:  err.Error(),
+		Attempts:   attempts,
+	}
+}
+
+// recordFailure 记录一个最终失败的文件
+func (s *Stats) recordFailure(task FileTask, class string, err error, attempts int) {
+	atomic.AddInt64(&s.FailedFiles, 1)
+	s.addRecentError(RecentError{Time: time.Now(), Path: task.SourcePath, Class: class, Error: err.Error(), Final: true})
+
+	s.failures.mu.Lock()
+	defer s.failures.mu.Unlock()
+	s.failures.files = append(s.failures.files, newFailedFile(task, class, err, attempts))
+}
+
+// recordInconsistent 记录一个已上传但复制期间发生变化的文件
+func (s *Stats) recordInconsistent(task FileTask, err error, attempts int) {
+	atomic.AddInt64(&s.InconsistentFiles, 1)
+
+	s.failures.mu.Lock()
+	defer s.failures.mu.Unlock()
+	s.failures.inconsistent = append(s.failures.inconsistent, newFailedFile(task, errorClassChanged, err, attempts))
+}
+
+func (s *Stats) failedFiles() ([]FailedFile, []FailedFile) {
+	s.failures.mu.Lock()
+	defer s.failures.mu.Unlock()
+	return append([]FailedFile(nil), s.failures.files...), append([]FailedFile(nil), s.failures.inconsistent...)
+}
+
+// writeFailureReport 有失败或不一致的文件时写出报告，返回报告路径
+func writeFailureReport(config *Config, stats *Stats) (string, error) {
+	files, inconsistent := stats.failedFiles()
+	if len(files) == 0 && len(inconsistent) == 0 {
+		return "", nil
+	}
+
+	report := FailureReport{
+		Config:       config.path,
+		Job:          config.Name,
+		StartTime:    stats.StartTime,
+		EndTime:      time.Now(),
+		Files:        files,
+		Inconsistent: inconsistent,
+	}
+	path := filepath.Join(config.StateDir, "failed-"+stats.StartTime.Format("20060102-150405")+".json")
+	if err := writeJSONFile(path, report); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func loadFailureReport(path string) (*FailureReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FailureReport{}
+	if err := json.Unmarshal(data, report); err != nil {
+		return nil, fmt.Errorf("parse report %s: %v", path, err)
+	}
+	return report, nil
+}
+
+// feedFailedFiles 用失败报告代替扫描，只重新上传报告中的文件
+func feedFailedFiles(report *FailureReport) func(sched *Scheduler, stats *Stats) {
+	return func(sched *Scheduler, stats *Stats) {
+		defer sched.Close()
+
+		slog.Info("Retrying failed files from report", "files", len(report.Files))
+		for _, f := range report.Files {
+			if control.Stopping() {
+				break
+			}
+
+			task := FileTask{
+				SourcePath: f.Path,
+				RelPath:    f.RelPath,
+				Size:       f.Size,
+				ModTime:    f.ModTime,
+				BaseDir:    f.BaseDir,
+			}
+
+			// 以当前的文件大小和修改时间为准
+			info, err := os.Stat(f.Path)
+			if err != nil {
+				atomic.AddInt64(&stats.TotalFiles, 1)
+				stats.recordFailure(task, errorClassRead, err, 1)
+				slog.Error("Upload failed", "path", f.Path, "class", errorClassRead, "err", err)
+				continue
+			}
+			task.Size = info.Size()
+			task.ModTime = info.ModTime()
+
+			atomic.AddInt64(&stats.TotalFiles, 1)
+			atomic.AddInt64(&stats.TotalBytes, task.Size)
+			sched.Submit(task)
+		}
+
+		atomic.StoreInt32(&stats.ScanComplete, 1)
+	}
+}
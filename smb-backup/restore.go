@@ -0,0 +1,341 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// restoreCommand 把共享上的备份下载回本地：
+// 远端名字按映射清单或编码规则还原，小文件打包分段解开到原来的位置，
+// 去重存放的文件按 dedup 清单从对象区取回，压缩上传的文件解压，符号链接和硬链接按链接清单重建，
+// 最后创建空目录并还原目录的修改时间
+func restoreCommand(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	job := fs.String("job", "", "job to restore when the config defines several")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: smb-backup restore [-job name] <config.json> <local_dir> [path_prefix]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	config, err := loadJobConfig(args[0], *job)
+	if err != nil {
+		fatalConfig("Failed to load config", "err", err)
+	}
+	if err := setupLogging(config); err != nil {
+		fatalConfig("Failed to set up logging", "err", err)
+	}
+
+	prefix := ""
+	if len(args) > 2 {
+		prefix = strings.Trim(filepath.ToSlash(args[2]), "/")
+	}
+
+	control.handleSignals(time.Duration(config.ShutdownTimeout) * time.Second)
+
+	pool, err := NewSMBPool(config, 1, 1)
+	if err != nil {
+		fatal("Failed to create SMB pool", "err", err)
+	}
+	defer pool.Close()
+
+	conn, err := pool.Get(10 * time.Second)
+	if err != nil {
+		fatal("Failed to get connection", "err", err)
+	}
+	defer pool.Put(conn)
+
+	r := &restorer{
+		share:    conn.share,
+		config:   config,
+		localDir: args[1],
+		prefix:   prefix,
+		names:    NewNameMapper(config),
+		objects:  NewObjectStore(config),
+		links:    NewLinkTable(config),
+		restored: make(map[string]time.Time),
+	}
+	if err := r.names.Load(conn.share); err != nil {
+		fatal("Failed to load name manifest", "err", err)
+	}
+	// 去重清单与当前是否开启 dedup 无关，以前的运行可能用过
+	if err := r.objects.Load(conn.share); err != nil {
+		fatal("Failed to load dedup manifest", "err", err)
+	}
+	if err := r.links.Load(conn.share); err != nil {
+		fatal("Failed to load link manifest", "err", err)
+	}
+
+	slog.Info("Restoring", "source", fmt.Sprintf("//%s/%s/%s", config.Host, config.Share, config.DestPath),
+		"local_dir", r.localDir, "prefix", prefix)
+
+	start := time.Now()
+	r.run()
+
+	slog.Info("Restore finished", "elapsed", time.Since(start).Round(time.Second),
+		"restored_files", r.files, "bytes", r.bytes, "failed_files", r.failed)
+
+	if r.failed > 0 || control.Stopping() {
+		pool.Put(conn)
+		pool.Close()
+		os.Exit(1)
+	}
+}
+
+type restorer struct {
+	share    *smb2.Share
+	config   *Config
+	localDir string
+	prefix   string
+	names    *NameMapper
+	objects  *ObjectStore
+	links    *LinkTable
+
+	// 同一路径可能既有单独上传的文件又有打包的副本，保留修改时间较新的
+	restored map[string]time.Time
+	dirs     []localDirTime // 共享上的目录，恢复完文件后创建并设置修改时间
+
+	files  int64
+	bytes  int64
+	failed int64
+}
+
+func (r *restorer) run() {
+	root := joinSMBPath(r.config.DestPath)
+
+	r.walk(root, "")
+	r.walk(joinSMBPath(root, longPathDirName), longPathDirName)
+	r.restoreObjects()
+	r.extractPacks(root)
+
+	// 硬链接的目标可能在打包分段中，链接最后重建
+	restored, failed := restoreLinks(r.localDir, r.links.Entries(), r.wanted)
+	r.files += restored
+	r.failed += failed
+
+	// 写入文件会改变目录的修改时间，目录最后处理
+	if !control.Stopping() {
+		r.failed += restoreDirTimes(r.dirs)
+	}
+}
+
+// extractPacks 解开小文件打包分段。完整成功的备份会删除更早运行的分段，
+// 留下的是最近一次成功运行及之后未完成的运行写出的分段
+func (r *restorer) extractPacks(root string) {
+	packDir := joinSMBPath(root, packDirName)
+	entries, err := r.share.ReadDir(packDir)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("Failed to read pack dir", "path", packDir, "err", err)
+		r.failed++
+		return
+	}
+	// 分段名去掉任务名后以运行时间开头，按它排序即按时间先后解包
+	sort.Slice(entries, func(i, j int) bool { return packSortKey(entries[i].Name()) < packSortKey(entries[j].Name()) })
+	for _, entry := range entries {
+		if control.Stopping() {
+			return
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".tar") {
+			continue
+		}
+		if err := r.extractPack(joinSMBPath(packDir, entry.Name())); err != nil {
+			slog.Error("Failed to extract pack", "pack", entry.Name(), "err", err)
+			r.failed++
+		}
+	}
+}
+
+// walk 递归下载 dir 下的文件，rel 为相对 dest_path 的远端路径
+func (r *restorer) walk(dir, rel string) {
+	entries, err := r.share.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to read dir", "path", dir, "err", err)
+			r.failed++
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if control.Stopping() {
+			return
+		}
+
+		remoteRel := entry.Name()
+		if rel != "" {
+			remoteRel = rel + "/" + entry.Name()
+		}
+		// 程序自己的数据单独处理
+		if rel == "" && (entry.Name() == ".smb-backup" || entry.Name() == ".test") {
+			continue
+		}
+
+		remotePath := dir + "/" + entry.Name()
+		if entry.IsDir() {
+			r.walk(remotePath, remoteRel)
+			if original := r.names.Lookup(remoteRel); r.wanted(original) {
+				if localPath, err := restoreTarget(r.localDir, original); err == nil {
+					r.dirs = append(r.dirs, localDirTime{path: localPath, modTime: entry.ModTime()})
+				}
+			}
+			continue
+		}
+		if strings.HasSuffix(remoteRel, compressSuffix) {
+			if err := r.restoreCompressed(remotePath, remoteRel, entry.ModTime()); err != nil {
+				slog.Error("Restore failed", "path", r.names.Lookup(strings.TrimSuffix(remoteRel, compressSuffix)), "err", err)
+				r.failed++
+			}
+			continue
+		}
+
+		original := r.names.Lookup(remoteRel)
+		if !r.wanted(original) {
+			continue
+		}
+		if err := r.restoreRemoteFile(remotePath, original, entry.ModTime()); err != nil {
+			slog.Error("Restore failed", "path", original, "err", err)
+			r.failed++
+		}
+	}
+}
+
+// restoreObjects 按 dedup 清单还原去重存放的文件
+func (r *restorer) restoreObjects() {
+	for _, e := range r.objects.Entries() {
+		if control.Stopping() {
+			return
+		}
+		if !r.wanted(e.Path) {
+			continue
+		}
+		if err := r.restoreRemoteFile(r.objects.objectPath(e.Hash), e.Path, e.ModTime); err != nil {
+			slog.Error("Restore failed", "path", e.Path, "object", e.Hash, "err", err)
+			r.failed++
+		}
+	}
+}
+
+func (r *restorer) wanted(original string) bool {
+	return r.prefix == "" || original == r.prefix || strings.HasPrefix(original, r.prefix+"/")
+}
+
+func (r *restorer) restoreRemoteFile(remotePath, original string, modTime time.Time) error {
+	f, err := r.share.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return r.writeLocal(original, modTime, f)
+}
+
+// restoreCompressed 解压还原压缩上传的文件。源文件名中的后缀在远端是转义过的，
+// 带 compressSuffix 的远端文件都是压缩上传的
+func (r *restorer) restoreCompressed(remotePath, remoteRel string, modTime time.Time) error {
+	original := r.names.Lookup(strings.TrimSuffix(remoteRel, compressSuffix))
+	if !r.wanted(original) {
+		return nil
+	}
+	f, err := r.share.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	src, closer, err := decompressReader(f)
+	if err != nil {
+		return err
+	}
+	defer closer()
+	return r.writeLocal(original, modTime, src)
+}
+
+func (r *restorer) extractPack(packPath string) error {
+	f, err := r.share.Open(packPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(bufio.NewReaderSize(f, r.config.BufferSize))
+	for {
+		if control.Stopping() {
+			return nil
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || !r.wanted(hdr.Name) {
+			continue
+		}
+		if err := r.writeLocal(hdr.Name, hdr.ModTime, tr); err != nil {
+			slog.Error("Restore failed", "path", hdr.Name, "err", err)
+			r.failed++
+		}
+	}
+}
+
+// writeLocal 把内容写到本地对应位置，并还原修改时间
+func (r *restorer) writeLocal(original string, modTime time.Time, src io.Reader) error {
+	if prev, ok := r.restored[original]; ok && prev.After(modTime) {
+		return nil
+	}
+
+	localPath, err := restoreTarget(r.localDir, original)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	dst, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, r.config.BufferSize)
+	n, err := io.CopyBuffer(dst, src, buf)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	os.Chtimes(localPath, modTime, modTime)
+
+	r.restored[original] = modTime
+	r.files++
+	r.bytes += n
+	slog.Debug("Restored", "path", original, "bytes", n)
+	return nil
+}
+
+// restoreTarget 原始路径在本地恢复目录中的位置，拒绝跳出恢复目录的路径
+func restoreTarget(localDir, original string) (string, error) {
+	localPath := filepath.Join(localDir, filepath.FromSlash(original))
+	if rel, err := filepath.Rel(localDir, localPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path escapes restore directory")
+	}
+	return localPath, nil
+}
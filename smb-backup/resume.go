@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// resumeMarker 上传开始前写入 state_dir/partial，成功后删除。
+// 远端比源文件小不代表是中断的上传：以前完整上传、之后源文件变大的副本抽样校验也可能通过，
+// 只有留有记录且源文件大小和修改时间都没变时才续传
+type resumeMarker struct {
+	Source  string    `json:"source"`
+	Dest    string    `json:"dest"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+func resumeMarkerPath(config *Config, destPath string) string {
+	return filepath.Join(config.StateDir, "partial", destKey(config, destPath)+".json")
+}
+
+// resumable 文件是否可能续传，只有这些文件需要记录
+func resumable(task FileTask, config *Config) bool {
+	return config.ResumeMode != "off" && task.Size >= config.ResumeMinSize && !task.Compressed
+}
+
+// markUploading 记录正在上传的文件，写入失败时只是下次无法续传
+func markUploading(config *Config, task FileTask, destPath string) {
+	marker := resumeMarker{Source: task.SourcePath, Dest: destPath, Size: task.Size, ModTime: task.ModTime}
+	if err := writeJSONFile(resumeMarkerPath(config, destPath), marker); err != nil {
+		slog.Warn("Failed to record upload for resume", "path", task.SourcePath, "err", err)
+	}
+}
+
+// clearUploading 上传完成，删除记录
+func clearUploading(config *Config, destPath string) {
+	if err := os.Remove(resumeMarkerPath(config, destPath)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove resume marker", "dest", destPath, "err", err)
+	}
+}
+
+// interruptedUpload 远端文件是否是本工具对同一版本源文件中断的上传
+func interruptedUpload(config *Config, task FileTask, destPath string) bool {
+	data, err := os.ReadFile(resumeMarkerPath(config, destPath))
+	if err != nil {
+		return false
+	}
+	var marker resumeMarker
+	if err := json.Unmarshal(data, &marker); err != nil {
+		return false
+	}
+	return marker.Dest == destPath && marker.Size == task.Size && marker.ModTime.Equal(task.ModTime)
+}
+
+// verifiedResumeOffset 检查远程已存在的部分文件，返回校验通过、可以继续写入的偏移量。
+// 返回 0 表示需要从头上传。
+func verifiedResumeOffset(share *smb2.Share, srcFile *os.File, destPath string, task FileTask, config *Config) int64 {
+	if !resumable(task, config) {
+		return 0
+	}
+	if !interruptedUpload(config, task, destPath) {
+		slog.Debug("No interrupted upload recorded, uploading from zero", "dest", destPath)
+		return 0
+	}
+
+	fi, err := share.Stat(destPath)
+	if err != nil || fi.IsDir() || fi.Size() <= 0 || fi.Size() >= task.Size {
+		return 0
+	}
+	remoteSize := fi.Size()
+
+	dstFile, err := share.Open(destPath)
+	if err != nil {
+		return 0
+	}
+	defer dstFile.Close()
+
+	var offset int64
+	switch config.ResumeMode {
+	case "full":
+		offset, err = verifyPrefixFull(srcFile, dstFile, remoteSize, config.ResumeBlockSize)
+	default:
+		offset, err = verifyPrefixSampled(srcFile, dstFile, remoteSize, config.ResumeBlockSize, config.ResumeSamples)
+	}
+	if err != nil {
+		slog.Warn("Failed to verify partial file, restarting from zero", "dest", destPath, "err", err)
+		return 0
+	}
+
+	if offset == 0 {
+		slog.Debug("Partial file does not match source, restarting from zero", "dest", destPath)
+	}
+	return offset
+}
+
+// verifyPrefixSampled 抽样比较若干块的哈希，首尾两块必定参与比较。
+// 全部一致时认为整个远程前缀可用。
+func verifyPrefixSampled(src io.ReaderAt, dst io.ReaderAt, remoteSize int64, blockSize int, samples int) (int64, error) {
+	lastStart := remoteSize - int64(blockSize)
+	if lastStart < 0 {
+		lastStart = 0
+	}
+
+	for i := 0; i < samples; i++ {
+		start := lastStart * int64(i) / int64(samples-1)
+		match, err := blockMatches(src, dst, start, min64(int64(blockSize), remoteSize-start))
+		if err != nil {
+			return 0, err
+		}
+		if !match {
+			return 0, nil
+		}
+	}
+
+	return remoteSize, nil
+}
+
+// verifyPrefixFull 从头逐块比较哈希，返回连续一致部分的末尾
+func verifyPrefixFull(src io.ReaderAt, dst io.ReaderAt, remoteSize int64, blockSize int) (int64, error) {
+	var offset int64
+	for offset < remoteSize {
+		length := min64(int64(blockSize), remoteSize-offset)
+		match, err := blockMatches(src, dst, offset, length)
+		if err != nil {
+			return 0, err
+		}
+		if !match {
+			break
+		}
+		offset += length
+	}
+	return offset, nil
+}
+
+func blockMatches(src io.ReaderAt, dst io.ReaderAt, offset int64, length int64) (bool, error) {
+	srcSum, err := hashRange(src, offset, length)
+	if err != nil {
+		return false, fmt.Errorf("read source: %v", err)
+	}
+	dstSum, err := hashRange(dst, offset, length)
+	if err != nil {
+		return false, fmt.Errorf("read dest: %v", err)
+	}
+	return bytes.Equal(srcSum, dstSum), nil
+}
+
+func hashRange(r io.ReaderAt, offset int64, length int64) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, offset, length)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// openForResume 打开远程文件，截掉未校验的尾部，并把源文件和目标文件都定位到续传位置
+func openForResume(share *smb2.Share, srcFile *os.File, destPath string, offset int64) (*smb2.File, error) {
+	dstFile, err := share.OpenFile(destPath, os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open dest '%s': %v", destPath, err)
+	}
+
+	if err := dstFile.Truncate(offset); err != nil {
+		dstFile.Close()
+		return nil, fmt.Errorf("truncate dest '%s': %v", destPath, err)
+	}
+	if _, err := dstFile.Seek(offset, io.SeekStart); err != nil {
+		dstFile.Close()
+		return nil, fmt.Errorf("seek dest '%s': %v", destPath, err)
+	}
+	if _, err := srcFile.Seek(offset, io.SeekStart); err != nil {
+		dstFile.Close()
+		return nil, fmt.Errorf("seek source: %v", err)
+	}
+
+	return dstFile, nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scanDir 待扫描的目录及其所属的源路径
+type scanDir struct {
+	root string
+	src  *SourcePath
+	path string
+
+	ancestors []fileID // 跟随符号链接时，从源路径到本目录的各级目录，用于发现循环
+}
+
+// child 子目录，跟随符号链接时记录目录的身份
+func (d scanDir) child(path string, info os.FileInfo, follow bool) scanDir {
+	sub := scanDir{root: d.root, src: d.src, path: path}
+	if follow {
+		if id, _, ok := fileIdentity(info); ok {
+			sub.ancestors = append(append([]fileID(nil), d.ancestors...), id)
+		}
+	}
+	return sub
+}
+
+// loops 目录是本目录或某一级上层目录
+func (d scanDir) loops(info os.FileInfo) bool {
+	id, _, ok := fileIdentity(info)
+	if !ok {
+		return false
+	}
+	for _, a := range d.ancestors {
+		if a == id {
+			return true
+		}
+	}
+	return false
+}
+
+func scanFiles(sources []SourcePath, sched *Scheduler, stats *Stats, config *Config) {
+	defer sched.Close()
+
+	startTime := time.Now()
+	var roots []scanDir
+	var mu sync.Mutex
+	var collected []FileTask
+
+	submit := func(task FileTask) {
+		if control.Stopping() {
+			return
+		}
+		atomic.AddInt64(&stats.TotalFiles, 1)
+		atomic.AddInt64(&stats.TotalBytes, task.Size)
+
+		if config.PreScan {
+			mu.Lock()
+			collected = append(collected, task)
+			mu.Unlock()
+			return
+		}
+		sched.Submit(task)
+	}
+
+	for i := range sources {
+		src := &sources[i]
+		slog.Info("Scanning", "source", src.String())
+
+		info, err := os.Stat(src.Path)
+		if err != nil {
+			slog.Warn("Error accessing path", "path", src.Path, "err", err)
+			atomic.AddInt64(&stats.scanErrors, 1)
+			continue
+		}
+
+		if isSpecialFile(info.Mode()) {
+			atomic.AddInt64(&stats.SpecialFiles, 1)
+			slog.Info("Skipping special file", "path", src.Path, "type", specialFileType(info.Mode()))
+			continue
+		}
+
+		// 单个文件作为源时 dest 就是远端文件名
+		if !info.IsDir() {
+			submit(FileTask{
+				SourcePath: src.Path,
+				RelPath:    src.Dest,
+				Size:       info.Size(),
+				ModTime:    info.ModTime(),
+			})
+			continue
+		}
+
+		root := scanDir{root: src.Path, src: src}
+		roots = append(roots, root.child(src.Path, info, config.Symlinks == symlinkFollow))
+	}
+
+	parallelWalk(roots, config, stats, func(dir scanDir, path string, relPath string, info os.FileInfo) {
+		submit(FileTask{
+			SourcePath: path,
+			RelPath:    relPath,
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+			BaseDir:    dir.src.Dest,
+		})
+	})
+
+	if control.Stopping() {
+		slog.Info("Scan stopped by shutdown request")
+		return
+	}
+
+	atomic.StoreInt32(&stats.ScanComplete, 1)
+	stats.fullScan = true
+	slog.Info("Scan complete",
+		"files", atomic.LoadInt64(&stats.TotalFiles),
+		"bytes", atomic.LoadInt64(&stats.TotalBytes),
+		"dirs", atomic.LoadInt64(&stats.ScannedDirs),
+		"elapsed", time.Since(startTime).Round(time.Millisecond))
+
+	for _, task := range collected {
+		if control.Stopping() {
+			return
+		}
+		sched.Submit(task)
+	}
+}
+
+// parallelWalk 用 scan_workers 个 goroutine 并发遍历目录树，对每个通过过滤规则的文件调用 visit。
+// visit 会被并发调用，relPath 为相对源路径的 / 分隔路径。
+// 符号链接按 symlinks 处理，特殊文件跳过，stats.links 非空时同一 inode 的硬链接在遍历结束后
+// 只把路径最小的一个交给 visit
+func parallelWalk(roots []scanDir, config *Config, stats *Stats, visit func(dir scanDir, path string, relPath string, info os.FileInfo)) {
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	stack := append([]scanDir(nil), roots...)
+	outstanding := len(stack) // 已入栈但尚未处理完的目录数
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.ScanWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				mu.Lock()
+				for len(stack) == 0 && outstanding > 0 {
+					cond.Wait()
+				}
+				if outstanding == 0 {
+					mu.Unlock()
+					return
+				}
+				dir := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				mu.Unlock()
+
+				// 停止后不再读取目录，剩余的目录直接出栈
+				var subdirs []scanDir
+				if !control.Stopping() {
+					subdirs = readScanDir(dir, config, stats, visit)
+				}
+				atomic.AddInt64(&stats.ScannedDirs, 1)
+
+				mu.Lock()
+				stack = append(stack, subdirs...)
+				outstanding += len(subdirs) - 1
+				if outstanding == 0 || len(subdirs) > 0 {
+					cond.Broadcast()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if stats.links != nil {
+		atomic.AddInt64(&stats.LinkFiles, stats.links.Release())
+	}
+}
+
+// readScanDir 读取一个目录，文件交给 visit，返回需要继续扫描的子目录。
+// 被 exclude 排除的目录整棵跳过
+func readScanDir(dir scanDir, config *Config, stats *Stats, visit func(dir scanDir, path string, relPath string, info os.FileInfo)) []scanDir {
+	entries, err := os.ReadDir(dir.path)
+	if err != nil {
+		slog.Warn("Error accessing path", "path", dir.path, "err", err)
+		atomic.AddInt64(&stats.scanErrors, 1)
+	}
+
+	follow := config.Symlinks == symlinkFollow
+	var subdirs []scanDir
+	for _, entry := range entries {
+		path := filepath.Join(dir.path, entry.Name())
+		relPath, err := filepath.Rel(dir.root, path)
+		if err != nil {
+			slog.Warn("Error getting relative path", "path", path, "err", err)
+			atomic.AddInt64(&stats.scanErrors, 1)
+			continue
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if dir.src.excluded(relPath) {
+			continue
+		}
+
+		if entry.IsDir() {
+			var info os.FileInfo
+			if follow || stats.dirs != nil {
+				if info, err = entry.Info(); err != nil {
+					slog.Warn("Error accessing path", "path", path, "err", err)
+					atomic.AddInt64(&stats.scanErrors, 1)
+					continue
+				}
+			}
+			recordDir(dir, path, relPath, info, stats)
+			subdirs = append(subdirs, dir.child(path, info, follow))
+			continue
+		}
+
+		var info os.FileInfo
+		if entry.Type()&os.ModeSymlink != 0 {
+			if config.Symlinks == symlinkSkip {
+				continue
+			}
+			if follow {
+				if info, err = os.Stat(path); err != nil {
+					slog.Warn("Cannot follow symlink, recording the link instead", "path", path, "err", err)
+				} else if info.IsDir() {
+					if dir.loops(info) {
+						slog.Info("Skipping symlink to a parent directory", "path", path)
+					} else {
+						recordDir(dir, path, relPath, info, stats)
+						subdirs = append(subdirs, dir.child(path, info, follow))
+					}
+					continue
+				}
+			}
+			if info == nil {
+				if dir.src.included(relPath) {
+					recordSymlink(dir, path, relPath, stats)
+				}
+				continue
+			}
+		}
+
+		if !dir.src.included(relPath) {
+			continue
+		}
+
+		if info == nil {
+			if info, err = entry.Info(); err != nil {
+				slog.Warn("Error accessing path", "path", path, "err", err)
+				atomic.AddInt64(&stats.scanErrors, 1)
+				continue
+			}
+		}
+		if isSpecialFile(info.Mode()) {
+			atomic.AddInt64(&stats.SpecialFiles, 1)
+			slog.Info("Skipping special file", "path", path, "type", specialFileType(info.Mode()))
+			continue
+		}
+		if stats.links != nil {
+			task := FileTask{SourcePath: path, RelPath: relPath, Size: info.Size(), ModTime: info.ModTime(), BaseDir: dir.src.Dest}
+			if stats.links.Visit(info, task, func() { visit(dir, path, relPath, info) }) {
+				continue
+			}
+		}
+		visit(dir, path, relPath, info)
+	}
+
+	return subdirs
+}
+
+// recordSymlink 把符号链接记录到链接清单
+func recordSymlink(dir scanDir, path, relPath string, stats *Stats) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		slog.Warn("Error reading symlink", "path", path, "err", err)
+		return
+	}
+	if stats.links == nil {
+		return
+	}
+	stats.links.AddSymlink(originalPath(dir.src.Dest, relPath), target)
+	atomic.AddInt64(&stats.LinkFiles, 1)
+	slog.Debug("Symlink recorded", "path", path, "target", target)
+}
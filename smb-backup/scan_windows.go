@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// fileIdentity Windows 上需要打开文件才能取得文件索引，不识别硬链接和目录循环
+func fileIdentity(info os.FileInfo) (id fileID, nlink uint64, ok bool) {
+	return fileID{}, 0, false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/hirochachacha/go-smb2"
+)
+
+// go-smb2 不导出协商结果，这里的常量与其 internal/smb2 中的定义一致
+const (
+	smbDialect202 = 0x202
+	smbDialect210 = 0x210
+	smbDialect300 = 0x300
+	smbDialect302 = 0x302
+	smbDialect311 = 0x311
+
+	smbSessionFlagGuest   = 0x1
+	smbSessionFlagNull    = 0x2
+	smbSessionFlagEncrypt = 0x4
+	smbShareFlagEncrypt   = 0x8000
+
+	smbCipherAES128CCM = 0x1
+	smbCipherAES128GCM = 0x2
+)
+
+var smbDialectNames = map[string]uint16{
+	"2.0.2": smbDialect202,
+	"2.1":   smbDialect210,
+	"3.0":   smbDialect300,
+	"3.0.2": smbDialect302,
+	"3.1.1": smbDialect311,
+}
+
+// smbSecurity 一个连接协商得到的协议版本和安全属性
+type smbSecurity struct {
+	dialect         uint16
+	signingRequired bool // 协商时任一方要求签名
+	signed          bool // 消息实际被签名或加密（guest 和匿名会话不签名）
+	encrypted       bool // 会话或共享要求加密，所有消息都加密传输
+	cipher          uint16
+	guest           bool
+}
+
+// inspectSMBSecurity 通过反射读取 go-smb2 未导出的会话状态。
+// 库的内部结构变化导致读取失败时返回 false，调用方应视为无法确认
+func inspectSMBSecurity(share *smb2.Share) (sec smbSecurity, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	tc := reflect.ValueOf(share).Elem().FieldByName("treeConn").Elem()
+	sess := tc.FieldByName("session").Elem()
+	conn := sess.FieldByName("conn").Elem()
+
+	shareFlags := tc.FieldByName("shareFlags").Uint()
+	sessionFlags := sess.FieldByName("sessionFlags").Uint()
+
+	sec.dialect = uint16(conn.FieldByName("dialect").Uint())
+	sec.signingRequired = conn.FieldByName("requireSigning").Bool()
+	sec.cipher = uint16(conn.FieldByName("cipherId").Uint())
+	sec.guest = sessionFlags&(smbSessionFlagGuest|smbSessionFlagNull) != 0
+	sec.encrypted = sessionFlags&smbSessionFlagEncrypt != 0 || shareFlags&smbShareFlagEncrypt != 0
+	sec.signed = sec.encrypted || !sec.guest
+	return sec, true
+}
+
+func (s smbSecurity) dialectName() string {
+	for name, d := range smbDialectNames {
+		if d == s.dialect {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%x", s.dialect)
+}
+
+func (s smbSecurity) cipherName() string {
+	if !s.encrypted {
+		return "off"
+	}
+	switch s.cipher {
+	case smbCipherAES128GCM:
+		return "AES-128-GCM"
+	default:
+		// SMB 3.0 和 3.0.2 不协商算法，固定为 CCM
+		return "AES-128-CCM"
+	}
+}
+
+func (s smbSecurity) String() string {
+	signing := "off"
+	if s.signed {
+		signing = "on"
+		if s.signingRequired {
+			signing = "required"
+		}
+	}
+	str := fmt.Sprintf("dialect %s, signing %s, encryption %s", s.dialectName(), signing, s.cipherName())
+	if s.guest {
+		str += ", guest session"
+	}
+	return str
+}
+
+// checkSMBSecurity 按 require_signing、require_encryption 和 min_dialect 校验连接。
+// go-smb2 不能主动要求加密，需要在服务端开启（如 Samba 的 smb encrypt = required）
+func checkSMBSecurity(config *Config, share *smb2.Share) error {
+	if !config.RequireSigning && !config.RequireEncryption && config.minDialect == 0 {
+		return nil
+	}
+
+	sec, ok := inspectSMBSecurity(share)
+	if !ok {
+		return fmt.Errorf("cannot determine negotiated SMB security properties")
+	}
+
+	if sec.dialect < config.minDialect {
+		return fmt.Errorf("negotiated SMB dialect %s is below min_dialect %s", sec.dialectName(), config.MinDialect)
+	}
+	if config.RequireSigning && !sec.signed {
+		return fmt.Errorf("session is not signed (%s)", sec)
+	}
+	if config.RequireEncryption && !sec.encrypted {
+		return fmt.Errorf("session is not encrypted (%s), enable encryption for the share on the server", sec)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SourcePath src_path 中的一项。既可以写成字符串（只有源路径），
+// 也可以写成对象，指定远端子目录和各自的过滤规则：
+//
+//	{"path": "/mnt/usb/DCIM", "dest": "usb/DCIM", "exclude": [".thumbnails", "*.tmp"]}
+type SourcePath struct {
+	Path    string   `json:"path"`
+	Dest    string   `json:"dest"`    // 相对 dest_path 的远端子目录，默认为源路径的最后一级名字，"/" 表示直接放在 dest_path 下
+	Include []string `json:"include"` // 只上传匹配的文件，为空表示全部
+	Exclude []string `json:"exclude"` // 跳过匹配的文件和目录（含其下所有内容）
+}
+
+func (s *SourcePath) UnmarshalJSON(data []byte) error {
+	var p string
+	if err := json.Unmarshal(data, &p); err == nil {
+		*s = SourcePath{Path: p}
+		s.Dest = defaultSourceDest(p)
+		return nil
+	}
+
+	var raw struct {
+		Path    string   `json:"path"`
+		Dest    *string  `json:"dest"`
+		Include []string `json:"include"`
+		Exclude []string `json:"exclude"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("src_path entry must be a path or an object: %v", err)
+	}
+
+	*s = SourcePath{Path: raw.Path, Include: raw.Include, Exclude: raw.Exclude}
+	if raw.Dest != nil {
+		s.Dest = strings.Trim(filepath.ToSlash(*raw.Dest), "/")
+	} else {
+		s.Dest = defaultSourceDest(raw.Path)
+	}
+	return nil
+}
+
+func defaultSourceDest(p string) string {
+	return filepath.Base(p)
+}
+
+func (s SourcePath) String() string {
+	dest := s.Dest
+	if dest == "" {
+		dest = "/"
+	}
+	return s.Path + " -> " + dest
+}
+
+// matchPattern 含 / 的模式匹配完整相对路径，否则只匹配最后一级名字
+func matchPattern(pattern, relPath string) bool {
+	if strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, relPath)
+		return ok
+	}
+	ok, _ := path.Match(pattern, path.Base(relPath))
+	return ok
+}
+
+// excluded 相对路径（文件或目录）是否被排除
+func (s *SourcePath) excluded(relPath string) bool {
+	for _, pattern := range s.Exclude {
+		if matchPattern(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// included 文件是否满足 include 规则
+func (s *SourcePath) included(relPath string) bool {
+	if len(s.Include) == 0 {
+		return true
+	}
+	for _, pattern := range s.Include {
+		if matchPattern(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSources 检查过滤规则，并拒绝会写到同一远端目录的源路径：
+// 两个映射相同，或一个位于另一个之下，文件都会混在一起甚至互相覆盖
+func validateSources(sources []SourcePath, caseInsensitive bool) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("src_path is empty")
+	}
+
+	for i := range sources {
+		s := &sources[i]
+		if s.Path == "" {
+			return fmt.Errorf("src_path entry %d has no path", i+1)
+		}
+		for _, pattern := range append(append([]string(nil), s.Include...), s.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("src_path %s: invalid pattern %q", s.Path, pattern)
+			}
+		}
+		if s.Dest == ".smb-backup" || strings.HasPrefix(s.Dest, ".smb-backup/") {
+			return fmt.Errorf("src_path %s: dest %q is reserved", s.Path, s.Dest)
+		}
+	}
+
+	key := func(dest string) string {
+		if caseInsensitive {
+			return strings.ToLower(dest)
+		}
+		return dest
+	}
+	overlaps := func(a, b string) bool {
+		return a == b || a == "" || b == "" || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+	}
+
+	for i := range sources {
+		for j := i + 1; j < len(sources); j++ {
+			a, b := key(sources[i].Dest), key(sources[j].Dest)
+			if overlaps(a, b) {
+				return fmt.Errorf("src_path %s and %s map to overlapping remote folders %q and %q, set a distinct \"dest\" for one of them",
+					sources[i].Path, sources[j].Path, sources[i].Dest, sources[j].Dest)
+			}
+		}
+	}
+	return nil
+}
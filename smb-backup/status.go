@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recentErrorLimit 状态页保留的最近错误条数
+const recentErrorLimit = 50
+
+// RecentError 上传过程中遇到的一个错误，Final 表示重试用尽、文件最终失败
+type RecentError struct {
+	Time  time.Time `json:"time"`
+	Path  string    `json:"path"`
+	Class string    `json:"class"`
+	Error string    `json:"error"`
+	Final bool      `json:"final"`
+}
+
+// WorkerState 一个 worker 正在上传的文件
+type WorkerState struct {
+	Worker  string    `json:"worker"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Started time.Time `json:"started"`
+}
+
+// liveState Stats 中只供状态页使用的部分：当前文件、最近错误和 statsReporter 算出的速度
+type liveState struct {
+	mu      sync.Mutex
+	workers map[string]WorkerState
+	errors  []RecentError // 环形缓冲
+	next    int
+
+	speed    float64 // 最近 5 秒，字节/秒
+	avgSpeed float64
+	eta      time.Duration // -1 表示未知
+}
+
+// setWorker 记录 worker 开始上传的文件
+func (s *Stats) setWorker(worker string, path string, size int64) {
+	s.live.mu.Lock()
+	defer s.live.mu.Unlock()
+	if s.live.workers == nil {
+		s.live.workers = make(map[string]WorkerState)
+	}
+	s.live.workers[worker] = WorkerState{Worker: worker, Path: path, Size: size, Started: time.Now()}
+}
+
+func (s *Stats) clearWorker(worker string) {
+	s.live.mu.Lock()
+	defer s.live.mu.Unlock()
+	delete(s.live.workers, worker)
+}
+
+// noteError 统计一次上传错误（含之后重试成功的）并记入最近错误
+func (s *Stats) noteError(path string, err error) {
+	atomic.AddInt64(&s.ErrorCount, 1)
+	s.addRecentError(RecentError{Time: time.Now(), Path: path, Class: errorClass(err), Error: err.Error()})
+}
+
+func (s *Stats) addRecentError(e RecentError) {
+	s.live.mu.Lock()
+	defer s.live.mu.Unlock()
+	if len(s.live.errors) < recentErrorLimit {
+		s.live.errors = append(s.live.errors, e)
+		return
+	}
+	s.live.errors[s.live.next] = e
+	s.live.next = (s.live.next + 1) % recentErrorLimit
+}
+
+func (s *Stats) setRate(speed, avgSpeed float64, eta time.Duration) {
+	s.live.mu.Lock()
+	defer s.live.mu.Unlock()
+	s.live.speed, s.live.avgSpeed, s.live.eta = speed, avgSpeed, eta
+}
+
+// StatusSnapshot /status 返回的内容
+type StatusSnapshot struct {
+	Running  bool          `json:"running"`
+	Paused   bool          `json:"paused"`
+	Stopping bool          `json:"stopping"`
+	Job      string        `json:"job,omitempty"`
+	Progress *RunSummary   `json:"progress,omitempty"`
+	Scanning bool          `json:"scanning"`
+	Errors   int64         `json:"errors"`
+	Speed    float64       `json:"speed_bytes_per_second"`
+	AvgSpeed float64       `json:"avg_speed_bytes_per_second"`
+	ETA      float64       `json:"eta_seconds"` // -1 表示未知
+	Workers  []WorkerState `json:"workers"`
+	Pool     *PoolMetrics  `json:"pool,omitempty"`
+	Recent   []RecentError `json:"recent_errors"`
+}
+
+// statusMonitor 当前运行的任务，runBackup 开始时挂上，结束时取下。
+// daemon 两次运行之间保留上一次的统计
+type statusMonitor struct {
+	mu      sync.Mutex
+	config  *Config
+	stats   *Stats
+	pool    *SMBPool
+	running bool
+	once    sync.Once
+}
+
+var status statusMonitor
+
+func (m *statusMonitor) attach(config *Config, stats *Stats, pool *SMBPool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config, m.stats, m.pool, m.running = config, stats, pool, true
+}
+
+func (m *statusMonitor) detach() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pool, m.running = nil, false
+}
+
+func (m *statusMonitor) Snapshot() StatusSnapshot {
+	m.mu.Lock()
+	config, stats, pool, running := m.config, m.stats, m.pool, m.running
+	m.mu.Unlock()
+
+	snap := StatusSnapshot{
+		Running:  running,
+		Paused:   control.Paused(),
+		Stopping: control.Stopping(),
+		ETA:      -1,
+		Workers:  []WorkerState{},
+		Recent:   []RecentError{},
+	}
+	if stats == nil {
+		return snap
+	}
+
+	summary := newRunSummary(config, stats)
+	snap.Job = config.Name
+	snap.Progress = &summary
+	snap.Scanning = running && atomic.LoadInt32(&stats.ScanComplete) == 0
+	snap.Errors = atomic.LoadInt64(&stats.ErrorCount)
+	if pool != nil {
+		metrics := pool.Metrics()
+		snap.Pool = &metrics
+	}
+
+	stats.live.mu.Lock()
+	if running {
+		snap.Speed = stats.live.speed
+		if stats.live.eta >= 0 && stats.live.speed > 0 {
+			snap.ETA = stats.live.eta.Seconds()
+		}
+		for _, w := range stats.live.workers {
+			snap.Workers = append(snap.Workers, w)
+		}
+	}
+	snap.AvgSpeed = stats.live.avgSpeed
+	// 从最旧的开始输出
+	snap.Recent = append(snap.Recent, stats.live.errors[stats.live.next:]...)
+	snap.Recent = append(snap.Recent, stats.live.errors[:stats.live.next]...)
+	stats.live.mu.Unlock()
+
+	sort.Slice(snap.Workers, func(i, j int) bool { return snap.Workers[i].Worker < snap.Workers[j].Worker })
+	return snap
+}
+
+// start 启动状态服务，同一进程只启动一次，daemon 的多次运行共用
+func (m *statusMonitor) start(addr string) {
+	if addr == "" {
+		return
+	}
+	m.once.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/status", m.serveJSON)
+		mux.HandleFunc("/metrics", m.serveMetrics)
+		mux.HandleFunc("/", m.serveDashboard)
+
+		server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				slog.Warn("Status server stopped", "err", err)
+			}
+		}()
+		slog.Info("Serving status (JSON: /status, Prometheus: /metrics)", "url", "http://"+addr+"/")
+	})
+}
+
+func (m *statusMonitor) serveJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(m.Snapshot())
+}
+
+// serveMetrics 输出 Prometheus 文本格式
+func (m *statusMonitor) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	snap := m.Snapshot()
+
+	var b strings.Builder
+	declared := make(map[string]bool)
+	metric := func(name, help, typ string, value float64, labels ...string) {
+		if !declared[name] {
+			declared[name] = true
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		}
+		if len(labels) > 0 {
+			fmt.Fprintf(&b, "%s{%s} %g\n", name, strings.Join(labels, ","), value)
+		} else {
+			fmt.Fprintf(&b, "%s %g\n", name, value)
+		}
+	}
+	boolValue := func(v bool) float64 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+
+	job := fmt.Sprintf("job=%q", snap.Job)
+	metric("smb_backup_running", "Whether a backup run is in progress.", "gauge", boolValue(snap.Running), job)
+	metric("smb_backup_paused", "Whether transfers are paused.", "gauge", boolValue(snap.Paused), job)
+
+	if p := snap.Progress; p != nil {
+		files := "smb_backup_files"
+		metric(files, "Files by state in the current or last run.", "gauge", float64(p.TotalFiles), job, `state="total"`)
+		metric(files, "", "gauge", float64(p.ProcessedFiles), job, `state="processed"`)
+		metric(files, "", "gauge", float64(p.FailedFiles), job, `state="failed"`)
+		metric(files, "", "gauge", float64(p.SkippedFiles), job, `state="skipped"`)
+		metric(files, "", "gauge", float64(p.InterruptedFiles), job, `state="interrupted"`)
+		metric(files, "", "gauge", float64(p.InconsistentFiles), job, `state="inconsistent"`)
+		metric("smb_backup_bytes", "Bytes by state in the current or last run.", "gauge", float64(p.TotalBytes), job, `state="total"`)
+		metric("smb_backup_bytes", "", "gauge", float64(p.ProcessedBytes), job, `state="processed"`)
+		metric("smb_backup_run_start_timestamp_seconds", "Start time of the current or last run.", "gauge", float64(p.StartTime.Unix()), job)
+	}
+	metric("smb_backup_errors", "Upload errors in the current or last run, including retried ones.", "gauge", float64(snap.Errors), job)
+	metric("smb_backup_speed_bytes_per_second", "Upload speed over the last interval.", "gauge", snap.Speed, job)
+	metric("smb_backup_eta_seconds", "Estimated time remaining, -1 if unknown.", "gauge", snap.ETA, job)
+	metric("smb_backup_active_workers", "Workers currently uploading a file.", "gauge", float64(len(snap.Workers)), job)
+
+	if p := snap.Pool; p != nil {
+		metric("smb_backup_pool_connections", "SMB connections by state.", "gauge", float64(p.InUse), `state="in_use"`)
+		metric("smb_backup_pool_connections", "", "gauge", float64(p.Idle), `state="idle"`)
+		metric("smb_backup_pool_connections", "", "gauge", float64(p.Emergency), `state="emergency"`)
+		metric("smb_backup_pool_recreated", "Connections recreated in this run.", "gauge", float64(p.Recreated))
+		metric("smb_backup_pool_failed", "Failed connection attempts in this run.", "gauge", float64(p.Failed))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, b.String())
+}
+
+func (m *statusMonitor) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, dashboardHTML)
+}
+
+// dashboardHTML 页面本身不含数据，由脚本每 2 秒请求 /status 刷新
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>smb-backup</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { padding: 2px 8px; text-align: left; border-bottom: 1px solid #ddd; }
+.bar { width: 100%; max-width: 600px; height: 16px; background: #eee; }
+.fill { height: 100%; background: #4a8; }
+.final { color: #c33; }
+</style>
+</head>
+<body>
+<h2>smb-backup <span id="state"></span></h2>
+<div class="bar"><div class="fill" id="fill" style="width: 0"></div></div>
+<table id="summary"></table>
+<h3>Workers</h3>
+<table id="workers"></table>
+<h3>Recent errors</h3>
+<table id="errors"></table>
+<script>
+function gb(n) { return (n / 1073741824).toFixed(2) + " GB"; }
+function mbs(n) { return (n / 1048576).toFixed(2) + " MB/s"; }
+function dur(s) {
+  if (s < 0) return "unknown";
+  s = Math.round(s);
+  return Math.floor(s / 3600) + "h" + Math.floor(s % 3600 / 60) + "m" + (s % 60) + "s";
+}
+function esc(s) { var d = document.createElement("div"); d.textContent = s; return d.innerHTML; }
+function rows(id, list) { document.getElementById(id).innerHTML = list.join(""); }
+function refresh() {
+  fetch("status").then(function (r) { return r.json(); }).then(function (s) {
+    var state = s.running ? (s.paused ? "paused" : s.stopping ? "stopping" : "running") : "idle";
+    document.getElementById("state").textContent = (s.job ? s.job + " - " : "") + state;
+    var p = s.progress || {};
+    var pct = p.total_bytes ? p.processed_bytes / p.total_bytes * 100 : 0;
+    document.getElementById("fill").style.width = pct.toFixed(1) + "%";
+    rows("summary", [
+      "<tr><th>Files</th><td>" + (p.processed_files || 0) + " / " + (p.total_files || 0) + (s.scanning ? " (scanning)" : "") + "</td></tr>",
+      "<tr><th>Bytes</th><td>" + gb(p.processed_bytes || 0) + " / " + gb(p.total_bytes || 0) + " (" + pct.toFixed(1) + "%)</td></tr>",
+      "<tr><th>Speed</th><td>" + mbs(s.speed_bytes_per_second) + " (avg " + mbs(s.avg_speed_bytes_per_second) + ")</td></tr>",
+      "<tr><th>ETA</th><td>" + dur(s.eta_seconds) + "</td></tr>",
+      "<tr><th>Failed</th><td>" + (p.failed_files || 0) + " files, " + s.errors + " errors</td></tr>",
+      s.pool ? "<tr><th>Pool</th><td>" + s.pool.in_use + " in use, " + s.pool.idle + " idle, " + s.pool.emergency + " emergency</td></tr>" : ""
+    ]);
+    rows("workers", s.workers.map(function (w) {
+      return "<tr><td>" + esc(w.worker) + "</td><td>" + esc(w.path) + "</td><td>" + gb(w.size) + "</td></tr>";
+    }));
+    rows("errors", s.recent_errors.slice().reverse().map(function (e) {
+      return "<tr" + (e.final ? ' class="final"' : "") + "><td>" + new Date(e.time).toLocaleTimeString() + "</td><td>" +
+        esc(e.class) + "</td><td>" + esc(e.path) + "</td><td>" + esc(e.error) + "</td></tr>";
+    }));
+  }).catch(function () {
+    document.getElementById("state").textContent = "- unreachable";
+  });
+}
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// RunSummary 一次运行的结果，保存到 state_dir/last-run.json
+type RunSummary struct {
+	Job               string    `json:"job,omitempty"`
+	StartTime         time.Time `json:"start_time"`
+	EndTime           time.Time `json:"end_time"`
+	Interrupted       bool      `json:"interrupted"`
+	TotalFiles        int64     `json:"total_files"`
+	TotalBytes        int64     `json:"total_bytes"`
+	ProcessedFiles    int64     `json:"processed_files"`
+	ProcessedBytes    int64     `json:"processed_bytes"`
+	FailedFiles       int64     `json:"failed_files"`
+	SkippedFiles      int64     `json:"skipped_files"`
+	InterruptedFiles  int64     `json:"interrupted_files"`
+	InconsistentFiles int64     `json:"inconsistent_files"`
+	ScanErrors        int64     `json:"scan_errors"` // 扫描时无法访问的源路径和目录
+	DedupedFiles      int64     `json:"deduped_files,omitempty"`
+	DedupedBytes      int64     `json:"deduped_bytes,omitempty"`
+	CompressedFiles   int64     `json:"compressed_files,omitempty"`
+	CompressedBytes   int64     `json:"compressed_bytes,omitempty"`
+	CompressedStored  int64     `json:"compressed_stored,omitempty"`
+	SpecialFiles      int64     `json:"special_files,omitempty"`
+	LinkFiles         int64     `json:"link_files,omitempty"`
+	Dirs              int64     `json:"dirs,omitempty"`
+	DirFailures       int64     `json:"dir_failures,omitempty"`
+}
+
+func newRunSummary(config *Config, stats *Stats) RunSummary {
+	return RunSummary{
+		Job:               config.Name,
+		StartTime:         stats.StartTime,
+		EndTime:           time.Now(),
+		Interrupted:       control.Stopping(),
+		TotalFiles:        atomic.LoadInt64(&stats.TotalFiles),
+		TotalBytes:        atomic.LoadInt64(&stats.TotalBytes),
+		ProcessedFiles:    atomic.LoadInt64(&stats.ProcessedFiles),
+		ProcessedBytes:    atomic.LoadInt64(&stats.ProcessedBytes),
+		FailedFiles:       atomic.LoadInt64(&stats.FailedFiles),
+		SkippedFiles:      atomic.LoadInt64(&stats.SkippedFiles),
+		InterruptedFiles:  atomic.LoadInt64(&stats.InterruptedFiles),
+		InconsistentFiles: atomic.LoadInt64(&stats.InconsistentFiles),
+		ScanErrors:        atomic.LoadInt64(&stats.scanErrors),
+		DedupedFiles:      atomic.LoadInt64(&stats.DedupedFiles),
+		DedupedBytes:      atomic.LoadInt64(&stats.DedupedBytes),
+		CompressedFiles:   atomic.LoadInt64(&stats.CompressedFiles),
+		CompressedBytes:   atomic.LoadInt64(&stats.CompressedBytes),
+		CompressedStored:  atomic.LoadInt64(&stats.CompressedStored),
+		SpecialFiles:      atomic.LoadInt64(&stats.SpecialFiles),
+		LinkFiles:         atomic.LoadInt64(&stats.LinkFiles),
+		Dirs:              atomic.LoadInt64(&stats.Dirs),
+		DirFailures:       atomic.LoadInt64(&stats.DirFailures),
+	}
+}
+
+// writeJSONFile 先写临时文件再改名，避免中途退出留下半个文件
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func saveRunSummary(config *Config, summary RunSummary) error {
+	return writeJSONFile(filepath.Join(config.StateDir, "last-run.json"), summary)
+}